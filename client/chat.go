@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+
+	"realm/protocol"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// chatLines is how many chat lines are drawn.
+const chatLines = 8
+
+// the chat lines received and the room joined last, guarded by mutex
+var (
+	chatLog []string
+	room    string
+)
+
+// logChat adds a line to the chat drawn on screen.
+func logChat(line string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	chatLog = append(chatLog, line)
+	if len(chatLog) > chatLines {
+		chatLog = chatLog[len(chatLog)-chatLines:]
+	}
+}
+
+// updateInput reads the chat line. Enter starts it and sends it, Escape
+// drops it. While typing the keys do not move the player.
+func (g *Game) updateInput() {
+	if !g.typing {
+		if inpututil.IsKeyJustPressed(ebiten.KeyEnter) {
+			g.typing = true
+			g.input = g.input[:0]
+		}
+		return
+	}
+
+	g.input = ebiten.AppendInputChars(g.input)
+	if inpututil.IsKeyJustPressed(ebiten.KeyBackspace) && len(g.input) > 0 {
+		g.input = g.input[:len(g.input)-1]
+	}
+
+	switch {
+	case inpututil.IsKeyJustPressed(ebiten.KeyEscape):
+		g.typing = false
+	case inpututil.IsKeyJustPressed(ebiten.KeyEnter):
+		g.typing = false
+		p := command(string(g.input))
+		if p != nil && connected() {
+			send(p)
+		}
+	}
+}
+
+// command returns the message a chat line sends, nil for none.
+// "/join ROOM" joins a room, "/leave" leaves the current room or the one
+// named after it, and any other line is said in the current room.
+func command(line string) protocol.Payload {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	mutex.Lock()
+	current := room
+	mutex.Unlock()
+
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/join":
+		if arg == "" {
+			logChat("usage: /join ROOM")
+			return nil
+		}
+		return protocol.Join{Room: arg}
+
+	case "/leave":
+		if arg == "" {
+			arg = current
+		}
+		if arg == "" {
+			logChat("not in a chat room")
+			return nil
+		}
+		if strings.EqualFold(arg, current) {
+			mutex.Lock()
+			room = ""
+			mutex.Unlock()
+		}
+		return protocol.Leave{Room: arg}
+	}
+
+	if current == "" {
+		logChat("join a room first: /join ROOM")
+		return nil
+	}
+	return protocol.Say{Room: current, Text: line}
+}
+
+// drawChat draws the chat lines and the line being typed above the
+// bottom line of the screen.
+func (g *Game) drawChat(screen *ebiten.Image) {
+	y := screenHeight - 32
+	if g.typing {
+		ebitenutil.DebugPrintAt(screen, "> "+string(g.input)+"_", 0, y)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for i := len(chatLog) - 1; i >= 0; i-- {
+		y -= 16
+		ebitenutil.DebugPrintAt(screen, chatLog[i], 0, y)
+	}
+}
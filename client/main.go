@@ -3,14 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"image/color"
 	_ "image/png"
 	"log"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"realm/protocol"
+
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/hajimehoshi/ebiten/v2/vector"
 	"nhooyr.io/websocket"
 )
 
@@ -19,54 +27,193 @@ const (
 	screenHeight = 240
 )
 
+// wsURL adds the connection token in REALM_TOKEN to the websocket url,
+// the native client has no session cookie to send. The token is shown on
+// the account page of the forum.
+func wsURL(base string) string {
+	token := os.Getenv("REALM_TOKEN")
+	if token == "" {
+		return base
+	}
+	return base + "?token=" + url.QueryEscape(token)
+}
+
 type Game struct {
-	keys []ebiten.Key
+	keys   []ebiten.Key
+	dx, dy int8 // last movement intent sent
+	// the chat line being typed
+	typing bool
+	input  []rune
 }
 
+// encoding used on the wire, JSON is handy when debugging
+const encoding = protocol.Binary
+
 var (
-	conn   *websocket.Conn
-	tosend = make(chan []byte, 100)
+	tosend = make(chan protocol.Payload, 100)
+	seq    atomic.Uint32
+
+	mutex   sync.Mutex
+	me      string
+	players = make(map[string]protocol.Player)
+
+	// the last ping sent and the round trip of the last one answered
+	pingNonce atomic.Uint64
+	pingSent  atomic.Int64 // unix nanoseconds
+	rtt       atomic.Int64 // nanoseconds, zero until the first pong
 )
 
-func parseMessage(buffer []byte) error {
-	if len(buffer) == 0 {
-		return nil
+// connection is a websocket connection to the server with its own read
+// and write loops, both stop when either fails.
+type connection struct {
+	ws     *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// the live connection, nil while disconnected, guarded by connMutex
+var (
+	connMutex sync.Mutex
+	conn      *connection
+)
+
+func connected() bool {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+
+	return conn != nil
+}
+
+// close stops the loops of the connection and drops it, Update dials a
+// new one.
+func (c *connection) close() {
+	c.cancel()
+	c.ws.CloseNow()
+
+	connMutex.Lock()
+	if conn == c {
+		conn = nil
 	}
+	connMutex.Unlock()
+}
 
-	p := buffer[0]
-	switch p {
-	case '.':
-		log.Println(buffer[1:])
+// connect dials the server, says hello and joins again the room joined
+// before a reconnect, then starts the loops of the new connection.
+func connect() error {
+	//ws, _, err := websocket.Dial(context.Background(), "ws://127.0.0.1:8888/ws", nil)
+	ws, _, err := websocket.Dial(context.Background(), wsURL("wss://sp.crg.eti.br/ws"), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &connection{ws: ws, ctx: ctx, cancel: cancel}
+
+	seq.Store(0)
+	err = directSend(c, protocol.Hello{
+		Versions: protocol.SupportedVersions,
+		Encoding: encoding,
+	})
+	if err != nil {
+		c.close()
+		return err
+	}
+
+	mutex.Lock()
+	current := room
+	mutex.Unlock()
+	if current != "" {
+		err = directSend(c, protocol.Join{Room: current})
+		if err != nil {
+			c.close()
+			return err
+		}
+	}
+
+	connMutex.Lock()
+	conn = c
+	connMutex.Unlock()
+
+	go receiveLoop(c)
+	go sendLoop(c)
+
+	return nil
+}
+
+func parseMessage(m protocol.Message) error {
+	switch p := m.Payload.(type) {
+	case protocol.Welcome:
+		log.Printf("connected, protocol version %d, %s encoding\n", p.Version, p.Encoding)
+		mutex.Lock()
+		me = p.You
+		mutex.Unlock()
+	case protocol.Pong:
+		if p.Nonce == pingNonce.Load() {
+			rtt.Store(time.Now().UnixNano() - pingSent.Load())
+		}
+	case protocol.Error:
+		log.Printf("server error: %s\n", p.Message)
+		logChat("error: " + p.Message)
+	case protocol.Text:
+		log.Printf("%s: %s\n", p.From, p.Text)
+	case protocol.Chat:
+		log.Printf("[%s] %s: %s\n", p.Room, p.From, p.Text)
+		logChat(fmt.Sprintf("[%s] %s: %s", p.Room, p.From, p.Text))
+	case protocol.History:
+		// the history answers a join, the room is now the current one
+		mutex.Lock()
+		room = p.Room
+		mutex.Unlock()
+		logChat("joined " + p.Room)
+		for _, c := range p.Messages {
+			log.Printf("[%s] %s: %s\n", c.Room, c.From, c.Text)
+			logChat(fmt.Sprintf("[%s] %s: %s", c.Room, c.From, c.Text))
+		}
+	case protocol.Snapshot:
+		mutex.Lock()
+		me = p.You
+		players = make(map[string]protocol.Player)
+		for _, pl := range p.Players {
+			players[pl.ID] = pl
+		}
+		mutex.Unlock()
+	case protocol.Delta:
+		mutex.Lock()
+		for _, pl := range p.Players {
+			players[pl.ID] = pl
+		}
+		for _, id := range p.Removed {
+			delete(players, id)
+		}
+		mutex.Unlock()
 	default:
-		log.Printf("unknown message: %s\n", string(buffer))
+		log.Printf("unexpected message: %s\n", m.Type())
 	}
 	return nil
 }
 
-func receiveLoop() {
-	var (
-		buffer []byte
-		mt     websocket.MessageType
-		err    error
-	)
+func receiveLoop(c *connection) {
+	defer c.close()
 
 	for {
-		if conn == nil {
-			return
-		}
 		//Receive
-		mt, buffer, err = conn.Read(context.Background())
+		mt, buffer, err := c.ws.Read(c.ctx)
 		if err != nil {
-			conn = nil
 			log.Println(err)
 			return
 		}
-		log.Printf("Message received: %s, message type %d\n", string(buffer), mt)
 
-		//conn.Close(websocket.StatusNormalClosure, "Websocket: normal closure")
+		enc := protocol.Binary
+		if mt == websocket.MessageText {
+			enc = protocol.JSON
+		}
+		m, err := protocol.Decode(enc, buffer)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 
 		//Parse
-		err = parseMessage(buffer)
+		err = parseMessage(m)
 		if err != nil {
 			log.Println(err)
 			return
@@ -74,39 +221,51 @@ func receiveLoop() {
 	}
 }
 
-func directSend(msg []byte) error {
+func directSend(c *connection, p protocol.Payload) error {
 	//Send
-
-	if conn == nil {
-		return fmt.Errorf("conn is nil")
-	}
-
-	err := conn.Write(context.Background(), websocket.MessageBinary, msg)
+	msg, err := protocol.Encode(encoding, protocol.Message{
+		Seq:     seq.Add(1),
+		Time:    time.Now(),
+		Payload: p,
+	})
 	if err != nil {
-		log.Println(err)
-		conn = nil
 		return err
 	}
-	log.Printf("Message send: %s\n", string(msg))
-	return nil
+
+	mt := websocket.MessageBinary
+	if encoding == protocol.JSON {
+		mt = websocket.MessageText
+	}
+
+	return c.ws.Write(c.ctx, mt, msg)
 }
 
-func send(msg []byte) {
-	tosend <- msg
+func send(p protocol.Payload) {
+	tosend <- p
 }
 
-func sendLoop() {
-	var err error
+func sendLoop(c *connection) {
+	defer c.close()
+
+	var (
+		err   error
+		nonce uint64
+	)
 	for {
 		select {
+		case <-c.ctx.Done():
+			return
 		case <-time.After(1 * time.Second):
-			err = directSend([]byte("!ping"))
+			nonce++
+			pingNonce.Store(nonce)
+			pingSent.Store(time.Now().UnixNano())
+			err = directSend(c, protocol.Ping{Nonce: nonce})
 			if err != nil {
 				log.Println(err)
 				return
 			}
 		case msg := <-tosend:
-			err = directSend(msg)
+			err = directSend(c, msg)
 			if err != nil {
 				log.Println(err)
 				return
@@ -115,29 +274,54 @@ func sendLoop() {
 	}
 }
 
+// movement returns the direction of the arrow or WASD keys held down.
+func movement() (dx, dy int8) {
+	if ebiten.IsKeyPressed(ebiten.KeyArrowLeft) || ebiten.IsKeyPressed(ebiten.KeyA) {
+		dx--
+	}
+	if ebiten.IsKeyPressed(ebiten.KeyArrowRight) || ebiten.IsKeyPressed(ebiten.KeyD) {
+		dx++
+	}
+	if ebiten.IsKeyPressed(ebiten.KeyArrowUp) || ebiten.IsKeyPressed(ebiten.KeyW) {
+		dy--
+	}
+	if ebiten.IsKeyPressed(ebiten.KeyArrowDown) || ebiten.IsKeyPressed(ebiten.KeyS) {
+		dy++
+	}
+	return dx, dy
+}
+
 func (g *Game) Update() error {
 	g.keys = inpututil.AppendPressedKeys(g.keys[:0])
 
-	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
+	if inpututil.IsKeyJustPressed(ebiten.KeySpace) && !g.typing {
 		log.Println(g.keys)
 	}
 
-	var err error
+	g.updateInput()
 
-	if conn == nil {
+	if !connected() {
 		log.Println("connecting...")
-		//conn, _, err = websocket.Dial(context.Background(), "ws://127.0.0.1:8888/ws", nil)
-		conn, _, err = websocket.Dial(context.Background(), "wss://sp.crg.eti.br/ws", nil)
+		err := connect()
 		if err != nil {
-			conn = nil
 			log.Println(err)
 			return nil
 		}
+		// the server starts the new player standing still
+		g.dx, g.dy = 0, 0
+		return nil
+	}
 
-		go receiveLoop()
-		go sendLoop()
+	// movement intent, the server moves the player, while the chat line
+	// is open the keys type into it
+	var dx, dy int8
+	if !g.typing {
+		dx, dy = movement()
+	}
+	if dx != g.dx || dy != g.dy {
+		g.dx, g.dy = dx, dy
+		send(protocol.Move{DX: dx, DY: dy})
 	}
-	//defer conn.Close(websocket.StatusInternalError, "Websocket: internal Error")
 
 	return nil
 }
@@ -145,10 +329,35 @@ func (g *Game) Update() error {
 var keyStrs = []string{}
 
 func (g *Game) Draw(screen *ebiten.Image) {
+	mutex.Lock()
+	// camera centered on our own player
+	var camX, camY int32
+	if p, ok := players[me]; ok {
+		camX = p.X - screenWidth/2
+		camY = p.Y - screenHeight/2
+	}
+	for id, p := range players {
+		c := color.RGBA{0x80, 0x80, 0xff, 0xff}
+		if id == me {
+			c = color.RGBA{0xff, 0xff, 0x80, 0xff}
+		}
+		x := float32(p.X - camX)
+		y := float32(p.Y - camY)
+		vector.DrawFilledRect(screen, x-4, y-4, 8, 8, c, false)
+		ebitenutil.DebugPrintAt(screen, p.Nick, int(x)-4, int(y)+6)
+	}
+	mutex.Unlock()
+
 	for _, p := range g.keys {
 		keyStrs = append(keyStrs, p.String())
 	}
 	ebitenutil.DebugPrint(screen, strings.Join(keyStrs, ", "))
+
+	g.drawChat(screen)
+
+	if d := time.Duration(rtt.Load()); d > 0 {
+		ebitenutil.DebugPrintAt(screen, fmt.Sprintf("rtt %d ms", d.Milliseconds()), 0, screenHeight-16)
+	}
 }
 
 func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
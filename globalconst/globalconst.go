@@ -3,4 +3,12 @@ package globalconst
 const (
 	CookieName   = "forum_session"
 	TimeToExpire = 24 * 60 * 60 // 24 horas
+
+	MaxTitleLength   = 200
+	MaxContentLength = 20000
+	MaxChatLength    = 2000
+	ThreadsPerPage   = 25
+	CommentsPerPage  = 50
+	SearchPerPage    = 20
+	MaxBanDays       = 3650 // longer bans are permanent ones
 )
@@ -4,9 +4,13 @@ go 1.22
 
 require (
 	crg.eti.br/go/config v1.5.0
+	github.com/coreos/go-oidc/v3 v3.11.0
 	github.com/dghubble/gologin/v2 v2.5.0
+	github.com/go-jose/go-jose/v4 v4.0.2
 	github.com/hajimehoshi/ebiten/v2 v2.7.7
 	github.com/jmoiron/sqlx v1.4.0
+	github.com/lib/pq v1.10.9
+	golang.org/x/net v0.27.0
 	golang.org/x/oauth2 v0.21.0
 	modernc.org/sqlite v1.30.1
 	nhooyr.io/websocket v1.8.11
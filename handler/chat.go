@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"realm/globalconst"
+	"realm/model"
+	"realm/permission"
+	"realm/protocol"
+	"realm/store"
+	"realm/util"
+)
+
+const (
+	HistoryPageSize    = 50
+	MaxHistoryPageSize = 200
+)
+
+// sendError answers a request that failed, the connection stays open.
+func sendError(user *connectedUser, msg string) {
+	user.send(protocol.Error{Message: msg})
+}
+
+// join adds the user to a chat room and sends a page of its history.
+// Room names are matched in lower case, as in leave and say.
+func (h *Handler) join(user *connectedUser, j protocol.Join) {
+	room, err := h.store.GetChatRoom(strings.ToLower(j.Room))
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(user, "chat room not found: "+j.Room)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		sendError(user, "could not join "+j.Room)
+		return
+	}
+
+	limit := int(j.Limit)
+	if limit <= 0 {
+		limit = HistoryPageSize
+	}
+	if limit > MaxHistoryPageSize {
+		limit = MaxHistoryPageSize
+	}
+
+	// one more than asked tells if there are older messages
+	messageList, err := h.store.GetChatMessagePage(room.NameSlug, j.Before, limit+1)
+	if err != nil {
+		log.Println(err)
+		sendError(user, "could not load the history of "+j.Room)
+		return
+	}
+
+	history := protocol.History{Room: room.NameSlug}
+	if len(messageList) > limit {
+		history.More = true
+		messageList = messageList[1:]
+	}
+	for _, msg := range messageList {
+		history.Messages = append(history.Messages, chatPayload(msg))
+	}
+
+	h.hub.setRoom(user, room.NameSlug, true)
+
+	user.send(history)
+}
+
+// canChat reports whether the user may send messages, answering with an
+// error when not.
+func (h *Handler) canChat(user *connectedUser) bool {
+	if user.userID == "" {
+		sendError(user, "login to chat")
+		return false
+	}
+
+	ok, err := h.perms.Can(user.userID, permission.Chat, "")
+	if err != nil {
+		log.Println(err)
+		sendError(user, "could not send the message")
+		return false
+	}
+	if !ok {
+		sendError(user, "you are not allowed to chat")
+		return false
+	}
+
+	return true
+}
+
+// text relays a text message to every other connection.
+func (h *Handler) text(user *connectedUser, t protocol.Text) {
+	if !h.canChat(user) {
+		return
+	}
+
+	t.Text = strings.TrimSpace(t.Text)
+	if t.Text == "" {
+		return
+	}
+	if utf8.RuneCountInString(t.Text) > globalconst.MaxChatLength {
+		sendError(user, "message too long")
+		return
+	}
+
+	t.From = user.id
+	h.hub.broadcast(t, user)
+}
+
+// say saves a message sent to a joined room and delivers it to every
+// member of the room, the sender included.
+func (h *Handler) say(user *connectedUser, s protocol.Say) {
+	if !h.canChat(user) {
+		return
+	}
+
+	room := strings.ToLower(s.Room)
+	if !h.hub.inRoom(user, room) {
+		sendError(user, "not in chat room "+s.Room)
+		return
+	}
+
+	text := strings.TrimSpace(s.Text)
+	if text == "" {
+		return
+	}
+	if utf8.RuneCountInString(text) > globalconst.MaxChatLength {
+		sendError(user, "message too long")
+		return
+	}
+
+	msg := model.ChatMessage{
+		ID:      util.RandomID(),
+		RoomID:  room,
+		UserID:  user.userID,
+		Content: text,
+	}
+	err := h.store.CreateChatMessage(&msg)
+	if err != nil {
+		log.Println(err)
+		sendError(user, "could not send the message")
+		return
+	}
+
+	// read it back for the time set by the database
+	saved, err := h.store.GetChatMessage(msg.ID)
+	if err != nil {
+		log.Println(err)
+		sendError(user, "could not send the message")
+		return
+	}
+
+	chat := chatPayload(model.ChatMessageView{
+		ChatMessage: *saved,
+		UserName:    user.nick,
+	})
+	for _, member := range h.hub.roomMembers(room) {
+		member.send(chat)
+	}
+}
+
+func chatPayload(msg model.ChatMessageView) protocol.Chat {
+	return protocol.Chat{
+		ID:   msg.ID,
+		Room: msg.RoomID,
+		From: msg.UserName,
+		Text: msg.Content,
+		Time: msg.CreatedAt,
+	}
+}
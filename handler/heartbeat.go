@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Heartbeat sets how often the server pings each connection and how many
+// pings in a row may go unanswered before the connection is closed.
+type Heartbeat struct {
+	Interval  time.Duration
+	MaxMissed int
+}
+
+// DefaultHeartbeat fills the zero fields of the Heartbeat given to New.
+var DefaultHeartbeat = Heartbeat{
+	Interval:  15 * time.Second,
+	MaxMissed: 3,
+}
+
+func (hb Heartbeat) withDefaults() Heartbeat {
+	if hb.Interval <= 0 {
+		hb.Interval = DefaultHeartbeat.Interval
+	}
+	if hb.MaxMissed <= 0 {
+		hb.MaxMissed = DefaultHeartbeat.MaxMissed
+	}
+	return hb
+}
+
+// touch records that the client was heard from.
+func (u *connectedUser) touch() {
+	u.lastSeen.Store(time.Now().UnixNano())
+}
+
+// heartbeat pings u every interval until it is stopped, a pong waits for
+// the reader goroutine to read it.
+func (h *Handler) heartbeat(u *connectedUser) {
+	ticker := time.NewTicker(h.hb.Interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.hb.Interval)
+		err := u.conn.Ping(ctx)
+		cancel()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err == nil {
+			missed = 0
+			u.touch()
+			continue
+		}
+
+		missed++
+		if missed >= h.hb.MaxMissed {
+			lastSeen := time.Unix(0, u.lastSeen.Load())
+			log.Printf("user %s missed %d heartbeats, last seen %s ago\n",
+				u.id, missed, time.Since(lastSeen).Round(time.Second))
+			u.drop()
+			return
+		}
+	}
+}
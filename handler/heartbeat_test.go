@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatTimeout(t *testing.T) {
+	ts := newTestServer(t, Options{
+		Heartbeat: Heartbeat{Interval: 50 * time.Millisecond, MaxMissed: 2},
+	})
+	_, _, aliceToken := ts.login(t, "alice")
+	_, _, bobToken := ts.login(t, "bob")
+
+	// alice never reads again, so her pongs are never sent
+	idle := ts.connect(t, aliceToken)
+
+	// bob keeps reading and answers every ping
+	active := ts.connect(t, bobToken)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			_, _, err := active.Read(context.Background())
+			if err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	users := func() int {
+		ts.handler.hub.mu.RLock()
+		defer ts.handler.hub.mu.RUnlock()
+		return len(ts.handler.hub.users)
+	}
+	waitFor(t, "both users to register", func() bool { return users() == 2 })
+	waitFor(t, "the idle user to unregister", func() bool { return users() == 1 })
+
+	// the server dropped the connection, reading drains what was sent
+	// before and then fails
+	readCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		_, _, err := idle.Read(readCtx)
+		if err != nil {
+			if readCtx.Err() != nil {
+				t.Error("idle connection still open")
+			}
+			break
+		}
+	}
+
+	// the answering user outlives several intervals
+	time.Sleep(300 * time.Millisecond)
+	if n := users(); n != 1 {
+		t.Errorf("%d users after the timeout, want the active one", n)
+	}
+	select {
+	case err := <-closed:
+		t.Errorf("active connection closed: %v", err)
+	default:
+	}
+}
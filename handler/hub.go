@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"realm/protocol"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	// SendQueueSize is how many messages may wait for a slow client
+	// before it is disconnected.
+	SendQueueSize = 256
+	// WriteTimeout is how long a single write may take.
+	WriteTimeout = 10 * time.Second
+)
+
+// connectedUser is one connection, a user may have several in other tabs
+// or devices that share the same player.
+type connectedUser struct {
+	conn      *websocket.Conn
+	id        string // public id of the player, the session id is never sent to clients
+	nick      string
+	sessionID string            // never stored for guests
+	userID    string            // empty for guests
+	playerKey string            // the user id, or the session id of a guest
+	encoding  protocol.Encoding // negotiated in the handshake
+	seq       atomic.Uint32     // last sequence number sent
+	lastSeen  atomic.Int64      // unix nanoseconds of the last message or pong
+	rooms     map[string]bool   // joined chat rooms, guarded by hub.mu
+
+	queue chan protocol.Payload // written by writeLoop
+	done  chan struct{}         // closed by stop
+	once  sync.Once
+}
+
+func newConnectedUser(conn *websocket.Conn, nick, sessionID, userID string) *connectedUser {
+	key := userID
+	if key == "" {
+		key = sessionID
+	}
+
+	u := &connectedUser{
+		conn:      conn,
+		id:        playerID(key),
+		nick:      nick,
+		sessionID: sessionID,
+		userID:    userID,
+		playerKey: key,
+		rooms:     make(map[string]bool),
+		queue:     make(chan protocol.Payload, SendQueueSize),
+		done:      make(chan struct{}),
+	}
+	u.touch()
+
+	return u
+}
+
+// playerID returns the public id of the player with the given key, the
+// same for every connection of the player.
+func playerID(key string) string {
+	sum := sha256.Sum256([]byte("player:" + key))
+	return hex.EncodeToString(sum[:12])
+}
+
+// send queues p for the writer goroutine without blocking, a user whose
+// queue is full is disconnected.
+func (u *connectedUser) send(p protocol.Payload) {
+	select {
+	case <-u.done:
+		return
+	default:
+	}
+
+	select {
+	case u.queue <- p:
+	default:
+		log.Printf("user %s is too slow, disconnecting\n", u.id)
+		u.stop(websocket.StatusPolicyViolation, "too slow")
+	}
+}
+
+// stop ends the writer goroutine and closes the connection, which ends
+// the reader that unregisters the user. It does not block.
+func (u *connectedUser) stop(code websocket.StatusCode, reason string) {
+	u.once.Do(func() {
+		close(u.done)
+		go u.conn.Close(code, reason)
+	})
+}
+
+// drop is stop for a peer that stopped answering, it closes the
+// connection without waiting for a close handshake that would not come.
+func (u *connectedUser) drop() {
+	u.once.Do(func() {
+		close(u.done)
+		u.conn.CloseNow()
+	})
+}
+
+// writeLoop writes the queued messages until the user is stopped, a
+// write that takes longer than timeout stops it.
+func (u *connectedUser) writeLoop(timeout time.Duration) {
+	for {
+		select {
+		case <-u.done:
+			return
+		case p := <-u.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := writeMessage(ctx, u.conn, u.encoding, protocol.Message{
+				Seq:     u.seq.Add(1),
+				Time:    time.Now(),
+				Payload: p,
+			})
+			cancel()
+			if err != nil {
+				log.Println("write:", err)
+				u.stop(websocket.StatusInternalError, "write failed")
+				return
+			}
+		}
+	}
+}
+
+// hub keeps the connections. They are added and removed by its run
+// goroutine, the other goroutines only read them. The world has one
+// player for all the connections with the same player key, added with
+// the first and removed with the last.
+type hub struct {
+	register   chan *connectedUser
+	unregister chan *connectedUser
+	// closing stops the connections a function matches, it is handled
+	// in order with the registrations so none is missed
+	closing      chan func(u *connectedUser) bool
+	world        *world
+	writeTimeout time.Duration
+
+	mu      sync.RWMutex
+	users   map[*connectedUser]bool
+	players map[string]map[*connectedUser]bool // by player key
+}
+
+func newHub(w *world) *hub {
+	return &hub{
+		register:     make(chan *connectedUser),
+		unregister:   make(chan *connectedUser),
+		closing:      make(chan func(u *connectedUser) bool),
+		world:        w,
+		writeTimeout: WriteTimeout,
+		users:        make(map[*connectedUser]bool),
+		players:      make(map[string]map[*connectedUser]bool),
+	}
+}
+
+func (h *hub) run() {
+	for {
+		select {
+		case u := <-h.register:
+			h.mu.Lock()
+			conns, online := h.players[u.playerKey]
+			if !online {
+				conns = make(map[*connectedUser]bool)
+				h.players[u.playerKey] = conns
+			}
+			conns[u] = true
+			h.users[u] = true
+			h.mu.Unlock()
+			if online {
+				// the new connection needs a snapshot of its own
+				h.world.resync(u.playerKey)
+			} else {
+				h.world.add(u.playerKey, u.id, u.nick)
+			}
+			go u.writeLoop(h.writeTimeout)
+
+		case u := <-h.unregister:
+			u.stop(websocket.StatusNormalClosure, "")
+			h.mu.Lock()
+			last := false
+			if h.users[u] {
+				delete(h.users, u)
+				conns := h.players[u.playerKey]
+				delete(conns, u)
+				last = len(conns) == 0
+				if last {
+					delete(h.players, u.playerKey)
+				}
+			}
+			h.mu.Unlock()
+			if last {
+				h.world.remove(u.playerKey)
+			}
+
+		case match := <-h.closing:
+			h.mu.RLock()
+			for u := range h.users {
+				if match(u) {
+					u.stop(websocket.StatusPolicyViolation, "session ended")
+				}
+			}
+			h.mu.RUnlock()
+		}
+	}
+}
+
+// sendTo sends p to every connection of the player with the given key.
+func (h *hub) sendTo(playerKey string, p protocol.Payload) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for u := range h.players[playerKey] {
+		u.send(p)
+	}
+}
+
+// broadcast sends p to every connection but except, which may be nil.
+func (h *hub) broadcast(p protocol.Payload, except *connectedUser) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for u := range h.users {
+		if u != except {
+			u.send(p)
+		}
+	}
+}
+
+// roomMembers returns the connections that joined room.
+func (h *hub) roomMembers(room string) []*connectedUser {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var members []*connectedUser
+	for u := range h.users {
+		if u.rooms[room] {
+			members = append(members, u)
+		}
+	}
+	return members
+}
+
+// setRoom records that u joined or left a room.
+func (h *hub) setRoom(u *connectedUser, room string, joined bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if joined {
+		u.rooms[room] = true
+	} else {
+		delete(u.rooms, room)
+	}
+}
+
+// inRoom reports whether u joined room.
+func (h *hub) inRoom(u *connectedUser, room string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return u.rooms[room]
+}
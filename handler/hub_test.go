@@ -0,0 +1,315 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"realm/protocol"
+	"realm/util"
+
+	"nhooyr.io/websocket"
+)
+
+// hubServer serves websocket connections as the users of a hub, without
+// the handshake. Each connection is a guest unless the client sends a
+// user id in the user query parameter.
+type hubServer struct {
+	hub      *hub
+	srv      *httptest.Server
+	accepted chan *connectedUser
+}
+
+// newHubServer starts a hub and a server for it. With register false the
+// users are accepted but never registered, so nothing drains their queue.
+func newHubServer(t *testing.T, register bool) *hubServer {
+	t.Helper()
+
+	hs := &hubServer{
+		hub:      newHub(newWorld()),
+		accepted: make(chan *connectedUser, 1024),
+	}
+	hs.hub.writeTimeout = 200 * time.Millisecond
+	go hs.hub.run()
+
+	hs.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		u := newConnectedUser(conn, "nick", util.RandomID(), r.URL.Query().Get("user"))
+		u.encoding = protocol.JSON
+
+		if register {
+			hs.hub.register <- u
+			defer func() { hs.hub.unregister <- u }()
+		}
+		hs.accepted <- u
+
+		for {
+			_, _, err := conn.Read(context.Background())
+			if err != nil {
+				u.stop(websocket.StatusNormalClosure, "")
+				return
+			}
+		}
+	}))
+	t.Cleanup(hs.srv.Close)
+
+	return hs
+}
+
+// dialConn opens a client connection that is closed when the test ends.
+func (hs *hubServer) dialConn(t *testing.T, query string) (*websocket.Conn, error) {
+	url := "ws" + strings.TrimPrefix(hs.srv.URL, "http") + "/?" + query
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(1 << 24)
+	t.Cleanup(func() { conn.CloseNow() })
+
+	return conn, nil
+}
+
+// dial opens a client connection and returns it with its server side
+// user, it must not run concurrently with other dials.
+func (hs *hubServer) dial(t *testing.T, query string) (*websocket.Conn, *connectedUser) {
+	t.Helper()
+
+	conn, err := hs.dialConn(t, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case u := <-hs.accepted:
+		return conn, u
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+		return nil, nil
+	}
+}
+
+// counts returns the number of connections, of players in the hub and of
+// players in the world.
+func (hs *hubServer) counts() (int, int, int) {
+	hs.hub.mu.RLock()
+	users, players := len(hs.hub.users), len(hs.hub.players)
+	hs.hub.mu.RUnlock()
+
+	hs.hub.world.mu.Lock()
+	defer hs.hub.world.mu.Unlock()
+
+	return users, players, len(hs.hub.world.players)
+}
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readText reads messages from conn until a Text arrives.
+func readText(ctx context.Context, conn *websocket.Conn) (protocol.Text, error) {
+	for {
+		_, b, err := conn.Read(ctx)
+		if err != nil {
+			return protocol.Text{}, err
+		}
+		m, err := protocol.Decode(protocol.JSON, b)
+		if err != nil {
+			return protocol.Text{}, err
+		}
+		if p, ok := m.Payload.(protocol.Text); ok {
+			return p, nil
+		}
+	}
+}
+
+func TestHubRegisterUnregister(t *testing.T) {
+	const clients = 300
+	hs := newHubServer(t, true)
+
+	conns := make([]*websocket.Conn, clients)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			conns[i], err = hs.dialConn(t, "")
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	waitFor(t, "registrations", func() bool {
+		users, players, inWorld := hs.counts()
+		return users == clients && players == clients && inWorld == clients
+	})
+
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Close(websocket.StatusNormalClosure, "")
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "unregistrations", func() bool {
+		users, players, inWorld := hs.counts()
+		return users == 0 && players == 0 && inWorld == 0
+	})
+}
+
+func TestHubSharedPlayer(t *testing.T) {
+	hs := newHubServer(t, true)
+
+	first, u1 := hs.dial(t, "user=u1")
+	second, u2 := hs.dial(t, "user=u1")
+	if u1.id != u2.id {
+		t.Errorf("connections of a user have ids %s and %s", u1.id, u2.id)
+	}
+
+	waitFor(t, "registrations", func() bool {
+		users, players, inWorld := hs.counts()
+		return users == 2 && players == 1 && inWorld == 1
+	})
+
+	first.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "first close", func() bool {
+		users, players, inWorld := hs.counts()
+		return users == 1 && players == 1 && inWorld == 1
+	})
+
+	second.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "second close", func() bool {
+		users, players, inWorld := hs.counts()
+		return users == 0 && players == 0 && inWorld == 0
+	})
+}
+
+func TestHubBroadcast(t *testing.T) {
+	const clients = 200
+	hs := newHubServer(t, true)
+
+	conns := make([]*websocket.Conn, clients)
+	users := make([]*connectedUser, clients)
+	for i := range conns {
+		conns[i], users[i] = hs.dial(t, "")
+	}
+	waitFor(t, "registrations", func() bool {
+		n, _, _ := hs.counts()
+		return n == clients
+	})
+
+	sender := users[0]
+	hs.hub.broadcast(protocol.Text{From: sender.id, Text: "hello"}, sender)
+
+	var wg sync.WaitGroup
+	for _, conn := range conns[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			text, err := readText(ctx, conn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if text.Text != "hello" || text.From != sender.id {
+				t.Errorf("got %+v", text)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the sender is left out, so a message sent to it later comes first
+	sender.send(protocol.Text{Text: "direct"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	text, err := readText(ctx, conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text.Text != "direct" {
+		t.Errorf("sender got %q", text.Text)
+	}
+}
+
+func TestHubEvictsFullQueue(t *testing.T) {
+	hs := newHubServer(t, false)
+	conn, u := hs.dial(t, "")
+
+	for i := 0; i < SendQueueSize; i++ {
+		u.send(protocol.Text{Text: "queued"})
+	}
+	select {
+	case <-u.done:
+		t.Fatal("stopped before the queue was full")
+	default:
+	}
+
+	u.send(protocol.Text{Text: "one too many"})
+	select {
+	case <-u.done:
+	case <-time.After(time.Second):
+		t.Fatal("not stopped with a full queue")
+	}
+
+	_, _, err := conn.Read(context.Background())
+	if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("read %v, want policy violation", err)
+	}
+}
+
+func TestHubWriteTimeout(t *testing.T) {
+	hs := newHubServer(t, true)
+	// the client never reads, so the writes block once the socket
+	// buffers are full
+	_, u := hs.dial(t, "")
+
+	payload := protocol.Text{Text: strings.Repeat("x", 256<<10)}
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case <-u.done:
+			waitFor(t, "unregistration", func() bool {
+				users, _, _ := hs.counts()
+				return users == 0
+			})
+			return
+		case <-deadline:
+			t.Fatal("blocked writer not stopped")
+		default:
+		}
+
+		// stay below the queue size, so only the timeout can stop it
+		if len(u.queue) < SendQueueSize/2 {
+			u.send(payload)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -2,164 +2,306 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"realm/model"
+	"realm/permission"
+	"realm/protocol"
 	"realm/session"
-	"sync"
+	"realm/store"
+	"realm/util"
+	"strings"
 	"time"
 
 	"nhooyr.io/websocket"
 )
 
-type connectedUser struct {
-	conn      *websocket.Conn
-	nick      string
-	sessionID string
-	x, y      int
+// handshakeTimeout is how long a client has to send its Hello.
+const handshakeTimeout = 10 * time.Second
+
+// Options configures a Handler.
+type Options struct {
+	Heartbeat Heartbeat
+	// Guests lets clients without a logged in session connect.
+	Guests bool
+	// Origins are the host patterns, as in path.Match, of the pages
+	// besides the server itself that may open the websocket. Clients that
+	// send no Origin, such as the native one, are not checked.
+	Origins []string
 }
 
-var (
-	mutex          sync.Mutex
-	connectedUsers = make(map[string]connectedUser)
-)
+// Handler serves the websocket endpoint with the store and the session
+// control given to New.
+type Handler struct {
+	store    store.Store
+	sessions *session.Control
+	perms    *permission.Checker
+	hub      *hub
+	hb       Heartbeat
+	guests   bool
+	origins  []string
+}
 
-func removeUser(sessionID string) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	delete(connectedUsers, sessionID)
+// New returns a Handler and starts its hub and world.
+func New(st store.Store, sc *session.Control, opts Options) *Handler {
+	w := newWorld()
+	h := newHub(w)
+	go h.run()
+	go w.run(h)
+
+	return &Handler{
+		store:    st,
+		sessions: sc,
+		perms:    permission.New(st),
+		hub:      h,
+		hb:       opts.Heartbeat.withDefaults(),
+		guests:   opts.Guests,
+		origins:  opts.Origins,
+	}
 }
 
-func addUser(sessionID string, user connectedUser) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	connectedUsers[sessionID] = user
+// CloseSession disconnects the websockets opened with a session, for a
+// session that ended.
+func (h *Handler) CloseSession(sessionID string) {
+	h.hub.closing <- func(u *connectedUser) bool {
+		return u.userID != "" && u.sessionID == sessionID
+	}
 }
 
-func broadcast(buffer []byte) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for _, user := range connectedUsers {
-		err := send(user.conn, buffer)
-		if err != nil {
-			log.Println(err)
-			removeUser(user.sessionID)
+// CloseEnded disconnects the websockets whose session is no longer
+// active, for sessions that ended without a call to CloseSession.
+func (h *Handler) CloseEnded() {
+	h.hub.mu.RLock()
+	sessionIDs := make(map[string]bool)
+	for u := range h.hub.users {
+		if u.userID != "" {
+			sessionIDs[u.sessionID] = true
 		}
 	}
+	h.hub.mu.RUnlock()
+
+	for id := range sessionIDs {
+		if !h.sessions.Active(id) {
+			h.CloseSession(id)
+		}
+	}
+}
+
+// CloseUser disconnects every websocket of a user.
+func (h *Handler) CloseUser(userID string) {
+	h.hub.closing <- func(u *connectedUser) bool {
+		return u.userID == userID
+	}
 }
 
-func send(conn *websocket.Conn, buffer []byte) error {
-	err := conn.Write(
-		context.Background(),
-		websocket.MessageText,
-		buffer,
-	)
+// writeMessage writes m in a text frame for JSON and in a binary frame
+// for the binary encoding.
+func writeMessage(ctx context.Context, conn *websocket.Conn, enc protocol.Encoding, m protocol.Message) error {
+	buffer, err := protocol.Encode(enc, m)
+	if err != nil {
+		return err
+	}
+
+	mt := websocket.MessageBinary
+	if enc == protocol.JSON {
+		mt = websocket.MessageText
+	}
+
+	err = conn.Write(ctx, mt, buffer)
 	if err != nil {
 		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
 			log.Println("Connection closed normally")
-			conn = nil
 			return nil
 		}
 		return err
 	}
 
-	log.Printf("Message send: %s\n", string(buffer))
 	return nil
 }
 
-func parseMessage(userID string, conn *websocket.Conn, buffer []byte) error {
-	if len(buffer) == 0 {
-		return nil
+// decodeError is returned by readMessage when a frame was read but is not
+// a valid message, the connection is still usable.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return "decode: " + e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// readMessage reads a message, the frame type tells the encoding.
+func readMessage(ctx context.Context, conn *websocket.Conn) (protocol.Message, protocol.Encoding, error) {
+	mt, buffer, err := conn.Read(ctx)
+	if err != nil {
+		return protocol.Message{}, "", err
 	}
 
-	p := buffer[0]
+	enc := protocol.Binary
+	if mt == websocket.MessageText {
+		enc = protocol.JSON
+	}
 
-	switch p {
-	case '!':
-		log.Printf("Ping received from %s, sessionID: %s\n",
-			userID,
-			connectedUsers[userID].sessionID)
-	case '~':
-		buffer[0] = '.' //Replace ~ with .
-		for _, user := range connectedUsers {
-			if user.sessionID == userID {
-				continue
-			}
-			err := send(user.conn, buffer)
-			if err != nil {
-				log.Println(err)
-				removeUser(user.sessionID)
-			}
+	m, err := protocol.Decode(enc, buffer)
+	if err != nil {
+		return protocol.Message{}, enc, &decodeError{err}
+	}
+	return m, enc, nil
+}
+
+// handshake waits for the Hello of the client and answers with a Welcome,
+// or with an Error when no common version exists.
+func handshake(conn *websocket.Conn, id string) (protocol.Encoding, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	m, enc, err := readMessage(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+
+	hello, ok := m.Payload.(protocol.Hello)
+	if !ok {
+		err = fmt.Errorf("expected hello, got %s", m.Type())
+		_ = writeMessage(ctx, conn, enc, protocol.Message{
+			Seq:     1,
+			Time:    time.Now(),
+			Payload: protocol.Error{Message: err.Error()},
+		})
+		return "", err
+	}
+
+	// the client may ask for the other encoding once connected
+	if hello.Encoding == protocol.JSON || hello.Encoding == protocol.Binary {
+		enc = hello.Encoding
+	}
+
+	version, ok := protocol.Negotiate(hello.Versions, protocol.SupportedVersions)
+	if !ok {
+		err = fmt.Errorf("no common protocol version in %v", hello.Versions)
+		_ = writeMessage(ctx, conn, enc, protocol.Message{
+			Seq:     1,
+			Time:    time.Now(),
+			Payload: protocol.Error{Message: err.Error()},
+		})
+		return "", err
+	}
+
+	err = writeMessage(ctx, conn, enc, protocol.Message{
+		Seq:  1,
+		Time: time.Now(),
+		Payload: protocol.Welcome{
+			Version:  version,
+			Encoding: enc,
+			You:      id,
+		},
+	})
+	return enc, err
+}
+
+func (h *Handler) parseMessage(user *connectedUser, m protocol.Message) error {
+	switch p := m.Payload.(type) {
+	case protocol.Ping:
+		// the client measures the round trip with the pong
+		user.send(protocol.Pong{Nonce: p.Nonce})
+	case protocol.Text:
+		h.text(user, p)
+	case protocol.Move:
+		err := h.hub.world.setIntent(user.playerKey, p)
+		if err != nil {
+			log.Println(err)
 		}
-	case '.':
-		log.Printf("Message received: %s\n", string(buffer))
+	case protocol.Join:
+		h.join(user, p)
+	case protocol.Leave:
+		h.hub.setRoom(user, strings.ToLower(p.Room), false)
+	case protocol.Say:
+		h.say(user, p)
 	default:
-		log.Printf("Unknown message received: %s\n", string(buffer))
+		return fmt.Errorf("unexpected %s message", m.Type())
 	}
 
 	return nil
 }
 
-func Websocket(w http.ResponseWriter, r *http.Request) {
-	var (
-		conn   *websocket.Conn
-		buffer []byte
-		mt     websocket.MessageType
-		err    error
-	)
+// connSession returns the session of a websocket request, from the
+// token query parameter of the native client or from the cookie.
+func (h *Handler) connSession(r *http.Request) (string, *model.SessionData, bool) {
+	token := r.URL.Query().Get("token")
+	if token != "" {
+		return h.sessions.FromToken(token)
+	}
+	return h.sessions.Get(r)
+}
 
-	sid, sd, ok := session.SC.Get(r)
-	if !ok {
-		log.Println("ws session not found")
-		sid, sd = session.SC.Create()
+// Websocket accepts the connection of a logged in user, or of a guest
+// when guests are allowed.
+func (h *Handler) Websocket(w http.ResponseWriter, r *http.Request) {
+	sid, sd, ok := h.connSession(r)
+	loggedIn := ok && sd.LoggedIn
+	if !loggedIn && !h.guests {
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return
 	}
 
-	conn, err = websocket.Accept(w, r, &websocket.AcceptOptions{
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		CompressionMode: websocket.CompressionDisabled,
-		OriginPatterns:  []string{"*"},
+		OriginPatterns:  h.origins,
 	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	user := connectedUser{
-		conn:      conn,
-		nick:      sd.UserName,
-		x:         0,
-		y:         0,
-		sessionID: sid,
+	var user *connectedUser
+	if loggedIn {
+		user = newConnectedUser(conn, sd.UserName, sid, sd.UserID)
+	} else {
+		// guests are keyed by a session id that is never stored
+		user = newConnectedUser(conn, "guest", util.RandomID(), "")
 	}
 
-	addUser(user.sessionID, user)
+	user.encoding, err = handshake(conn, user.id)
+	if err != nil {
+		log.Println("handshake:", err)
+		conn.Close(websocket.StatusPolicyViolation, "handshake failed")
+		return
+	}
+	user.seq.Store(1) // the welcome
 
-	initTime := time.Now()
+	h.hub.register <- user
+	defer func() { h.hub.unregister <- user }()
+	// a session that ended while connecting was not seen by CloseSession
+	if loggedIn && !h.sessions.Active(sid) {
+		user.stop(websocket.StatusPolicyViolation, "session ended")
+		return
+	}
+	go h.heartbeat(user)
 
-	go func() {
-		for {
-			//Receive
-			initTime = time.Now()
-			mt, buffer, err = conn.Read(context.Background())
-			if err != nil {
-				conn = nil
-				removeUser(user.sessionID)
-				if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-					log.Println("Connection closed normally")
-					return
-				}
-				log.Println(err)
-				return
-			}
-			timeElapsed := time.Since(initTime)
-			log.Printf("Time elapsed: %s\n", timeElapsed)
-			log.Printf("Message received: %s, message type %d\n", string(buffer), mt)
-
-			//Parse
-			err = parseMessage(user.sessionID, conn, buffer)
-			if err != nil {
-				log.Println(err)
-				removeUser(user.sessionID)
+	for {
+		m, _, err := readMessage(context.Background(), conn)
+		var de *decodeError
+		if errors.As(err, &de) {
+			// a message that does not decode is answered and dropped
+			log.Println(err)
+			user.send(protocol.Error{Message: err.Error()})
+			continue
+		}
+		if err != nil {
+			if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+				log.Println("Connection closed normally")
 				return
 			}
+			log.Println(err)
+			return
+		}
+		user.touch()
+
+		err = h.parseMessage(user, m)
+		if err != nil {
+			log.Println(err)
+			user.stop(websocket.StatusPolicyViolation, "unexpected message")
+			return
 		}
-	}()
+	}
 }
@@ -0,0 +1,453 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"realm/globalconst"
+	"realm/memory"
+	"realm/model"
+	"realm/protocol"
+	"realm/session"
+
+	"nhooyr.io/websocket"
+)
+
+// testServer serves a Handler on a memory store.
+type testServer struct {
+	store    *memory.Memory
+	sessions *session.Control
+	handler  *Handler
+	srv      *httptest.Server
+}
+
+func newTestServer(t *testing.T, opts Options) *testServer {
+	t.Helper()
+
+	st := memory.New()
+	backend, err := session.NewWriteThrough(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := session.New("session", backend, []byte("secret"))
+
+	ts := &testServer{
+		store:    st,
+		sessions: sc,
+		handler:  New(st, sc, opts),
+	}
+	ts.srv = httptest.NewServer(http.HandlerFunc(ts.handler.Websocket))
+	t.Cleanup(ts.srv.Close)
+
+	return ts
+}
+
+// login creates a user, or finds the one with that name, and a logged in
+// session for it. It returns the user, the session id and a connection
+// token of the session.
+func (ts *testServer) login(t *testing.T, name string) (model.User, string, string) {
+	t.Helper()
+
+	user, err := ts.store.SaveUser(&model.User{
+		OAuthProvider: "github",
+		OAuthUserID:   name,
+		UserName:      name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := &model.SessionData{UserID: user.ID, UserName: name, LoggedIn: true}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	id := ts.sessions.Rotate(httptest.NewRecorder(), r, "", sd)
+	token, _ := ts.sessions.Token(id, sd)
+
+	return user, id, token
+}
+
+// dial opens a connection with token and returns the response of the
+// upgrade.
+func (ts *testServer) dial(t *testing.T, token string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(ts.srv.URL, "http") + "/?token=" + token
+	conn, resp, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		return nil, resp, err
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+
+	return conn, resp, nil
+}
+
+// connect dials with token and completes the handshake.
+func (ts *testServer) connect(t *testing.T, token string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := ts.dial(t, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send(t, conn, protocol.Hello{Versions: protocol.SupportedVersions, Encoding: protocol.JSON})
+	next[protocol.Welcome](t, conn)
+
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, p protocol.Payload) {
+	t.Helper()
+
+	b, err := protocol.Encode(protocol.JSON, protocol.Message{Seq: 1, Time: time.Now(), Payload: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Write(context.Background(), websocket.MessageText, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next reads messages from conn until a payload of type T arrives.
+func next[T protocol.Payload](t *testing.T, conn *websocket.Conn) T {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for {
+		_, b, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := protocol.Decode(protocol.JSON, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := m.Payload.(T); ok {
+			return p
+		}
+	}
+}
+
+func TestWebsocketLoginRequired(t *testing.T) {
+	ts := newTestServer(t, Options{})
+
+	_, resp, err := ts.dial(t, "")
+	if err == nil {
+		t.Fatal("connected without a session")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("response %v, want %d", resp, http.StatusUnauthorized)
+	}
+}
+
+func TestWebsocketRemovedSession(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	user, _, token := ts.login(t, "alice")
+	ts.sessions.RemoveUser(user.ID)
+
+	_, resp, err := ts.dial(t, token)
+	if err == nil {
+		t.Fatal("connected with the token of a removed session")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("response %v, want %d", resp, http.StatusUnauthorized)
+	}
+}
+
+// signToken returns a connection token of session id expiring at
+// expireAt, signed with the key session.New derives from "secret".
+func signToken(userID, id string, expireAt time.Time) string {
+	key := hmac.New(sha256.New, []byte("secret"))
+	key.Write([]byte("connection token"))
+
+	payload := userID + "." + session.Handle(id) + "." + strconv.FormatInt(expireAt.Unix(), 10)
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(payload))
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hello completes the handshake on conn and returns the player id the
+// server gave it.
+func hello(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+
+	send(t, conn, protocol.Hello{Versions: protocol.SupportedVersions, Encoding: protocol.JSON})
+	return next[protocol.Welcome](t, conn).You
+}
+
+func TestWebsocketBadToken(t *testing.T) {
+	for _, guests := range []bool{false, true} {
+		t.Run("guests="+strconv.FormatBool(guests), func(t *testing.T) {
+			ts := newTestServer(t, Options{Guests: guests})
+			alice, aliceID, aliceToken := ts.login(t, "alice")
+			bob, _, _ := ts.login(t, "bob")
+
+			conn, _, err := ts.dial(t, aliceToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			aliceYou := hello(t, conn)
+
+			// the same token signed here, before it expires, is good
+			conn, _, err = ts.dial(t, signToken(alice.ID, aliceID, time.Now().Add(time.Minute)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if you := hello(t, conn); you != aliceYou {
+				t.Fatalf("token signed in the test connected as %q, want %q", you, aliceYou)
+			}
+
+			tokens := map[string]string{
+				"tampered":      bob.ID + strings.TrimPrefix(aliceToken, alice.ID),
+				"bad signature": aliceToken[:len(aliceToken)-2] + "AA",
+				"expired":       signToken(alice.ID, aliceID, time.Now().Add(-time.Second)),
+			}
+			for name, token := range tokens {
+				conn, resp, err := ts.dial(t, token)
+				if !guests {
+					if err == nil {
+						t.Errorf("%s token: connected", name)
+						continue
+					}
+					if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+						t.Errorf("%s token: response %v, want %d", name, resp, http.StatusUnauthorized)
+					}
+					continue
+				}
+
+				// with guests allowed the bad token only makes a guest
+				if err != nil {
+					t.Errorf("%s token: %v", name, err)
+					continue
+				}
+				if you := hello(t, conn); you == aliceYou {
+					t.Errorf("%s token: connected as alice", name)
+				}
+				send(t, conn, protocol.Say{Room: "lobby", Text: "hi"})
+				if e := next[protocol.Error](t, conn); !strings.Contains(e.Message, "login") {
+					t.Errorf("%s token: say error = %q, want a login error", name, e.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	ts := newTestServer(t, Options{Origins: []string{"realm.example"}})
+	_, _, token := ts.login(t, "alice")
+
+	url := "ws" + strings.TrimPrefix(ts.srv.URL, "http") + "/?token=" + token
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true}, // native client
+		{ts.srv.URL, true},
+		{"https://realm.example", true},
+		{"https://evil.example", false},
+		{"https://realm.example.evil.example", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: header})
+		if err == nil {
+			conn.CloseNow()
+		}
+		if tt.ok && err != nil {
+			t.Errorf("origin %q: %v", tt.origin, err)
+		}
+		if !tt.ok && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q: connected or wrong response %v", tt.origin, resp)
+		}
+	}
+}
+
+func TestWebsocketChat(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice, _, aliceToken := ts.login(t, "alice")
+	_, _, bobToken := ts.login(t, "bob")
+
+	room := model.ChatRoom{Name: "Lobby"}
+	if err := ts.store.CreateChatRoom(&room); err != nil {
+		t.Fatal(err)
+	}
+	err := ts.store.CreateChatMessage(&model.ChatMessage{ID: "m1", RoomID: room.NameSlug, UserID: alice.ID, Content: "earlier"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceConn := ts.connect(t, aliceToken)
+	bobConn := ts.connect(t, bobToken)
+
+	send(t, aliceConn, protocol.Join{Room: "LOBBY"})
+	history := next[protocol.History](t, aliceConn)
+	if history.Room != room.NameSlug || len(history.Messages) != 1 || history.Messages[0].Text != "earlier" ||
+		history.Messages[0].From != "alice" {
+		t.Errorf("history = %+v", history)
+	}
+	send(t, bobConn, protocol.Join{Room: room.NameSlug})
+	next[protocol.History](t, bobConn)
+
+	send(t, bobConn, protocol.Say{Room: "Lobby", Text: "  hi alice  "})
+	for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+		chat := next[protocol.Chat](t, conn)
+		if chat.From != "bob" || chat.Text != "hi alice" || chat.Room != room.NameSlug {
+			t.Errorf("chat = %+v", chat)
+		}
+	}
+
+	messages, err := ts.store.GetChatMessageList(room.NameSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := false
+	for _, m := range messages {
+		saved = saved || m.Content == "hi alice" && m.UserID != alice.ID
+	}
+	if len(messages) != 2 || !saved {
+		t.Errorf("stored messages = %+v", messages)
+	}
+
+	// a room must be joined to talk in it
+	send(t, aliceConn, protocol.Leave{Room: "lobbY"})
+	send(t, aliceConn, protocol.Say{Room: room.NameSlug, Text: "still here?"})
+	if e := next[protocol.Error](t, aliceConn); !strings.Contains(e.Message, "not in chat room") {
+		t.Errorf("error = %q", e.Message)
+	}
+}
+
+func TestWebsocketBannedCannotChat(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	user, _, token := ts.login(t, "mallory")
+	if err := ts.store.BanUser(user.ID, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	room := model.ChatRoom{Name: "Lobby"}
+	if err := ts.store.CreateChatRoom(&room); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := ts.connect(t, token)
+	send(t, conn, protocol.Join{Room: room.NameSlug})
+	next[protocol.History](t, conn)
+	send(t, conn, protocol.Say{Room: room.NameSlug, Text: "spam"})
+
+	if e := next[protocol.Error](t, conn); !strings.Contains(e.Message, "not allowed") {
+		t.Errorf("error = %q", e.Message)
+	}
+}
+
+// wantClosed reads from conn until the server closes it for an ended
+// session.
+func wantClosed(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for {
+		_, _, err := conn.Read(ctx)
+		if err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+				t.Errorf("read %v, want policy violation", err)
+			}
+			return
+		}
+	}
+}
+
+// wantOpen checks that conn still answers a ping.
+func wantOpen(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	send(t, conn, protocol.Ping{Nonce: 7})
+	if pong := next[protocol.Pong](t, conn); pong.Nonce != 7 {
+		t.Errorf("pong %d, want 7", pong.Nonce)
+	}
+}
+
+func TestWebsocketCloseSession(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice, phone, phoneToken := ts.login(t, "alice")
+	_, _, laptopToken := ts.login(t, "alice")
+	_, _, bobToken := ts.login(t, "bob")
+
+	phoneConn := ts.connect(t, phoneToken)
+	laptopConn := ts.connect(t, laptopToken)
+	bobConn := ts.connect(t, bobToken)
+
+	if _, err := ts.sessions.Revoke(alice.ID, session.Handle(phone)); err != nil {
+		t.Fatal(err)
+	}
+	ts.handler.CloseSession(phone)
+
+	wantClosed(t, phoneConn)
+	wantOpen(t, laptopConn)
+	wantOpen(t, bobConn)
+}
+
+func TestWebsocketCloseUser(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice, _, phoneToken := ts.login(t, "alice")
+	_, _, laptopToken := ts.login(t, "alice")
+	_, _, bobToken := ts.login(t, "bob")
+
+	phoneConn := ts.connect(t, phoneToken)
+	laptopConn := ts.connect(t, laptopToken)
+	bobConn := ts.connect(t, bobToken)
+
+	ts.sessions.RemoveUser(alice.ID)
+	ts.handler.CloseUser(alice.ID)
+
+	wantClosed(t, phoneConn)
+	wantClosed(t, laptopConn)
+	wantOpen(t, bobConn)
+}
+
+func TestWebsocketText(t *testing.T) {
+	ts := newTestServer(t, Options{Guests: true})
+	alice, _, aliceToken := ts.login(t, "alice")
+	_, _, bobToken := ts.login(t, "bob")
+	mallory, _, malloryToken := ts.login(t, "mallory")
+	if err := ts.store.BanUser(mallory.ID, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceConn := ts.connect(t, aliceToken)
+	bobConn := ts.connect(t, bobToken)
+	malloryConn := ts.connect(t, malloryToken)
+	guestConn := ts.connect(t, "")
+
+	send(t, malloryConn, protocol.Text{Text: "spam"})
+	if e := next[protocol.Error](t, malloryConn); !strings.Contains(e.Message, "not allowed") {
+		t.Errorf("banned user error = %q", e.Message)
+	}
+	send(t, guestConn, protocol.Text{Text: "guest spam"})
+	if e := next[protocol.Error](t, guestConn); !strings.Contains(e.Message, "login") {
+		t.Errorf("guest error = %q", e.Message)
+	}
+	send(t, bobConn, protocol.Text{Text: strings.Repeat("x", globalconst.MaxChatLength+1)})
+	if e := next[protocol.Error](t, bobConn); !strings.Contains(e.Message, "too long") {
+		t.Errorf("long text error = %q", e.Message)
+	}
+
+	// the dropped texts were handled first, so the next one alice reads
+	// is the one bob sends now
+	send(t, bobConn, protocol.Text{From: alice.ID, Text: "hello"})
+	text := next[protocol.Text](t, aliceConn)
+	if text.Text != "hello" || text.From == alice.ID || text.From == "" {
+		t.Errorf("alice got %+v", text)
+	}
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"realm/protocol"
+)
+
+const (
+	WorldWidth  = 1024
+	WorldHeight = 1024
+
+	TickRate      = 20 // ticks per second
+	PlayerSpeed   = 2  // pixels per tick
+	ViewRadius    = 320
+	SnapshotTicks = TickRate // full snapshot once a second, deltas in between
+)
+
+// worldPlayer wraps the public state of a player, its ID is derived from
+// the player key, which is never sent.
+type worldPlayer struct {
+	protocol.Player
+	dx, dy int32
+	// known is what this player's client was last told about the others,
+	// nil until the first snapshot is sent
+	known map[string]protocol.Player
+}
+
+// world is the authoritative state of the realm, clients only send
+// movement intents and the world moves the players on each tick.
+type world struct {
+	mu      sync.Mutex
+	tick    uint64
+	players map[string]*worldPlayer // by player key
+}
+
+func newWorld() *world {
+	return &world{
+		players: make(map[string]*worldPlayer),
+	}
+}
+
+func (w *world) add(playerKey, id, nick string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.players[playerKey] = &worldPlayer{
+		Player: protocol.Player{
+			ID:   id,
+			Nick: nick,
+			X:    WorldWidth/2 + rand.Int31n(64) - 32,
+			Y:    WorldHeight/2 + rand.Int31n(64) - 32,
+		},
+	}
+}
+
+func (w *world) remove(playerKey string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.players, playerKey)
+}
+
+// resync makes the next step send a full snapshot to a player.
+func (w *world) resync(playerKey string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p, ok := w.players[playerKey]
+	if ok {
+		p.known = nil
+	}
+}
+
+// setIntent sets the movement intent of a player, each value must be -1,
+// 0 or 1.
+func (w *world) setIntent(playerKey string, m protocol.Move) error {
+	if m.DX < -1 || m.DX > 1 || m.DY < -1 || m.DY > 1 {
+		return fmt.Errorf("invalid move intent %d,%d", m.DX, m.DY)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p, ok := w.players[playerKey]
+	if !ok {
+		return nil
+	}
+	p.dx, p.dy = int32(m.DX), int32(m.DY)
+
+	return nil
+}
+
+// step moves every player and returns the message each player must
+// receive by player key, players with nothing new are left out.
+func (w *world) step() map[string]protocol.Payload {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.tick++
+
+	for _, p := range w.players {
+		p.X = clamp(p.X+p.dx*PlayerSpeed, 0, WorldWidth-1)
+		p.Y = clamp(p.Y+p.dy*PlayerSpeed, 0, WorldHeight-1)
+	}
+
+	full := w.tick%SnapshotTicks == 0
+	out := make(map[string]protocol.Payload)
+
+	for key, p := range w.players {
+		visible := make(map[string]protocol.Player)
+		for _, o := range w.players {
+			if visibleFrom(p.Player, o.Player) {
+				visible[o.ID] = o.Player
+			}
+		}
+
+		if full || p.known == nil {
+			s := protocol.Snapshot{Tick: w.tick, You: p.ID}
+			for _, o := range visible {
+				s.Players = append(s.Players, o)
+			}
+			out[key] = s
+			p.known = visible
+			continue
+		}
+
+		d := protocol.Delta{Tick: w.tick}
+		for id, o := range visible {
+			if k, ok := p.known[id]; !ok || k != o {
+				d.Players = append(d.Players, o)
+			}
+		}
+		for id := range p.known {
+			if _, ok := visible[id]; !ok {
+				d.Removed = append(d.Removed, id)
+			}
+		}
+		p.known = visible
+
+		if len(d.Players) == 0 && len(d.Removed) == 0 {
+			continue
+		}
+		out[key] = d
+	}
+
+	return out
+}
+
+// run advances the world TickRate times per second and sends the
+// updates to the users connected to h.
+func (w *world) run(h *hub) {
+	ticker := time.NewTicker(time.Second / TickRate)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for key, msg := range w.step() {
+			h.sendTo(key, msg)
+		}
+	}
+}
+
+func visibleFrom(p, o protocol.Player) bool {
+	dx := p.X - o.X
+	dy := p.Y - o.Y
+	return dx*dx+dy*dy <= ViewRadius*ViewRadius
+}
+
+func clamp(v, min, max int32) int32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
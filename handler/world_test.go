@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"sort"
+	"testing"
+
+	"realm/protocol"
+)
+
+// newTestWorld returns a world with a player at each position, keyed and
+// identified by its index in the list: key0 is player id0 and so on.
+func newTestWorld(pos ...[2]int32) *world {
+	w := newWorld()
+	for i, p := range pos {
+		key, id := testKey(i), testID(i)
+		w.add(key, id, id)
+		w.players[key].X, w.players[key].Y = p[0], p[1]
+	}
+	return w
+}
+
+func testKey(i int) string { return "key" + string(rune('0'+i)) }
+func testID(i int) string  { return "id" + string(rune('0'+i)) }
+
+func playerAt(id string, x, y int32) protocol.Player {
+	return protocol.Player{ID: id, Nick: id, X: x, Y: y}
+}
+
+func sortPlayers(list []protocol.Player) []protocol.Player {
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func equalPlayers(a, b []protocol.Player) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = sortPlayers(a), sortPlayers(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWorldMove(t *testing.T) {
+	w := newTestWorld([2]int32{100, 100})
+
+	err := w.setIntent(testKey(0), protocol.Move{DX: 1, DY: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		w.step()
+	}
+
+	p := w.players[testKey(0)]
+	if p.X != 100+3*PlayerSpeed || p.Y != 100-3*PlayerSpeed {
+		t.Errorf("player at %d,%d after 3 ticks, want %d,%d",
+			p.X, p.Y, 100+3*PlayerSpeed, 100-3*PlayerSpeed)
+	}
+
+	err = w.setIntent(testKey(0), protocol.Move{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.step()
+	if q := w.players[testKey(0)]; q.X != p.X || q.Y != p.Y {
+		t.Errorf("stopped player moved to %d,%d", q.X, q.Y)
+	}
+}
+
+func TestWorldClamp(t *testing.T) {
+	w := newTestWorld([2]int32{1, WorldHeight - 2}, [2]int32{WorldWidth - 1, 0})
+
+	w.setIntent(testKey(0), protocol.Move{DX: -1, DY: 1})
+	w.setIntent(testKey(1), protocol.Move{DX: 1, DY: -1})
+	for i := 0; i < 5; i++ {
+		w.step()
+	}
+
+	if p := w.players[testKey(0)]; p.X != 0 || p.Y != WorldHeight-1 {
+		t.Errorf("player 0 at %d,%d, want 0,%d", p.X, p.Y, WorldHeight-1)
+	}
+	if p := w.players[testKey(1)]; p.X != WorldWidth-1 || p.Y != 0 {
+		t.Errorf("player 1 at %d,%d, want %d,0", p.X, p.Y, WorldWidth-1)
+	}
+}
+
+func TestWorldInvalidIntent(t *testing.T) {
+	w := newTestWorld([2]int32{100, 100})
+
+	for _, m := range []protocol.Move{{DX: 2}, {DY: -2}, {DX: 127, DY: 1}, {DX: -128}} {
+		if err := w.setIntent(testKey(0), m); err == nil {
+			t.Errorf("setIntent(%+v) accepted", m)
+		}
+	}
+
+	w.step()
+	if p := w.players[testKey(0)]; p.X != 100 || p.Y != 100 {
+		t.Errorf("invalid intents moved the player to %d,%d", p.X, p.Y)
+	}
+
+	if err := w.setIntent("unknown", protocol.Move{DX: 1}); err != nil {
+		t.Errorf("intent of a removed player: %v", err)
+	}
+}
+
+func TestWorldViewRadius(t *testing.T) {
+	w := newTestWorld(
+		[2]int32{100, 100},
+		[2]int32{100 + ViewRadius, 100}, // at the edge
+		[2]int32{100 + ViewRadius + 1, 100},
+		[2]int32{100 + ViewRadius, 100 + 1},
+	)
+
+	out := w.step()
+
+	s, ok := out[testKey(0)].(protocol.Snapshot)
+	if !ok {
+		t.Fatalf("first message is %T, want a snapshot", out[testKey(0)])
+	}
+	want := []protocol.Player{
+		playerAt(testID(0), 100, 100),
+		playerAt(testID(1), 100+ViewRadius, 100),
+	}
+	if !equalPlayers(s.Players, want) {
+		t.Errorf("player 0 sees %+v, want %+v", s.Players, want)
+	}
+	if s.You != testID(0) {
+		t.Errorf("snapshot is for %q, want %q", s.You, testID(0))
+	}
+
+	// visibility is symmetric
+	s = out[testKey(2)].(protocol.Snapshot)
+	for _, p := range s.Players {
+		if p.ID == testID(0) {
+			t.Errorf("player 2 sees player 0 out of the view radius")
+		}
+	}
+}
+
+func TestWorldSnapshotAndDelta(t *testing.T) {
+	w := newTestWorld([2]int32{100, 100}, [2]int32{200, 100})
+	a, b := testKey(0), testKey(1)
+
+	out := w.step()
+	if len(out) != 2 {
+		t.Fatalf("first step sent %d messages, want a snapshot to each player", len(out))
+	}
+	for key, msg := range out {
+		if _, ok := msg.(protocol.Snapshot); !ok {
+			t.Errorf("first message to %s is %T, want a snapshot", key, msg)
+		}
+	}
+
+	// nothing moved, nothing to send
+	if out := w.step(); len(out) != 0 {
+		t.Errorf("idle step sent %+v", out)
+	}
+
+	// b moves, both get a delta with only b
+	w.setIntent(b, protocol.Move{DX: 1})
+	out = w.step()
+	moved := playerAt(testID(1), 200+PlayerSpeed, 100)
+	for _, key := range []string{a, b} {
+		d, ok := out[key].(protocol.Delta)
+		if !ok {
+			t.Fatalf("message to %s is %T, want a delta", key, out[key])
+		}
+		if !equalPlayers(d.Players, []protocol.Player{moved}) || len(d.Removed) != 0 {
+			t.Errorf("delta to %s is %+v, want only %+v", key, d, moved)
+		}
+	}
+
+	// b leaves the view of a
+	w.setIntent(b, protocol.Move{})
+	w.players[b].X = 100 + ViewRadius + 1
+	out = w.step()
+	d, ok := out[a].(protocol.Delta)
+	if !ok || len(d.Players) != 0 || len(d.Removed) != 1 || d.Removed[0] != testID(1) {
+		t.Errorf("message to a is %+v, want %s removed", out[a], testID(1))
+	}
+
+	// the next full snapshot goes to everyone, moving or not
+	for w.tick%SnapshotTicks != SnapshotTicks-1 {
+		w.step()
+	}
+	out = w.step()
+	s, ok := out[a].(protocol.Snapshot)
+	if !ok {
+		t.Fatalf("message at tick %d is %T, want a snapshot", w.tick, out[a])
+	}
+	if s.Tick != w.tick || !equalPlayers(s.Players, []protocol.Player{playerAt(testID(0), 100, 100)}) {
+		t.Errorf("snapshot is %+v", s)
+	}
+
+	// resync sends a snapshot on the next step
+	w.resync(b)
+	out = w.step()
+	if _, ok := out[b].(protocol.Snapshot); !ok {
+		t.Errorf("message after resync is %T, want a snapshot", out[b])
+	}
+	if _, ok := out[a]; ok {
+		t.Errorf("player a got %+v without a resync", out[a])
+	}
+}
@@ -0,0 +1,46 @@
+package markdown
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// Cache keeps rendered HTML by a hash of the source, so an edited post is
+// rendered again however soon after its last render it changed.
+type Cache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[[sha256.Size]byte]string
+}
+
+// NewCache returns a cache that holds up to max entries, when it is full
+// it is emptied and starts over.
+func NewCache(max int) *Cache {
+	return &Cache{
+		max:     max,
+		entries: make(map[[sha256.Size]byte]string),
+	}
+}
+
+// Render returns the cached HTML of src, rendering it on a miss.
+func (c *Cache) Render(src string) string {
+	key := sha256.Sum256([]byte(src))
+
+	c.mu.Lock()
+	s, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return s
+	}
+
+	s = Render(src)
+
+	c.mu.Lock()
+	if len(c.entries) >= c.max {
+		c.entries = make(map[[sha256.Size]byte]string)
+	}
+	c.entries[key] = s
+	c.mu.Unlock()
+
+	return s
+}
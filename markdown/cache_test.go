@@ -0,0 +1,16 @@
+package markdown
+
+import "testing"
+
+func TestCacheRendersChangedSource(t *testing.T) {
+	c := NewCache(10)
+
+	first := c.Render("*before*")
+	second := c.Render("**after**")
+	if first == second {
+		t.Fatalf("both sources rendered as %q", first)
+	}
+	if got := c.Render("*before*"); got != first {
+		t.Errorf("cached render %q, want %q", got, first)
+	}
+}
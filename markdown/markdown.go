@@ -0,0 +1,424 @@
+// Package markdown renders the Markdown subset used in forum posts
+// (paragraphs, headings, code blocks, quotes, lists, links and emphasis)
+// to HTML. The output is always passed through Sanitize, raw HTML in the
+// source is escaped.
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"strings"
+)
+
+// Render converts Markdown source to sanitized HTML.
+func Render(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\t", "    ")
+	return Sanitize(renderBlocks(strings.Split(src, "\n")))
+}
+
+func renderBlocks(lines []string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			i++
+
+		case strings.HasPrefix(trimmed, "```"):
+			i = renderFence(&b, lines, i)
+
+		case headingLevel(trimmed) > 0:
+			level := headingLevel(trimmed)
+			text := strings.TrimSpace(strings.TrimRight(trimmed[level:], "#"))
+			tag := "h" + string(rune('0'+level))
+			b.WriteString("<" + tag + ">" + renderInline(text) + "</" + tag + ">\n")
+			i++
+
+		case isRule(trimmed):
+			b.WriteString("<hr>\n")
+			i++
+
+		case strings.HasPrefix(trimmed, ">"):
+			i = renderQuote(&b, lines, i)
+
+		case listMarker(line) != "":
+			i = renderList(&b, lines, i)
+
+		default:
+			i = renderParagraph(&b, lines, i)
+		}
+	}
+
+	return b.String()
+}
+
+// renderFence writes a fenced code block starting at lines[i] and returns
+// the index of the first line after it.
+func renderFence(b *strings.Builder, lines []string, i int) int {
+	lang := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), "```"))
+	i++
+
+	var code []string
+	for ; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "```") {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+
+	b.WriteString("<pre><code")
+	if lang != "" && isWord(lang) {
+		b.WriteString(` class="language-` + lang + `"`)
+	}
+	b.WriteString(">")
+	b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+	b.WriteString("</code></pre>\n")
+
+	return i
+}
+
+func renderQuote(b *strings.Builder, lines []string, i int) int {
+	var inner []string
+	for ; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+		trimmed = strings.TrimPrefix(trimmed, ">")
+		trimmed = strings.TrimPrefix(trimmed, " ")
+		inner = append(inner, trimmed)
+	}
+
+	b.WriteString("<blockquote>\n")
+	b.WriteString(renderBlocks(inner))
+	b.WriteString("</blockquote>\n")
+
+	return i
+}
+
+// renderList writes a list starting at lines[i]. Items continue on lines
+// indented past the marker, a blank line ends the list unless it is
+// followed by another item of the same kind.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	ordered := listMarker(lines[i]) != "-"
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+
+	var items [][]string
+	for i < len(lines) {
+		line := lines[i]
+		if m := listMarker(line); m != "" {
+			if (m != "-") != ordered {
+				break
+			}
+			items = append(items, []string{stripMarker(line)})
+			i++
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			// blank line, keep going only if the list continues
+			j := i + 1
+			for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+				j++
+			}
+			if j < len(lines) && (listMarker(lines[j]) != "" || indent(lines[j]) >= 2) {
+				last := len(items) - 1
+				items[last] = append(items[last], "")
+				i++
+				continue
+			}
+			break
+		}
+
+		if indent(line) < 2 {
+			break
+		}
+
+		last := len(items) - 1
+		items[last] = append(items[last], dedent(line, 2))
+		i++
+	}
+
+	b.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		inner := renderBlocks(item)
+		// tight item, no paragraph around a single line of text
+		if strings.Count(inner, "<p>") == 1 && strings.HasPrefix(inner, "<p>") {
+			inner = strings.Replace(inner, "<p>", "", 1)
+			inner = strings.Replace(inner, "</p>\n", "", 1)
+		}
+		b.WriteString("<li>" + strings.TrimSuffix(inner, "\n") + "</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+
+	return i
+}
+
+func renderParagraph(b *strings.Builder, lines []string, i int) int {
+	var text []string
+	for ; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" ||
+			strings.HasPrefix(trimmed, "```") ||
+			strings.HasPrefix(trimmed, ">") ||
+			headingLevel(trimmed) > 0 ||
+			(len(text) > 0 && listMarker(lines[i]) != "") {
+			break
+		}
+		text = append(text, renderInline(trimmed))
+	}
+
+	b.WriteString("<p>" + strings.Join(text, "<br>\n") + "</p>\n")
+
+	return i
+}
+
+// renderInline escapes text and converts code spans, emphasis, links and
+// bare URLs.
+func renderInline(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#+-.!>", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			n := run(s[i:], '`')
+			fence := s[i : i+n]
+			end := strings.Index(s[i+n:], fence)
+			if end >= 0 {
+				code := strings.TrimSpace(s[i+n : i+n+end])
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += n + end + n
+				continue
+			}
+			b.WriteString(fence)
+			i += n
+			continue
+
+		case c == '*' && strings.HasPrefix(s[i:], "**"):
+			end := strings.Index(s[i+2:], "**")
+			if end > 0 {
+				b.WriteString("<strong>" + renderInline(s[i+2:i+2+end]) + "</strong>")
+				i += end + 4
+				continue
+			}
+
+		case c == '*':
+			end := strings.IndexByte(s[i+1:], '*')
+			if end > 0 && s[i+1] != ' ' {
+				b.WriteString("<em>" + renderInline(s[i+1:i+1+end]) + "</em>")
+				i += end + 2
+				continue
+			}
+
+		case c == '[':
+			text, href, n := parseLink(s[i:])
+			if n > 0 {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `">` + renderInline(text) + "</a>")
+				i += n
+				continue
+			}
+
+		case c == '<':
+			end := strings.IndexByte(s[i:], '>')
+			if end > 0 {
+				href := s[i+1 : i+end]
+				if isAutoLink(href) && SafeURL(href) {
+					b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(href) + "</a>")
+					i += end + 1
+					continue
+				}
+			}
+
+		case c == 'h' && (i == 0 || isSpace(s[i-1])) && isAutoLink(s[i:]):
+			n := urlLength(s[i:])
+			href := s[i : i+n]
+			if SafeURL(href) {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(href) + "</a>")
+				i += n
+				continue
+			}
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+
+	return b.String()
+}
+
+// parseLink parses [text](href) at the start of s and returns the number of
+// bytes consumed, or zero if s does not start with a safe link.
+func parseLink(s string) (string, string, int) {
+	depth := 0
+	closeText := -1
+	for i := 0; i < len(s); i++ {
+		if s[i] == '[' {
+			depth++
+		} else if s[i] == ']' {
+			depth--
+			if depth == 0 {
+				closeText = i
+				break
+			}
+		}
+	}
+	if closeText < 0 || closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return "", "", 0
+	}
+
+	closeHref := strings.IndexByte(s[closeText+2:], ')')
+	if closeHref < 0 {
+		return "", "", 0
+	}
+
+	text := s[1:closeText]
+	href := strings.TrimSpace(s[closeText+2 : closeText+2+closeHref])
+	if href == "" || !SafeURL(href) {
+		return "", "", 0
+	}
+
+	return text, href, closeText + 2 + closeHref + 1
+}
+
+// SafeURL reports whether href is a relative URL or uses the http, https
+// or mailto scheme. Backslashes are refused, browsers read them as slashes
+// and /\host would point to another host.
+func SafeURL(href string) bool {
+	for i := 0; i < len(href); i++ {
+		if href[i] < ' ' || href[i] == 0x7f || href[i] == '\\' {
+			return false
+		}
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return true
+	case "":
+		return !strings.HasPrefix(href, "//")
+	}
+
+	return false
+}
+
+func isAutoLink(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// urlLength returns the length of the bare URL at the start of s, without
+// trailing punctuation.
+func urlLength(s string) int {
+	n := 0
+	for n < len(s) && !isSpace(s[n]) && s[n] != '<' && s[n] != '>' && s[n] != '"' {
+		n++
+	}
+	for n > 0 && strings.IndexByte(".,:;!?)'", s[n-1]) >= 0 {
+		n--
+	}
+	return n
+}
+
+func headingLevel(s string) int {
+	n := run(s, '#')
+	if n == 0 || n > 6 || n == len(s) || s[n] != ' ' {
+		return 0
+	}
+	return n
+}
+
+func isRule(s string) bool {
+	if len(s) < 3 {
+		return false
+	}
+	c := s[0]
+	if c != '-' && c != '*' && c != '_' {
+		return false
+	}
+	return strings.Count(s, string(c))+strings.Count(s, " ") == len(s) &&
+		strings.Count(s, string(c)) >= 3
+}
+
+// listMarker returns "-" for an unordered list item, "1" for an ordered
+// one and "" otherwise.
+func listMarker(line string) string {
+	s := strings.TrimLeft(line, " ")
+	if len(line)-len(s) > 3 || len(s) < 2 {
+		return ""
+	}
+
+	if (s[0] == '-' || s[0] == '*' || s[0] == '+') && s[1] == ' ' {
+		if isRule(strings.TrimSpace(s)) {
+			return ""
+		}
+		return "-"
+	}
+
+	n := 0
+	for n < len(s) && n < 9 && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	if n > 0 && n+1 < len(s) && (s[n] == '.' || s[n] == ')') && s[n+1] == ' ' {
+		return "1"
+	}
+
+	return ""
+}
+
+func stripMarker(line string) string {
+	s := strings.TrimLeft(line, " ")
+	i := strings.IndexByte(s, ' ')
+	return strings.TrimLeft(s[i:], " ")
+}
+
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func dedent(line string, n int) string {
+	if indent(line) < n {
+		n = indent(line)
+	}
+	return line[n:]
+}
+
+func run(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isWord(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '+') {
+			return false
+		}
+	}
+	return true
+}
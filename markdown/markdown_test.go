@@ -0,0 +1,97 @@
+package markdown
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"emphasis", "*em* and **strong**", "<p><em>em</em> and <strong>strong</strong></p>\n"},
+		{"code span", "use `a < b`", "<p>use <code>a &lt; b</code></p>\n"},
+		{"fence", "```go\nx := 1\n```", "<pre><code class=\"language-go\">x := 1</code></pre>\n"},
+		{"link", "[home](https://example.com/)", "<p><a href=\"https://example.com/\" rel=\"nofollow noopener\">home</a></p>\n"},
+		{"relative link", "[faq](/faq)", "<p><a href=\"/faq\" rel=\"nofollow noopener\">faq</a></p>\n"},
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"img onerror", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+		{"mixed case scheme", "[x](JaVaScRiPt:alert(1))", "<p>[x](JaVaScRiPt:alert(1))</p>\n"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>[x](data:text/html;base64,PHNjcmlwdD4=)</p>\n"},
+		{"protocol relative link", "[x](//evil.host/)", "<p>[x](//evil.host/)</p>\n"},
+		{"fence language", "```\"onclick=\"x\nx\n```", "<pre><code>x</code></pre>\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"allowed", "<p><em>a</em> <strong>b</strong> <code>c</code></p>", "<p><em>a</em> <strong>b</strong> <code>c</code></p>"},
+		{"script", "<p>a<script>alert(1)</script>b</p>", "<p>ab</p>"},
+		{"style", "<style>p{}</style>a", "a"},
+		{"img onerror", "<img src=x onerror=alert(1)>a", "a"},
+		{"event attribute", `<p onclick="alert(1)">a</p>`, "<p>a</p>"},
+		{"style attribute", `<em style="color:red">a</em>`, "<em>a</em>"},
+		{"unknown element", "<div><span>a</span></div>", "a"},
+		{"link", `<a href="https://example.com/" title="t">a</a>`, `<a href="https://example.com/" rel="nofollow noopener">a</a>`},
+		{"link rel replaced", `<a href="/x" rel="opener">a</a>`, `<a href="/x" rel="nofollow noopener">a</a>`},
+		{"javascript href", `<a href="javascript:alert(1)">a</a>`, `<a rel="nofollow noopener">a</a>`},
+		{"mixed case href", `<a href="JaVaScRiPt:alert(1)">a</a>`, `<a rel="nofollow noopener">a</a>`},
+		{"entity href", `<a href="javascript&#58;alert(1)">a</a>`, `<a rel="nofollow noopener">a</a>`},
+		{"data href", `<a href="data:text/html,x">a</a>`, `<a rel="nofollow noopener">a</a>`},
+		{"protocol relative href", `<a href="//evil.host/">a</a>`, `<a rel="nofollow noopener">a</a>`},
+		{"code class", `<code class="language-go">a</code>`, `<code class="language-go">a</code>`},
+		{"bad code class", `<code class="x&quot; onclick=&quot;y">a</code>`, `<code>a</code>`},
+		{"text escaped", "a &lt; b", "a &lt; b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.html); got != tt.want {
+				t.Errorf("Sanitize(%q) = %q, want %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		href string
+		want bool
+	}{
+		{"https://example.com/", true},
+		{"http://example.com/a?b=c", true},
+		{"mailto:a@example.com", true},
+		{"/thread/1", true},
+		{"thread/1#c2", true},
+		{"javascript:alert(1)", false},
+		{"JaVaScRiPt:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"vbscript:msgbox(1)", false},
+		{"data:text/html;base64,PHNjcmlwdD4=", false},
+		{"//evil.host", false},
+		{"//evil.host/path", false},
+		{`/\evil.host`, false},
+		{`\\evil.host`, false},
+		{"https:evil.host", false},
+		{"https:///path", false},
+	}
+
+	for _, tt := range tests {
+		if got := SafeURL(tt.href); got != tt.want {
+			t.Errorf("SafeURL(%q) = %v, want %v", tt.href, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package markdown
+
+import (
+	"html"
+	"io"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// allowedTags lists the elements kept by Sanitize and the attributes
+// allowed on each one.
+var allowedTags = map[string][]string{
+	"p":          nil,
+	"br":         nil,
+	"hr":         nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"strong":     nil,
+	"em":         nil,
+	"code":       {"class"},
+	"pre":        nil,
+	"blockquote": nil,
+	"ul":         nil,
+	"ol":         nil,
+	"li":         nil,
+	"a":          {"href"},
+}
+
+// droppedContent lists elements removed together with their content.
+var droppedContent = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"template": true,
+	"noscript": true,
+	"textarea": true,
+	"title":    true,
+}
+
+// Sanitize removes every element and attribute not in the allow-list from
+// an HTML fragment. Links must use a safe URL and get rel="nofollow
+// noopener", code classes must be language-*.
+func Sanitize(s string) string {
+	var (
+		b    strings.Builder
+		skip int
+		z    = xhtml.NewTokenizer(strings.NewReader(s))
+	)
+
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			if z.Err() != io.EOF {
+				return ""
+			}
+			return b.String()
+		}
+
+		tok := z.Token()
+
+		switch tt {
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if droppedContent[tok.Data] {
+				if tt == xhtml.StartTagToken {
+					skip++
+				}
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+			attrs, ok := allowedTags[tok.Data]
+			if !ok {
+				continue
+			}
+			b.WriteString("<" + tok.Data)
+			for _, a := range tok.Attr {
+				if !allowedAttr(tok.Data, a, attrs) {
+					continue
+				}
+				b.WriteString(" " + a.Key + `="` + html.EscapeString(a.Val) + `"`)
+			}
+			if tok.Data == "a" {
+				b.WriteString(` rel="nofollow noopener"`)
+			}
+			b.WriteString(">")
+
+		case xhtml.EndTagToken:
+			if droppedContent[tok.Data] {
+				if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+			_, ok := allowedTags[tok.Data]
+			if !ok || tok.Data == "br" || tok.Data == "hr" {
+				continue
+			}
+			b.WriteString("</" + tok.Data + ">")
+
+		case xhtml.TextToken:
+			if skip > 0 {
+				continue
+			}
+			b.WriteString(html.EscapeString(tok.Data))
+		}
+	}
+}
+
+func allowedAttr(tag string, a xhtml.Attribute, allowed []string) bool {
+	if a.Namespace != "" {
+		return false
+	}
+
+	found := false
+	for _, k := range allowed {
+		if k == a.Key {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	switch {
+	case tag == "a" && a.Key == "href":
+		return SafeURL(a.Val)
+	case tag == "code" && a.Key == "class":
+		return strings.HasPrefix(a.Val, "language-") && isWord(strings.TrimPrefix(a.Val, "language-"))
+	}
+
+	return true
+}
@@ -0,0 +1,1428 @@
+// Package memory is a store.Store kept in memory, meant for tests and
+// for running the server without a database file.
+package memory
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"realm/model"
+	"realm/store"
+	"realm/util"
+)
+
+type Memory struct {
+	mu           sync.Mutex
+	sessions     map[string]model.SessionData
+	users        map[string]model.User
+	identities   []model.UserIdentity
+	moderators   map[string][]string // forum slug to user ids
+	auditLog     []model.AuditLog
+	categories   map[string]model.Category
+	forums       map[string]model.Forum
+	threads      map[string]model.Thread
+	comments     map[string]model.Comment
+	revisions    []model.Revision
+	chatRooms    map[string]model.ChatRoom
+	chatMessages map[string]model.ChatMessage
+	seq          int64 // last Seq given to a comment or chat message
+}
+
+var _ store.Store = (*Memory)(nil)
+
+func New() *Memory {
+	return &Memory{
+		sessions:     make(map[string]model.SessionData),
+		users:        make(map[string]model.User),
+		moderators:   make(map[string][]string),
+		categories:   make(map[string]model.Category),
+		forums:       make(map[string]model.Forum),
+		threads:      make(map[string]model.Thread),
+		comments:     make(map[string]model.Comment),
+		chatRooms:    make(map[string]model.ChatRoom),
+		chatMessages: make(map[string]model.ChatMessage),
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// now matches the precision of datetime('now') in the sqlite backend.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+/////////////////////////////////////////////////////////////////
+// session
+
+func (m *Memory) SaveSession(sessionID string, sd *model.SessionData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := *sd
+	data.SessionID = sessionID
+	m.sessions[sessionID] = data
+
+	return nil
+}
+
+func (m *Memory) DeleteSession(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, sessionID)
+
+	return nil
+}
+
+func (m *Memory) GetSession(sessionID string) (*model.SessionData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.sessions[sessionID]
+	if !ok {
+		return &model.SessionData{}, store.ErrNotFound
+	}
+
+	return &data, nil
+}
+
+func (m *Memory) GetUserSessionList(userID string) ([]model.SessionData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := time.Now()
+	var sessionList []model.SessionData
+	for _, v := range m.sessions {
+		if v.UserID == userID && v.LoggedIn && v.ExpireAt.After(t) {
+			sessionList = append(sessionList, v)
+		}
+	}
+	sortSessions(sessionList)
+
+	return sessionList, nil
+}
+
+// sortSessions orders sessions by last use, latest first.
+func sortSessions(sessionList []model.SessionData) {
+	sort.Slice(sessionList, func(i, j int) bool {
+		a, b := sessionList[i], sessionList[j]
+		if !a.LastSeenAt.Equal(b.LastSeenAt) {
+			return a.LastSeenAt.After(b.LastSeenAt)
+		}
+		return a.SessionID < b.SessionID
+	})
+}
+
+func (m *Memory) DeleteExpiredSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := time.Now()
+	for k, v := range m.sessions {
+		if v.ExpireAt.Before(t) {
+			delete(m.sessions, k)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) DeleteUserSessions(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, v := range m.sessions {
+		if v.UserID == userID {
+			delete(m.sessions, k)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) DeleteAllSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions = make(map[string]model.SessionData)
+
+	return nil
+}
+
+func (m *Memory) LoadAllSessions() (map[string]model.SessionData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := time.Now()
+	sessionDataMap := make(map[string]model.SessionData)
+	for k, v := range m.sessions {
+		if v.ExpireAt.After(t) {
+			sessionDataMap[k] = v
+		}
+	}
+
+	return sessionDataMap, nil
+}
+
+/////////////////////////////////////////////////////////////////
+// user
+
+func (m *Memory) SaveUser(user *model.User) (model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.identityIndex(user.OAuthProvider, user.OAuthUserID)
+	if i < 0 {
+		user.ID = util.RandomID()
+		user.Role = model.RoleMember
+		user.BannedUntil = nil
+		m.users[user.ID] = *user
+		m.identities = append(m.identities, model.UserIdentity{
+			OAuthProvider: user.OAuthProvider,
+			OAuthUserID:   user.OAuthUserID,
+			UserID:        user.ID,
+			UserName:      user.UserName,
+			CreatedAt:     now(),
+		})
+
+		return *user, nil
+	}
+
+	m.identities[i].UserName = user.UserName
+
+	u := m.users[m.identities[i].UserID]
+	u.UserName = user.UserName
+	u.AvatarURL = user.AvatarURL
+	m.users[u.ID] = u
+	user.ID = u.ID
+
+	return *user, nil
+}
+
+func (m *Memory) GetUser(id string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return &model.User{}, store.ErrNotFound
+	}
+
+	return &u, nil
+}
+
+func (m *Memory) GetUserFromOAuthID(oauthProvider string, oauthUserID string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.identityIndex(oauthProvider, oauthUserID)
+	if i < 0 {
+		return &model.User{}, store.ErrNotFound
+	}
+
+	u := m.users[m.identities[i].UserID]
+
+	return &u, nil
+}
+
+// identityIndex returns the index of an identity in m.identities, or -1.
+func (m *Memory) identityIndex(oauthProvider, oauthUserID string) int {
+	return slices.IndexFunc(m.identities, func(i model.UserIdentity) bool {
+		return i.OAuthProvider == oauthProvider && i.OAuthUserID == oauthUserID
+	})
+}
+
+func (m *Memory) GetUserIdentityList(userID string) ([]model.UserIdentity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var identityList []model.UserIdentity
+	for _, i := range m.identities {
+		if i.UserID == userID {
+			identityList = append(identityList, i)
+		}
+	}
+
+	return identityList, nil
+}
+
+func (m *Memory) LinkUserIdentity(identity *model.UserIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.identityIndex(identity.OAuthProvider, identity.OAuthUserID)
+	if i < 0 {
+		id := *identity
+		id.CreatedAt = now()
+		m.identities = append(m.identities, id)
+		return nil
+	}
+
+	if m.identities[i].UserID != identity.UserID {
+		return store.ErrIdentityLinked
+	}
+	m.identities[i].UserName = identity.UserName
+
+	return nil
+}
+
+func (m *Memory) UnlinkUserIdentity(userID, oauthProvider, oauthUserID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.identityIndex(oauthProvider, oauthUserID)
+	if i < 0 || m.identities[i].UserID != userID {
+		return store.ErrNotFound
+	}
+
+	count := 0
+	for _, id := range m.identities {
+		if id.UserID == userID {
+			count++
+		}
+	}
+	if count < 2 {
+		return store.ErrLastIdentity
+	}
+
+	m.identities = slices.Delete(m.identities, i, i+1)
+
+	return nil
+}
+
+func (m *Memory) MergeUsers(intoID, fromID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if intoID == fromID {
+		return fmt.Errorf("memory: cannot merge user %q into itself", intoID)
+	}
+	if _, ok := m.users[intoID]; !ok {
+		return store.ErrNotFound
+	}
+	if _, ok := m.users[fromID]; !ok {
+		return store.ErrNotFound
+	}
+
+	for i := range m.identities {
+		if m.identities[i].UserID == fromID {
+			m.identities[i].UserID = intoID
+		}
+	}
+	for k, t := range m.threads {
+		if t.UserID == fromID {
+			t.UserID = intoID
+			m.threads[k] = t
+		}
+	}
+	for k, c := range m.comments {
+		if c.UserID == fromID {
+			c.UserID = intoID
+			m.comments[k] = c
+		}
+	}
+	for i := range m.revisions {
+		if m.revisions[i].UserID == fromID {
+			m.revisions[i].UserID = intoID
+		}
+	}
+	for k, c := range m.chatMessages {
+		if c.UserID == fromID {
+			c.UserID = intoID
+			m.chatMessages[k] = c
+		}
+	}
+	for forum, ids := range m.moderators {
+		if slices.Contains(ids, fromID) {
+			ids = slices.DeleteFunc(ids, func(id string) bool { return id == fromID })
+			if !slices.Contains(ids, intoID) {
+				ids = append(ids, intoID)
+			}
+			m.moderators[forum] = ids
+		}
+	}
+	for i := range m.auditLog {
+		if m.auditLog[i].UserID == fromID {
+			m.auditLog[i].UserID = intoID
+		}
+	}
+	for k, sd := range m.sessions {
+		if sd.UserID == fromID {
+			delete(m.sessions, k)
+		}
+	}
+	delete(m.users, fromID)
+
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////
+// forum
+
+func (m *Memory) CreateForum(forum *model.Forum) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slug := uniqueSlug(forum.Name, "forum", func(slug string) bool {
+		_, ok := m.forums[slug]
+		return ok || slices.Contains(store.ReservedForumSlugs, slug)
+	})
+
+	f := *forum
+	f.NameSlug = slug
+	m.forums[slug] = f
+	forum.NameSlug = slug
+
+	return nil
+}
+
+// uniqueSlug returns a slug of name that taken reports as free, fallback
+// is the slug of names without letters or digits.
+func uniqueSlug(name, fallback string, taken func(slug string) bool) string {
+	base := util.Slugify(name)
+	if base == "" {
+		base = fallback
+	}
+
+	slug, _ := util.UniqueSlug(base, func(slug string) (bool, error) {
+		return taken(slug), nil
+	})
+
+	return slug
+}
+
+func (m *Memory) GetForum(name string) (*model.Forum, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	forum, ok := m.forums[strings.ToLower(name)]
+	if !ok {
+		return &model.Forum{}, store.ErrNotFound
+	}
+
+	return &forum, nil
+}
+
+func (m *Memory) GetForumList() ([]model.Forum, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.forumList(), nil
+}
+
+// forumList must be called with m.mu held.
+func (m *Memory) forumList() []model.Forum {
+	var forumList []model.Forum
+	for _, f := range m.forums {
+		forumList = append(forumList, f)
+	}
+	sort.Slice(forumList, func(i, j int) bool {
+		a, b := forumList[i], forumList[j]
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.NameSlug < b.NameSlug
+	})
+
+	return forumList
+}
+
+func (m *Memory) UpdateForum(forum *model.Forum) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.forums[forum.NameSlug]; !ok {
+		return store.ErrNotFound
+	}
+	m.forums[forum.NameSlug] = *forum
+
+	return nil
+}
+
+func (m *Memory) DeleteForum(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.forums, strings.ToLower(name))
+
+	return nil
+}
+
+func (m *Memory) GetForumViewList() ([]model.ForumView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var viewList []model.ForumView
+	for _, f := range m.forumList() {
+		fv := model.ForumView{Forum: f}
+
+		var last *model.Thread
+		for _, t := range m.threads {
+			if t.ForumName != f.NameSlug || t.Deleted {
+				continue
+			}
+			fv.ThreadCount++
+			fv.PostCount++
+			if last == nil || t.LastPostAt.After(last.LastPostAt) ||
+				t.LastPostAt.Equal(last.LastPostAt) && t.ID > last.ID {
+				last = &t
+			}
+		}
+
+		for _, c := range m.comments {
+			t := m.threads[c.ThreadID]
+			if t.ForumName == f.NameSlug && !t.Deleted && !c.Deleted {
+				fv.PostCount++
+			}
+		}
+
+		if last != nil {
+			fv.LastThreadID = last.ID
+			fv.LastThreadTitle = last.Title
+			fv.LastUserName = m.users[last.UserID].UserName
+			lastPostAt := last.LastPostAt
+			fv.LastPostAt = &lastPostAt
+
+			var lastComment *model.Comment
+			for _, c := range m.comments {
+				if c.ThreadID == last.ID && !c.Deleted && (lastComment == nil || c.Seq > lastComment.Seq) {
+					lastComment = &c
+				}
+			}
+			if lastComment != nil {
+				fv.LastUserName = m.users[lastComment.UserID].UserName
+			}
+		}
+
+		viewList = append(viewList, fv)
+	}
+
+	return viewList, nil
+}
+
+/////////////////////////////////////////////////////////////////
+// category
+
+func (m *Memory) CreateCategory(category *model.Category) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slug := uniqueSlug(category.Name, "category", func(slug string) bool {
+		_, ok := m.categories[slug]
+		return ok
+	})
+
+	c := *category
+	c.NameSlug = slug
+	m.categories[slug] = c
+	category.NameSlug = slug
+
+	return nil
+}
+
+func (m *Memory) GetCategory(name string) (*model.Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	category, ok := m.categories[strings.ToLower(name)]
+	if !ok {
+		return &model.Category{}, store.ErrNotFound
+	}
+
+	return &category, nil
+}
+
+func (m *Memory) GetCategoryList() ([]model.Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var categoryList []model.Category
+	for _, c := range m.categories {
+		categoryList = append(categoryList, c)
+	}
+	sort.Slice(categoryList, func(i, j int) bool {
+		a, b := categoryList[i], categoryList[j]
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.NameSlug < b.NameSlug
+	})
+
+	return categoryList, nil
+}
+
+func (m *Memory) UpdateCategory(category *model.Category) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.categories[category.NameSlug]; !ok {
+		return store.ErrNotFound
+	}
+	m.categories[category.NameSlug] = *category
+
+	return nil
+}
+
+func (m *Memory) DeleteCategory(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = strings.ToLower(name)
+	for slug, f := range m.forums {
+		if f.CategorySlug == name {
+			f.CategorySlug = ""
+			m.forums[slug] = f
+		}
+	}
+	delete(m.categories, name)
+
+	return nil
+}
+
+func (m *Memory) CreateThread(thread *model.Thread) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.threads[thread.ID]; ok {
+		return fmt.Errorf("memory: thread %q already exists", thread.ID)
+	}
+
+	t := *thread
+	t.CreatedAt = now()
+	t.UpdatedAt = t.CreatedAt
+	t.EditedAt = nil
+	t.LastPostAt = t.CreatedAt
+	t.Deleted = false
+	t.Locked = false
+	t.Pinned = false
+	m.threads[t.ID] = t
+
+	return nil
+}
+
+func (m *Memory) GetThread(id string) (*model.Thread, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	thread, ok := m.threads[id]
+	if !ok {
+		return &model.Thread{}, store.ErrNotFound
+	}
+
+	return &thread, nil
+}
+
+func (m *Memory) GetThreadList(forumName string) ([]model.Thread, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var threadList []model.Thread
+	for _, t := range m.threads {
+		if t.ForumName == forumName {
+			threadList = append(threadList, t)
+		}
+	}
+	sortThreads(threadList)
+
+	return threadList, nil
+}
+
+func (m *Memory) GetThreadView(id string) (*model.ThreadView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	thread, ok := m.threads[id]
+	if !ok {
+		return &model.ThreadView{}, store.ErrNotFound
+	}
+
+	tv := m.threadView(thread)
+
+	return &tv, nil
+}
+
+func (m *Memory) GetThreadViewPage(forumName string, sortBy store.ThreadSort, page store.Page) ([]model.ThreadView, error) {
+	if !sortBy.Valid() {
+		return nil, fmt.Errorf("memory: unknown thread sort %q", sortBy)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var viewList []model.ThreadView
+	for _, t := range m.threads {
+		if t.ForumName == forumName && !t.Pinned {
+			viewList = append(viewList, m.threadView(t))
+		}
+	}
+
+	sort.Slice(viewList, func(i, j int) bool {
+		a, b := viewList[i], viewList[j]
+		switch sortBy {
+		case store.SortActivity:
+			if !a.LastPostAt.Equal(b.LastPostAt) {
+				return a.LastPostAt.After(b.LastPostAt)
+			}
+		case store.SortNewest:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+		case store.SortComments:
+			if a.CommentCount != b.CommentCount {
+				return a.CommentCount > b.CommentCount
+			}
+		}
+		return a.ID > b.ID
+	})
+
+	return pageOf(viewList, func(t model.ThreadView) string { return t.ID }, page), nil
+}
+
+func (m *Memory) GetPinnedThreadViewList(forumName string) ([]model.ThreadView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var threadList []model.Thread
+	for _, t := range m.threads {
+		if t.ForumName == forumName && t.Pinned {
+			threadList = append(threadList, t)
+		}
+	}
+	sortThreads(threadList)
+
+	var viewList []model.ThreadView
+	for _, t := range threadList {
+		viewList = append(viewList, m.threadView(t))
+	}
+
+	return viewList, nil
+}
+
+// pageOf returns the items of a sorted list selected by page.
+func pageOf[T any](list []T, id func(T) string, page store.Page) []T {
+	cursor := page.After
+	if page.Before != "" {
+		cursor = page.Before
+	}
+
+	if cursor != "" {
+		i := slices.IndexFunc(list, func(v T) bool { return id(v) == cursor })
+		switch {
+		case i < 0:
+			return nil
+		case page.Before != "":
+			list = list[:i]
+		default:
+			list = list[i+1:]
+		}
+	}
+
+	if len(list) > page.Limit {
+		if page.Before != "" {
+			return list[len(list)-page.Limit:]
+		}
+		return list[:page.Limit]
+	}
+
+	return list
+}
+
+// threadView must be called with m.mu held.
+func (m *Memory) threadView(thread model.Thread) model.ThreadView {
+	tv := model.ThreadView{
+		Thread:   thread,
+		UserName: m.users[thread.UserID].UserName,
+	}
+	for _, c := range m.comments {
+		if c.ThreadID == thread.ID && !c.Deleted {
+			tv.CommentCount++
+		}
+	}
+
+	return tv
+}
+
+// sortThreads orders threads by last post, newest first.
+func sortThreads(threadList []model.Thread) {
+	sort.Slice(threadList, func(i, j int) bool {
+		a, b := threadList[i], threadList[j]
+		if !a.LastPostAt.Equal(b.LastPostAt) {
+			return a.LastPostAt.After(b.LastPostAt)
+		}
+		return a.ID > b.ID
+	})
+}
+
+func (m *Memory) UpdateThread(thread *model.Thread) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.threads[thread.ID]
+	if !ok || t.Deleted {
+		return nil
+	}
+
+	m.addRevision("thread", t.ID, t.Title, t.Content, t.UserID, t.UpdatedAt)
+
+	t.Title = thread.Title
+	t.Content = thread.Content
+	t.UpdatedAt = now()
+	editedAt := t.UpdatedAt
+	t.EditedAt = &editedAt
+	m.threads[t.ID] = t
+
+	return nil
+}
+
+func (m *Memory) DeleteThread(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.threads[id]
+	if !ok {
+		return nil
+	}
+
+	m.addRevision("thread", t.ID, t.Title, t.Content, t.UserID, t.UpdatedAt)
+
+	t.Content = ""
+	t.Deleted = true
+	t.UpdatedAt = now()
+	m.threads[id] = t
+
+	return nil
+}
+
+func (m *Memory) CreateComment(comment *model.Comment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.comments[comment.ID]; ok {
+		return fmt.Errorf("memory: comment %q already exists", comment.ID)
+	}
+
+	c := *comment
+	c.CreatedAt = now()
+	c.UpdatedAt = c.CreatedAt
+	c.EditedAt = nil
+	c.Deleted = false
+	m.seq++
+	c.Seq = m.seq
+	m.comments[c.ID] = c
+
+	if t, ok := m.threads[c.ThreadID]; ok {
+		t.LastPostAt = c.CreatedAt
+		m.threads[t.ID] = t
+	}
+
+	return nil
+}
+
+func (m *Memory) GetComment(id string) (*model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	comment, ok := m.comments[id]
+	if !ok {
+		return &model.Comment{}, store.ErrNotFound
+	}
+
+	return &comment, nil
+}
+
+func (m *Memory) GetCommentList(threadID string) ([]model.Comment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.commentList(threadID), nil
+}
+
+func (m *Memory) GetCommentViewPage(threadID string, page store.Page) ([]model.CommentView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	commentList := pageOf(m.commentList(threadID), func(c model.Comment) string { return c.ID }, page)
+
+	var viewList []model.CommentView
+	for _, c := range commentList {
+		viewList = append(viewList, model.CommentView{
+			Comment:  c,
+			UserName: m.users[c.UserID].UserName,
+		})
+	}
+
+	return viewList, nil
+}
+
+// commentList returns the comments of a thread oldest first, it must be
+// called with m.mu held.
+func (m *Memory) commentList(threadID string) []model.Comment {
+	var commentList []model.Comment
+	for _, c := range m.comments {
+		if c.ThreadID == threadID {
+			commentList = append(commentList, c)
+		}
+	}
+	sort.Slice(commentList, func(i, j int) bool {
+		return commentList[i].Seq < commentList[j].Seq
+	})
+
+	return commentList
+}
+
+func (m *Memory) UpdateComment(comment *model.Comment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.comments[comment.ID]
+	if !ok || c.Deleted {
+		return nil
+	}
+
+	m.addRevision("comment", c.ID, "", c.Content, c.UserID, c.UpdatedAt)
+
+	c.Content = comment.Content
+	c.UpdatedAt = now()
+	editedAt := c.UpdatedAt
+	c.EditedAt = &editedAt
+	m.comments[c.ID] = c
+
+	return nil
+}
+
+func (m *Memory) DeleteComment(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.comments[id]
+	if !ok {
+		return nil
+	}
+
+	m.addRevision("comment", c.ID, "", c.Content, c.UserID, c.UpdatedAt)
+
+	c.Content = ""
+	c.Deleted = true
+	c.UpdatedAt = now()
+	m.comments[id] = c
+
+	// the thread's last post may have been this one
+	if t, ok := m.threads[c.ThreadID]; ok {
+		t.LastPostAt = t.CreatedAt
+		for _, other := range m.comments {
+			if other.ThreadID == t.ID && !other.Deleted && other.CreatedAt.After(t.LastPostAt) {
+				t.LastPostAt = other.CreatedAt
+			}
+		}
+		m.threads[t.ID] = t
+	}
+
+	return nil
+}
+
+// addRevision must be called with m.mu held.
+func (m *Memory) addRevision(itemType, itemID, title, content, userID string, createdAt time.Time) {
+	m.revisions = append(m.revisions, model.Revision{
+		ID:        util.RandomID(),
+		ItemType:  itemType,
+		ItemID:    itemID,
+		Title:     title,
+		Content:   content,
+		UserID:    userID,
+		CreatedAt: createdAt,
+	})
+}
+
+func (m *Memory) GetRevisionList(itemID string) ([]model.Revision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var revisionList []model.Revision
+	for _, r := range m.revisions {
+		if r.ItemID == itemID {
+			revisionList = append(revisionList, r)
+		}
+	}
+
+	return revisionList, nil
+}
+
+/////////////////////////////////////////////////////////////////
+// moderation
+
+func (m *Memory) SetUserRole(userID string, role model.Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	u.Role = role
+	u.BannedUntil = nil
+	m.users[userID] = u
+
+	return nil
+}
+
+func (m *Memory) BanUser(userID string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	u.Role = model.RoleBanned
+	u.BannedUntil = nil
+	if !until.IsZero() {
+		until = until.UTC()
+		u.BannedUntil = &until
+	}
+	m.users[userID] = u
+
+	return nil
+}
+
+func (m *Memory) GetUserList(role model.Role) ([]model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var userList []model.User
+	for _, u := range m.users {
+		if role == "" || u.Role == role {
+			userList = append(userList, u)
+		}
+	}
+	sortUsers(userList)
+
+	return userList, nil
+}
+
+// sortUsers orders users by name.
+func sortUsers(userList []model.User) {
+	sort.Slice(userList, func(i, j int) bool {
+		a, b := userList[i], userList[j]
+		if a.UserName != b.UserName {
+			return a.UserName < b.UserName
+		}
+		return a.ID < b.ID
+	})
+}
+
+func (m *Memory) AddForumModerator(forumName, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !slices.Contains(m.moderators[forumName], userID) {
+		m.moderators[forumName] = append(m.moderators[forumName], userID)
+	}
+
+	return nil
+}
+
+func (m *Memory) RemoveForumModerator(forumName, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.Index(m.moderators[forumName], userID)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	m.moderators[forumName] = slices.Delete(m.moderators[forumName], i, i+1)
+
+	return nil
+}
+
+func (m *Memory) GetForumModeratorList(forumName string) ([]model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var userList []model.User
+	for _, id := range m.moderators[forumName] {
+		if u, ok := m.users[id]; ok {
+			userList = append(userList, u)
+		}
+	}
+	sortUsers(userList)
+
+	return userList, nil
+}
+
+func (m *Memory) IsForumModerator(forumName, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Contains(m.moderators[forumName], userID), nil
+}
+
+// updateThread applies change to a thread, it returns store.ErrNotFound
+// if there is no thread with that id.
+func (m *Memory) updateThread(id string, change func(t *model.Thread)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.threads[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	change(&t)
+	m.threads[id] = t
+
+	return nil
+}
+
+func (m *Memory) SetThreadLocked(id string, locked bool) error {
+	return m.updateThread(id, func(t *model.Thread) { t.Locked = locked })
+}
+
+func (m *Memory) SetThreadPinned(id string, pinned bool) error {
+	return m.updateThread(id, func(t *model.Thread) { t.Pinned = pinned })
+}
+
+func (m *Memory) MoveThread(id, forumName string) error {
+	return m.updateThread(id, func(t *model.Thread) { t.ForumName = forumName })
+}
+
+func (m *Memory) CreateAuditLog(entry *model.AuditLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry.ID == "" {
+		entry.ID = util.RandomID()
+	}
+	e := *entry
+	e.CreatedAt = now()
+	m.auditLog = append(m.auditLog, e)
+
+	return nil
+}
+
+func (m *Memory) GetAuditLogList(limit int) ([]model.AuditLogView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entryList []model.AuditLogView
+	for i := len(m.auditLog) - 1; i >= 0 && len(entryList) < limit; i-- {
+		e := m.auditLog[i]
+		entryList = append(entryList, model.AuditLogView{
+			AuditLog: e,
+			UserName: m.users[e.UserID].UserName,
+		})
+	}
+
+	return entryList, nil
+}
+
+/////////////////////////////////////////////////////////////////
+// chat
+
+func (m *Memory) CreateChatRoom(room *model.ChatRoom) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slug := uniqueSlug(room.Name, "room", func(slug string) bool {
+		_, ok := m.chatRooms[slug]
+		return ok
+	})
+
+	t := now()
+	m.chatRooms[slug] = model.ChatRoom{
+		Name:      room.Name,
+		NameSlug:  slug,
+		CreatedAt: t,
+		UpdatedAt: t,
+	}
+	room.NameSlug = slug
+
+	return nil
+}
+
+func (m *Memory) GetChatRoom(name string) (*model.ChatRoom, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.chatRooms[strings.ToLower(name)]
+	if !ok {
+		return &model.ChatRoom{}, store.ErrNotFound
+	}
+
+	return &room, nil
+}
+
+func (m *Memory) GetChatRoomList() ([]model.ChatRoom, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var roomList []model.ChatRoom
+	for _, r := range m.chatRooms {
+		roomList = append(roomList, r)
+	}
+	sort.Slice(roomList, func(i, j int) bool {
+		return roomList[i].NameSlug < roomList[j].NameSlug
+	})
+
+	return roomList, nil
+}
+
+func (m *Memory) DeleteChatRoom(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.chatRooms, strings.ToLower(name))
+
+	return nil
+}
+
+func (m *Memory) CreateChatMessage(message *model.ChatMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.chatMessages[message.ID]; ok {
+		return fmt.Errorf("memory: chat message %q already exists", message.ID)
+	}
+
+	msg := *message
+	msg.CreatedAt = now()
+	msg.UpdatedAt = msg.CreatedAt
+	m.seq++
+	msg.Seq = m.seq
+	m.chatMessages[msg.ID] = msg
+
+	return nil
+}
+
+func (m *Memory) GetChatMessage(id string) (*model.ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.chatMessages[id]
+	if !ok {
+		return &model.ChatMessage{}, store.ErrNotFound
+	}
+
+	return &msg, nil
+}
+
+func (m *Memory) GetChatMessageList(roomID string) ([]model.ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.chatMessageList(roomID), nil
+}
+
+func (m *Memory) GetChatMessagePage(roomID, before string, limit int) ([]model.ChatMessageView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messageList := m.chatMessageList(roomID)
+	if before != "" {
+		for i, msg := range messageList {
+			if msg.ID == before {
+				messageList = messageList[:i]
+				break
+			}
+		}
+	}
+	if len(messageList) > limit {
+		messageList = messageList[len(messageList)-limit:]
+	}
+
+	var viewList []model.ChatMessageView
+	for _, msg := range messageList {
+		viewList = append(viewList, model.ChatMessageView{
+			ChatMessage: msg,
+			UserName:    m.users[msg.UserID].UserName,
+		})
+	}
+
+	return viewList, nil
+}
+
+// chatMessageList returns the messages of a room oldest first, it must be
+// called with m.mu held.
+func (m *Memory) chatMessageList(roomID string) []model.ChatMessage {
+	var messageList []model.ChatMessage
+	for _, msg := range m.chatMessages {
+		if msg.RoomID == roomID {
+			messageList = append(messageList, msg)
+		}
+	}
+	sort.Slice(messageList, func(i, j int) bool {
+		return messageList[i].Seq < messageList[j].Seq
+	})
+
+	return messageList
+}
+
+func (m *Memory) DeleteChatMessage(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.chatMessages, id)
+
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////
+// search
+
+// Search matches items containing every word of the query, ignoring
+// case, newest first.
+func (m *Memory) Search(q store.SearchQuery, scope store.SearchScope, page int) ([]model.SearchResult, error) {
+	words := strings.Fields(strings.ToLower(q.Text))
+	if len(words) == 0 {
+		return nil, nil
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	matches := func(text, forum, userID string, createdAt time.Time) bool {
+		if q.Forum != "" && forum != strings.ToLower(q.Forum) {
+			return false
+		}
+		if q.Author != "" && !strings.EqualFold(m.users[userID].UserName, q.Author) {
+			return false
+		}
+		if !q.From.IsZero() && createdAt.Before(q.From) {
+			return false
+		}
+		if !q.To.IsZero() && !createdAt.Before(q.To) {
+			return false
+		}
+		text = strings.ToLower(text)
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var resultList []model.SearchResult
+
+	for _, t := range m.threads {
+		if t.Deleted || (scope != store.SearchAll && scope != store.SearchThreads) {
+			continue
+		}
+		if matches(t.Title+" "+t.Content, t.ForumName, t.UserID, t.CreatedAt) {
+			resultList = append(resultList, model.SearchResult{
+				Kind:      "thread",
+				ID:        t.ID,
+				ThreadID:  t.ID,
+				Forum:     t.ForumName,
+				Title:     t.Title,
+				Snippet:   highlight(t.Content, words),
+				UserName:  m.users[t.UserID].UserName,
+				CreatedAt: t.CreatedAt,
+			})
+		}
+	}
+
+	for _, c := range m.comments {
+		if c.Deleted || (scope != store.SearchAll && scope != store.SearchComments) {
+			continue
+		}
+		t := m.threads[c.ThreadID]
+		if t.Deleted {
+			continue
+		}
+		if matches(c.Content, t.ForumName, c.UserID, c.CreatedAt) {
+			resultList = append(resultList, model.SearchResult{
+				Kind:      "comment",
+				ID:        c.ID,
+				ThreadID:  c.ThreadID,
+				Forum:     t.ForumName,
+				Title:     t.Title,
+				Snippet:   highlight(c.Content, words),
+				UserName:  m.users[c.UserID].UserName,
+				CreatedAt: c.CreatedAt,
+			})
+		}
+	}
+
+	for _, msg := range m.chatMessages {
+		if q.Forum != "" || (scope != store.SearchAll && scope != store.SearchChat) {
+			break
+		}
+		if matches(msg.Content, "", msg.UserID, msg.CreatedAt) {
+			title := msg.RoomID
+			if r, ok := m.chatRooms[msg.RoomID]; ok {
+				title = r.Name
+			}
+			resultList = append(resultList, model.SearchResult{
+				Kind:      "chat",
+				ID:        msg.ID,
+				Forum:     msg.RoomID,
+				Title:     title,
+				Snippet:   highlight(msg.Content, words),
+				UserName:  m.users[msg.UserID].UserName,
+				CreatedAt: msg.CreatedAt,
+			})
+		}
+	}
+
+	sort.Slice(resultList, func(i, j int) bool {
+		a, b := resultList[i], resultList[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+
+	start := (page - 1) * q.Limit
+	if start >= len(resultList) {
+		return nil, nil
+	}
+	resultList = resultList[start:]
+	if len(resultList) > q.Limit {
+		resultList = resultList[:q.Limit]
+	}
+
+	return resultList, nil
+}
+
+// highlight marks the words found in text with store.HighlightStart and
+// store.HighlightEnd, words must be lower case.
+func highlight(text string, words []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// case mapping changed byte offsets, leave the text as is
+		return text
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		n := 0
+		for _, w := range words {
+			if strings.HasPrefix(lower[i:], w) && len(w) > n {
+				n = len(w)
+			}
+		}
+		if n == 0 {
+			b.WriteByte(text[i])
+			i++
+			continue
+		}
+		b.WriteString(store.HighlightStart + text[i:i+n] + store.HighlightEnd)
+		i += n
+	}
+
+	return b.String()
+}
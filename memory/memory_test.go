@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"realm/store"
+	"realm/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return New()
+	})
+}
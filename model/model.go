@@ -11,21 +11,87 @@ type SessionData struct {
 	UserName      string    `db:"user_name"`
 	AvatarURL     string    `db:"avatar_url"`
 	SessionID     string    `db:"session_id"`
+	CSRFToken     string    `db:"csrf_token"`
+	// the device that last used the session
+	UserAgent  string    `db:"user_agent"`
+	IP         string    `db:"ip"`
+	LastSeenAt time.Time `db:"last_seen_at"`
 }
 
+// Role is the site wide role of a user.
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleBanned    Role = "banned"
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	return r == RoleAdmin || r == RoleModerator || r == RoleMember || r == RoleBanned
+}
+
+// User is a realm account. OAuthProvider and OAuthUserID are the identity
+// the account was created with, every identity that logs into it is a
+// UserIdentity.
 type User struct {
 	ID            string `db:"id"`
 	OAuthProvider string `db:"oauth_provider"`
 	OAuthUserID   string `db:"oauth_user_id"`
 	UserName      string `db:"user_name"`
 	AvatarURL     string `db:"avatar_url"`
+	Role          Role   `db:"role"`
+	// BannedUntil is when a ban ends, nil for a permanent ban
+	BannedUntil *time.Time `db:"banned_until"`
+}
+
+// RoleAt returns the role of the user at time t, a member once the ban
+// is over.
+func (u User) RoleAt(t time.Time) Role {
+	if u.Role == RoleBanned && u.BannedUntil != nil && !t.Before(*u.BannedUntil) {
+		return RoleMember
+	}
+	return u.Role
+}
+
+// UserIdentity is an OAuth account linked to a user, UserName is the name
+// the provider reported on the last login.
+type UserIdentity struct {
+	OAuthProvider string    `db:"oauth_provider"`
+	OAuthUserID   string    `db:"oauth_user_id"`
+	UserID        string    `db:"user_id"`
+	UserName      string    `db:"user_name"`
+	CreatedAt     time.Time `db:"created_at"`
 }
 
 // forum
 
 type Forum struct {
-	Name     string `db:"name"`
-	NameSlug string `db:"name_slug"`
+	Name        string `db:"name"`
+	NameSlug    string `db:"name_slug"`
+	Description string `db:"description"`
+	// SortOrder places the forum on the index, lower first
+	SortOrder int `db:"sort_order"`
+	// CategorySlug is the parent category, empty for none
+	CategorySlug string `db:"category_slug"`
+	// Archived forums are read only
+	Archived bool `db:"archived"`
+}
+
+// ForumView is a forum with its counts and latest post, used to render
+// the forum index.
+type ForumView struct {
+	Forum
+	ThreadCount int `db:"thread_count"`
+	// PostCount counts threads and comments, deleted ones are left out
+	PostCount int `db:"post_count"`
+	// the thread with the latest post, empty when the forum has none
+	LastThreadID    string     `db:"last_thread_id"`
+	LastThreadTitle string     `db:"last_thread_title"`
+	LastUserName    string     `db:"last_user_name"`
+	LastPostAt      *time.Time `db:"last_post_at"`
 }
 
 type Thread struct {
@@ -36,6 +102,28 @@ type Thread struct {
 	UserID    string    `db:"user_id"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
+	Deleted   bool      `db:"deleted"`
+	// EditedAt is when the author last changed the thread, nil if never
+	EditedAt *time.Time `db:"edited_at"`
+	// LastPostAt is when the thread or its latest comment was posted
+	LastPostAt time.Time `db:"last_post_at"`
+	// Locked threads take no new comments and no edits but from moderators
+	Locked bool `db:"locked"`
+	// Pinned threads are listed first in their forum
+	Pinned bool `db:"pinned"`
+}
+
+// Edited reports whether the thread was changed after it was created.
+func (t Thread) Edited() bool {
+	return t.EditedAt != nil
+}
+
+// ThreadView is a thread joined with its author name and comment count,
+// used to render the thread list and the thread page.
+type ThreadView struct {
+	Thread
+	UserName     string `db:"user_name"`
+	CommentCount int    `db:"comment_count"`
 }
 
 type Comment struct {
@@ -45,6 +133,52 @@ type Comment struct {
 	Content   string    `db:"content"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
+	Deleted   bool      `db:"deleted"`
+	// EditedAt is when the author last changed the comment, nil if never
+	EditedAt *time.Time `db:"edited_at"`
+	// Seq orders the comments as they were written, set by the store
+	Seq int64 `db:"seq"`
+}
+
+// Edited reports whether the comment was changed after it was created.
+func (c Comment) Edited() bool {
+	return c.EditedAt != nil
+}
+
+// CommentView is a comment joined with its author name.
+type CommentView struct {
+	Comment
+	UserName string `db:"user_name"`
+}
+
+// Revision is a previous version of a thread or comment, kept when the
+// author edits or deletes it.
+type Revision struct {
+	ID        string    `db:"id"`
+	ItemType  string    `db:"item_type"` // "thread" or "comment"
+	ItemID    string    `db:"item_id"`
+	Title     string    `db:"title"`
+	Content   string    `db:"content"`
+	UserID    string    `db:"user_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// AuditLog records a moderation action. TargetType is "thread",
+// "comment" or "user".
+type AuditLog struct {
+	ID         string    `db:"id"`
+	UserID     string    `db:"user_id"` // who did it
+	Action     string    `db:"action"`
+	TargetType string    `db:"target_type"`
+	TargetID   string    `db:"target_id"`
+	Detail     string    `db:"detail"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// AuditLogView is an audit log entry with the name of the moderator.
+type AuditLogView struct {
+	AuditLog
+	UserName string `db:"user_name"`
 }
 
 // chat
@@ -63,9 +197,33 @@ type ChatMessage struct {
 	Content   string    `db:"content"`
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
+	// Seq orders the messages as they were written, set by the store
+	Seq int64 `db:"seq"`
 }
 
+// ChatMessageView is a chat message with the name of its author.
+type ChatMessageView struct {
+	ChatMessage
+	UserName string `db:"user_name"`
+}
+
+// Category groups forums on the forum index.
 type Category struct {
 	NameSlug string `db:"name_slug"`
 	Name     string `db:"name"`
+	// SortOrder places the category on the index, lower first
+	SortOrder int `db:"sort_order"`
+}
+
+// SearchResult is an item found by a full text search. Kind is "thread",
+// "comment" or "chat". For chat messages Forum and Title hold the room.
+type SearchResult struct {
+	Kind      string    `db:"kind"`
+	ID        string    `db:"id"`
+	ThreadID  string    `db:"thread_id"`
+	Forum     string    `db:"forum"`
+	Title     string    `db:"title"`
+	Snippet   string    `db:"snippet"`
+	UserName  string    `db:"user_name"`
+	CreatedAt time.Time `db:"created_at"`
 }
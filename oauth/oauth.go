@@ -0,0 +1,115 @@
+// Package oauth keeps the OAuth login providers enabled in the config and
+// serves their login and callback endpoints. Every provider maps the
+// profile of the logged in user to a Profile, the forum turns it into a
+// model.User.
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dghubble/gologin/v2"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
+	"golang.org/x/oauth2"
+)
+
+// Profile is the user information read from a provider.
+type Profile struct {
+	ID        string // unique and stable within the provider
+	Name      string
+	AvatarURL string
+}
+
+// Provider is an OAuth 2.0 login provider.
+type Provider struct {
+	// Name identifies the provider in URLs and in model.User.OAuthProvider.
+	Name string
+	// Title is shown on the login page.
+	Title  string
+	Config *oauth2.Config
+	// Profile reads the user profile with the token of a finished login.
+	Profile func(ctx context.Context, token *oauth2.Token) (Profile, error)
+}
+
+// Registry holds the enabled providers in the order they were registered.
+type Registry struct {
+	providers map[string]*Provider
+	order     []*Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		providers: make(map[string]*Provider),
+	}
+}
+
+// Register adds p, a provider name can only be registered once.
+func (r *Registry) Register(p *Provider) error {
+	if _, ok := r.providers[p.Name]; ok {
+		return fmt.Errorf("oauth provider %q already registered", p.Name)
+	}
+	r.providers[p.Name] = p
+	r.order = append(r.order, p)
+	return nil
+}
+
+func (r *Registry) Get(name string) (*Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// List returns the providers in registration order.
+func (r *Registry) List() []*Provider {
+	return r.order
+}
+
+// LoginHandler redirects to the authorization page of the provider named
+// by the {provider} path value.
+func (r *Registry) LoginHandler(cookie gologin.CookieConfig) http.Handler {
+	handlers := make(map[string]http.Handler)
+	for _, p := range r.order {
+		handlers[p.Name] = oauth2Login.StateHandler(cookie,
+			oauth2Login.LoginHandler(p.Config, nil))
+	}
+	return dispatch(handlers)
+}
+
+// CallbackHandler finishes the login with the provider named by the
+// {provider} path value, reads the user profile and calls success.
+func (r *Registry) CallbackHandler(cookie gologin.CookieConfig, success func(w http.ResponseWriter, r *http.Request, p *Provider, profile Profile)) http.Handler {
+	handlers := make(map[string]http.Handler)
+	for _, p := range r.order {
+		profileHandler := func(w http.ResponseWriter, req *http.Request) {
+			token, err := oauth2Login.TokenFromContext(req.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			profile, err := p.Profile(req.Context(), token)
+			if err != nil {
+				log.Printf("%s profile: %v\n", p.Name, err)
+				http.Error(w, "could not read the user profile", http.StatusBadGateway)
+				return
+			}
+
+			success(w, req, p, profile)
+		}
+		handlers[p.Name] = oauth2Login.StateHandler(cookie,
+			oauth2Login.CallbackHandler(p.Config, http.HandlerFunc(profileHandler), nil))
+	}
+	return dispatch(handlers)
+}
+
+func dispatch(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.PathValue("provider")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,195 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// getJSON reads the JSON document at url with the token into v.
+func getJSON(ctx context.Context, config *oauth2.Config, token *oauth2.Token, url string, v any) error {
+	resp, err := config.Client(ctx, token).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// firstNonEmpty returns the first value that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func GitHub(clientID, clientSecret, redirectURL string) *Provider {
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     endpoints.GitHub,
+	}
+
+	return &Provider{
+		Name:   "github",
+		Title:  "GitHub",
+		Config: config,
+		Profile: func(ctx context.Context, token *oauth2.Token) (Profile, error) {
+			var u struct {
+				ID        int64  `json:"id"`
+				Login     string `json:"login"`
+				Name      string `json:"name"`
+				AvatarURL string `json:"avatar_url"`
+			}
+			err := getJSON(ctx, config, token, "https://api.github.com/user", &u)
+			if err != nil {
+				return Profile{}, err
+			}
+			return Profile{
+				ID:        strconv.FormatInt(u.ID, 10),
+				Name:      firstNonEmpty(u.Name, u.Login),
+				AvatarURL: u.AvatarURL,
+			}, nil
+		},
+	}
+}
+
+// GitLab returns a provider for gitlab.com or the self-hosted instance at
+// baseURL.
+func GitLab(baseURL, clientID, clientSecret, redirectURL string) *Provider {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"read_user"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  baseURL + "/oauth/authorize",
+			TokenURL: baseURL + "/oauth/token",
+		},
+	}
+
+	return &Provider{
+		Name:   "gitlab",
+		Title:  "GitLab",
+		Config: config,
+		Profile: func(ctx context.Context, token *oauth2.Token) (Profile, error) {
+			var u struct {
+				ID        int64  `json:"id"`
+				Username  string `json:"username"`
+				Name      string `json:"name"`
+				AvatarURL string `json:"avatar_url"`
+			}
+			err := getJSON(ctx, config, token, baseURL+"/api/v4/user", &u)
+			if err != nil {
+				return Profile{}, err
+			}
+			return Profile{
+				ID:        strconv.FormatInt(u.ID, 10),
+				Name:      firstNonEmpty(u.Name, u.Username),
+				AvatarURL: u.AvatarURL,
+			}, nil
+		},
+	}
+}
+
+func Google(clientID, clientSecret, redirectURL string) *Provider {
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "profile"},
+		Endpoint:     endpoints.Google,
+	}
+
+	return &Provider{
+		Name:   "google",
+		Title:  "Google",
+		Config: config,
+		Profile: func(ctx context.Context, token *oauth2.Token) (Profile, error) {
+			var u struct {
+				Sub     string `json:"sub"`
+				Name    string `json:"name"`
+				Picture string `json:"picture"`
+			}
+			err := getJSON(ctx, config, token, "https://openidconnect.googleapis.com/v1/userinfo", &u)
+			if err != nil {
+				return Profile{}, err
+			}
+			return Profile{
+				ID:        u.Sub,
+				Name:      firstNonEmpty(u.Name, u.Sub),
+				AvatarURL: u.Picture,
+			}, nil
+		},
+	}
+}
+
+// OIDC returns a provider for any OpenID Connect issuer, its endpoints are
+// discovered from issuerURL and the profile is read from the verified ID
+// token.
+func OIDC(ctx context.Context, title, issuerURL, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	issuer, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{oidc.ScopeOpenID, "profile"},
+		Endpoint:     issuer.Endpoint(),
+	}
+	verifier := issuer.Verifier(&oidc.Config{ClientID: clientID})
+
+	return &Provider{
+		Name:   "oidc",
+		Title:  firstNonEmpty(title, "OpenID Connect"),
+		Config: config,
+		Profile: func(ctx context.Context, token *oauth2.Token) (Profile, error) {
+			rawIDToken, ok := token.Extra("id_token").(string)
+			if !ok {
+				return Profile{}, errors.New("no id_token in the token response")
+			}
+
+			idToken, err := verifier.Verify(ctx, rawIDToken)
+			if err != nil {
+				return Profile{}, err
+			}
+
+			var claims struct {
+				Name              string `json:"name"`
+				PreferredUsername string `json:"preferred_username"`
+				Picture           string `json:"picture"`
+			}
+			err = idToken.Claims(&claims)
+			if err != nil {
+				return Profile{}, err
+			}
+
+			return Profile{
+				ID:        idToken.Subject,
+				Name:      firstNonEmpty(claims.Name, claims.PreferredUsername, idToken.Subject),
+				AvatarURL: claims.Picture,
+			}, nil
+		},
+	}, nil
+}
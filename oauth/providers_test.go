@@ -0,0 +1,259 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dghubble/gologin/v2"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// fakeIssuer is an OpenID Connect issuer that serves discovery, its keys
+// and a token endpoint. The token endpoint trades code "good" for a token
+// with the ID token in idToken.
+type fakeIssuer struct {
+	srv     *httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                fi.srv.URL,
+			"authorization_endpoint":                fi.srv.URL + "/authorize",
+			"token_endpoint":                        fi.srv.URL + "/token",
+			"jwks_uri":                              fi.srv.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     "key1",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("code") != "good" || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := map[string]any{"access_token": "access", "token_type": "Bearer", "expires_in": 3600}
+		if fi.idToken != "" {
+			token["id_token"] = fi.idToken
+		}
+		writeJSON(w, token)
+	})
+	fi.srv = httptest.NewServer(mux)
+	t.Cleanup(fi.srv.Close)
+
+	return fi
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// claims returns valid ID token claims for client "client".
+func (fi *fakeIssuer) claims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                fi.srv.URL,
+		"sub":                "user-42",
+		"aud":                "client",
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"name":               "Alice",
+		"preferred_username": "alice",
+		"picture":            "https://example.com/alice.png",
+	}
+}
+
+// sign returns claims as a JWT signed with key.
+func sign(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newTestOIDC(t *testing.T, fi *fakeIssuer) *Provider {
+	t.Helper()
+
+	p, err := OIDC(context.Background(), "", fi.srv.URL, "client", "secret", "http://realm.test/forum/oauth/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	fi := newFakeIssuer(t)
+	p := newTestOIDC(t, fi)
+
+	if p.Name != "oidc" || p.Title != "OpenID Connect" {
+		t.Errorf("provider %q titled %q", p.Name, p.Title)
+	}
+	if p.Config.Endpoint.AuthURL != fi.srv.URL+"/authorize" || p.Config.Endpoint.TokenURL != fi.srv.URL+"/token" {
+		t.Errorf("endpoint = %+v", p.Config.Endpoint)
+	}
+
+	_, err := OIDC(context.Background(), "", fi.srv.URL+"/missing", "client", "secret", "")
+	if err == nil {
+		t.Error("discovered an issuer that does not exist")
+	}
+}
+
+func TestOIDCProfile(t *testing.T) {
+	fi := newFakeIssuer(t)
+	p := newTestOIDC(t, fi)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		change func(claims map[string]any)
+		// noIDToken leaves the ID token out of the token response
+		noIDToken bool
+		want      Profile
+		err       string
+	}{
+		{name: "valid", want: Profile{ID: "user-42", Name: "Alice", AvatarURL: "https://example.com/alice.png"}},
+		{
+			name:   "username when no name",
+			change: func(c map[string]any) { delete(c, "name") },
+			want:   Profile{ID: "user-42", Name: "alice", AvatarURL: "https://example.com/alice.png"},
+		},
+		{name: "other audience", change: func(c map[string]any) { c["aud"] = "someone-else" }, err: "audience"},
+		{name: "other issuer", change: func(c map[string]any) { c["iss"] = "https://evil.test" }, err: "different provider"},
+		{name: "expired", change: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, err: "expired"},
+		{name: "signed with another key", key: otherKey, err: "signature"},
+		{name: "no id token", noIDToken: true, err: "no id_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi.idToken = ""
+			if !tt.noIDToken {
+				claims := fi.claims()
+				if tt.change != nil {
+					tt.change(claims)
+				}
+				key := tt.key
+				if key == nil {
+					key = fi.key
+				}
+				fi.idToken = sign(t, key, claims)
+			}
+
+			ctx := context.Background()
+			token, err := p.Config.Exchange(ctx, "good")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			profile, err := p.Profile(ctx, token)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want one about %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile != tt.want {
+				t.Errorf("profile = %+v, want %+v", profile, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	fi := newFakeIssuer(t)
+	fi.idToken = sign(t, fi.key, fi.claims())
+
+	registry := NewRegistry()
+	if err := registry.Register(newTestOIDC(t, fi)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Profile
+	callback := registry.CallbackHandler(gologin.DebugOnlyCookieConfig,
+		func(w http.ResponseWriter, r *http.Request, p *Provider, profile Profile) {
+			got = profile
+		})
+
+	tests := []struct {
+		name  string
+		code  string
+		state string
+		want  int
+	}{
+		{"login", "good", "state1", http.StatusOK},
+		{"bad code", "bad", "state1", http.StatusBadRequest},
+		{"other state", "good", "state2", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = Profile{}
+			r := httptest.NewRequest(http.MethodGet, "/forum/oauth/oidc/callback?code="+tt.code+"&state="+tt.state, nil)
+			r.SetPathValue("provider", "oidc")
+			r.AddCookie(&http.Cookie{Name: gologin.DebugOnlyCookieConfig.Name, Value: "state1"})
+			rec := httptest.NewRecorder()
+			callback.ServeHTTP(rec, r)
+
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusOK && got.ID != "user-42" {
+				t.Errorf("profile = %+v", got)
+			}
+			if tt.want != http.StatusOK && got.ID != "" {
+				t.Errorf("logged in with %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Package permission decides what a user may do on the forum and in the
+// chat, from the role of the user and the forums they moderate.
+package permission
+
+import (
+	"errors"
+	"time"
+
+	"realm/model"
+	"realm/store"
+)
+
+// Action is something a user may be allowed to do.
+type Action string
+
+const (
+	// Post creates threads and comments and changes the user's own posts.
+	Post Action = "post"
+	// Chat sends messages to chat rooms.
+	Chat Action = "chat"
+	// Moderate locks, pins and moves threads and deletes posts of others.
+	Moderate Action = "moderate"
+	// Ban bans and unbans users.
+	Ban Action = "ban"
+	// Manage creates and deletes forums and chat rooms and assigns roles
+	// and forum moderators.
+	Manage Action = "manage"
+)
+
+// Store is what the Checker reads.
+type Store interface {
+	GetUser(id string) (*model.User, error)
+	IsForumModerator(forumName, userID string) (bool, error)
+}
+
+// Checker answers permission questions for the users in a store.
+type Checker struct {
+	store Store
+}
+
+func New(st Store) *Checker {
+	return &Checker{store: st}
+}
+
+// Allowed reports whether a role may do action anywhere.
+func Allowed(role model.Role, action Action) bool {
+	switch role {
+	case model.RoleAdmin:
+		return true
+	case model.RoleModerator:
+		return action != Manage
+	case model.RoleMember:
+		return action == Post || action == Chat
+	}
+	return false
+}
+
+// Can reports whether the user may do action. forum is the slug of the
+// forum the action is done in, moderators of that forum may Moderate it;
+// it is empty for actions outside the forum. Guests, with an empty
+// userID, may do nothing.
+func (c *Checker) Can(userID string, action Action, forum string) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+
+	user, err := c.store.GetUser(userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	role := user.RoleAt(time.Now())
+	if Allowed(role, action) {
+		return true, nil
+	}
+
+	if action != Moderate || forum == "" || role != model.RoleMember {
+		return false, nil
+	}
+
+	return c.store.IsForumModerator(forum, userID)
+}
+
+// Outranks reports whether a user with role may ban or change the role
+// of a user with role other: admins act on anyone, moderators on members
+// and banned users.
+func Outranks(role, other model.Role) bool {
+	switch role {
+	case model.RoleAdmin:
+		return true
+	case model.RoleModerator:
+		return other == model.RoleMember || other == model.RoleBanned
+	}
+	return false
+}
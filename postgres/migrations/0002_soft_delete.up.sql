@@ -0,0 +1,15 @@
+alter table thread add column deleted boolean not null default false;
+alter table comment add column deleted boolean not null default false;
+
+create table revision (
+	id text not null,
+	item_type text not null,
+	item_id text not null,
+	title text not null,
+	content text not null,
+	user_id text not null,
+	created_at timestamptz not null,
+	primary key(id)
+);
+
+create index revision_item_idx on revision(item_id, created_at);
@@ -0,0 +1 @@
+alter table session drop column csrf_token;
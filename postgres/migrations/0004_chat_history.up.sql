@@ -0,0 +1 @@
+create index chat_message_room_idx on chat_message(room_id, created_at, id);
@@ -0,0 +1,5 @@
+drop index comment_thread_idx;
+drop index thread_created_idx;
+drop index thread_activity_idx;
+
+alter table thread drop column last_post_at;
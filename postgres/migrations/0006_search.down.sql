@@ -0,0 +1,3 @@
+drop index chat_message_search_idx;
+drop index comment_search_idx;
+drop index thread_search_idx;
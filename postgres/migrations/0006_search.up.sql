@@ -0,0 +1,10 @@
+-- full text indexes on the expressions used by Search
+
+create index thread_search_idx on thread
+	using gin (to_tsvector('simple', title || ' ' || content));
+
+create index comment_search_idx on comment
+	using gin (to_tsvector('simple', content));
+
+create index chat_message_search_idx on chat_message
+	using gin (to_tsvector('simple', content));
@@ -0,0 +1,2 @@
+drop index user_identity_user_idx;
+drop table user_identity;
@@ -0,0 +1,10 @@
+create table category (
+	name_slug text not null,
+	name text not null,
+	sort_order integer not null default 0,
+	primary key(name_slug)
+);
+
+-- categories named by forums before the table existed
+insert into category (name_slug, name)
+select distinct category_slug, category_slug from forum where category_slug <> '';
@@ -0,0 +1,5 @@
+drop index session_user_idx;
+
+alter table session drop column last_seen_at;
+alter table session drop column ip;
+alter table session drop column user_agent;
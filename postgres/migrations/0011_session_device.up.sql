@@ -0,0 +1,5 @@
+alter table session add column user_agent text not null default '';
+alter table session add column ip text not null default '';
+alter table session add column last_seen_at timestamptz not null default now();
+
+create index session_user_idx on session(user_id);
@@ -0,0 +1,2 @@
+-- the recomputed last_post_at is kept, there is no schema to revert
+select 1;
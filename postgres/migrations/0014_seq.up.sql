@@ -0,0 +1,21 @@
+-- created_at has whole seconds and ids are random, seq keeps the order
+-- comments and chat messages were written in
+alter table comment add column seq bigserial;
+alter table chat_message add column seq bigserial;
+
+update comment set seq = o.n
+from (select id, row_number() over (order by created_at, id) as n from comment) o
+where comment.id = o.id;
+
+update chat_message set seq = o.n
+from (select id, row_number() over (order by created_at, id) as n from chat_message) o
+where chat_message.id = o.id;
+
+select setval(pg_get_serial_sequence('comment', 'seq'), coalesce(max(seq), 0) + 1, false) from comment;
+select setval(pg_get_serial_sequence('chat_message', 'seq'), coalesce(max(seq), 0) + 1, false) from chat_message;
+
+drop index comment_thread_idx;
+drop index chat_message_room_idx;
+
+create index comment_thread_idx on comment(thread_id, seq);
+create index chat_message_room_idx on chat_message(room_id, seq);
@@ -0,0 +1,3 @@
+-- the full text search of postgres uses the indexes of 0006_search,
+-- only the sqlite schema changes
+select 1;
@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+
+	"realm/model"
+	"realm/store"
+)
+
+var _ store.Store = (*Postgres)(nil)
+
+// Search matches the text search expressions indexed by the 0006_search
+// migration, the snippets come from ts_headline.
+func (p *Postgres) Search(q store.SearchQuery, scope store.SearchScope, page int) ([]model.SearchResult, error) {
+	if strings.TrimSpace(q.Text) == "" {
+		return nil, nil
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	args := []any{q.Text}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// filter returns the conditions of the query filters, forum is empty
+	// for tables that do not belong to a forum
+	filter := func(forum, author, createdAt string) string {
+		var b strings.Builder
+		if q.Forum != "" {
+			fmt.Fprintf(&b, " and %s = %s", forum, arg(strings.ToLower(q.Forum)))
+		}
+		if q.Author != "" {
+			fmt.Fprintf(&b, " and lower(%s) = lower(%s)", author, arg(q.Author))
+		}
+		if !q.From.IsZero() {
+			fmt.Fprintf(&b, " and %s >= %s", createdAt, arg(q.From))
+		}
+		if !q.To.IsZero() {
+			fmt.Fprintf(&b, " and %s < %s", createdAt, arg(q.To))
+		}
+		return b.String()
+	}
+
+	const headline = `'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxWords=24, MinWords=8'`
+
+	var parts []string
+
+	if scope == store.SearchAll || scope == store.SearchThreads {
+		parts = append(parts, `select
+			'thread' as kind,
+			t.id,
+			t.id as thread_id,
+			t.forum_name as forum,
+			t.title,
+			ts_headline('simple', t.content, plainto_tsquery('simple', $1), `+headline+`) as snippet,
+			coalesce(u.user_name, '') as user_name,
+			t.created_at,
+			ts_rank(to_tsvector('simple', t.title || ' ' || t.content), plainto_tsquery('simple', $1)) as rank
+		from thread t
+		left join "user" u on u.id = t.user_id
+		where to_tsvector('simple', t.title || ' ' || t.content) @@ plainto_tsquery('simple', $1)
+		and t.deleted = false`+filter("t.forum_name", "u.user_name", "t.created_at"))
+	}
+
+	if scope == store.SearchAll || scope == store.SearchComments {
+		parts = append(parts, `select
+			'comment' as kind,
+			c.id,
+			c.thread_id,
+			t.forum_name as forum,
+			t.title,
+			ts_headline('simple', c.content, plainto_tsquery('simple', $1), `+headline+`) as snippet,
+			coalesce(u.user_name, '') as user_name,
+			c.created_at,
+			ts_rank(to_tsvector('simple', c.content), plainto_tsquery('simple', $1)) as rank
+		from comment c
+		join thread t on t.id = c.thread_id
+		left join "user" u on u.id = c.user_id
+		where to_tsvector('simple', c.content) @@ plainto_tsquery('simple', $1)
+		and c.deleted = false
+		and t.deleted = false`+filter("t.forum_name", "u.user_name", "c.created_at"))
+	}
+
+	// chat rooms are not part of a forum
+	if (scope == store.SearchAll || scope == store.SearchChat) && q.Forum == "" {
+		parts = append(parts, `select
+			'chat' as kind,
+			m.id,
+			'' as thread_id,
+			m.room_id as forum,
+			coalesce(r.name, m.room_id) as title,
+			ts_headline('simple', m.content, plainto_tsquery('simple', $1), `+headline+`) as snippet,
+			coalesce(u.user_name, '') as user_name,
+			m.created_at,
+			ts_rank(to_tsvector('simple', m.content), plainto_tsquery('simple', $1)) as rank
+		from chat_message m
+		left join chat_room r on r.name_slug = m.room_id
+		left join "user" u on u.id = m.user_id
+		where to_tsvector('simple', m.content) @@ plainto_tsquery('simple', $1)`+filter("", "u.user_name", "m.created_at"))
+	}
+
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	sqlStatement := `select
+		kind, id, thread_id, forum, title, snippet, user_name, created_at
+	from (` + strings.Join(parts, "\nunion all\n") + `) as found
+	order by rank desc, created_at desc
+	limit ` + arg(q.Limit) + ` offset ` + arg((page-1)*q.Limit) + `;`
+
+	var resultList []model.SearchResult
+	err := p.DB.Select(&resultList, sqlStatement, args...)
+
+	return resultList, err
+}
@@ -0,0 +1,307 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Binary layout: type (1 byte), seq (uvarint), time in unix milliseconds
+// (varint) and the payload fields in declaration order. Integers are
+// varints, strings and lists are prefixed by their length as a uvarint.
+
+const (
+	maxStringLength = 1 << 16
+	maxListLength   = 1 << 14
+)
+
+var errShortBuffer = errors.New("binary message truncated")
+
+type writer struct {
+	b []byte
+}
+
+func (w *writer) byte(v byte)      { w.b = append(w.b, v) }
+func (w *writer) uvarint(v uint64) { w.b = binary.AppendUvarint(w.b, v) }
+func (w *writer) varint(v int64)   { w.b = binary.AppendVarint(w.b, v) }
+
+func (w *writer) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.byte(1)
+		return
+	}
+	w.byte(0)
+}
+
+func (w *writer) chat(c Chat) {
+	w.string(c.ID)
+	w.string(c.Room)
+	w.string(c.From)
+	w.string(c.Text)
+	w.varint(c.Time.UnixMilli())
+}
+
+func (w *writer) player(p Player) {
+	w.string(p.ID)
+	w.string(p.Nick)
+	w.varint(int64(p.X))
+	w.varint(int64(p.Y))
+}
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) == 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) length(max int) int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(max) {
+		r.err = fmt.Errorf("length %d over the limit of %d", n, max)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) string() string {
+	n := r.length(maxStringLength)
+	if r.err != nil {
+		return ""
+	}
+	if len(r.b) < n {
+		r.err = errShortBuffer
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+func (r *reader) bool() bool {
+	return r.byte() != 0
+}
+
+func (r *reader) chat() Chat {
+	return Chat{
+		ID:   r.string(),
+		Room: r.string(),
+		From: r.string(),
+		Text: r.string(),
+		Time: time.UnixMilli(r.varint()),
+	}
+}
+
+func (r *reader) player() Player {
+	return Player{
+		ID:   r.string(),
+		Nick: r.string(),
+		X:    int32(r.varint()),
+		Y:    int32(r.varint()),
+	}
+}
+
+func encodeBinary(m Message) ([]byte, error) {
+	w := &writer{}
+	w.byte(byte(m.Type()))
+	w.uvarint(uint64(m.Seq))
+	w.varint(m.Time.UnixMilli())
+
+	switch p := m.Payload.(type) {
+	case Hello:
+		w.uvarint(uint64(len(p.Versions)))
+		for _, v := range p.Versions {
+			w.uvarint(uint64(v))
+		}
+		w.string(string(p.Encoding))
+	case Welcome:
+		w.uvarint(uint64(p.Version))
+		w.string(string(p.Encoding))
+		w.string(p.You)
+	case Error:
+		w.string(p.Message)
+	case Ping:
+		w.uvarint(p.Nonce)
+	case Pong:
+		w.uvarint(p.Nonce)
+	case Text:
+		w.string(p.From)
+		w.string(p.Text)
+	case Move:
+		w.varint(int64(p.DX))
+		w.varint(int64(p.DY))
+	case Snapshot:
+		w.uvarint(p.Tick)
+		w.string(p.You)
+		w.uvarint(uint64(len(p.Players)))
+		for _, pl := range p.Players {
+			w.player(pl)
+		}
+	case Delta:
+		w.uvarint(p.Tick)
+		w.uvarint(uint64(len(p.Players)))
+		for _, pl := range p.Players {
+			w.player(pl)
+		}
+		w.uvarint(uint64(len(p.Removed)))
+		for _, id := range p.Removed {
+			w.string(id)
+		}
+	case Join:
+		w.string(p.Room)
+		w.string(p.Before)
+		w.uvarint(uint64(p.Limit))
+	case Leave:
+		w.string(p.Room)
+	case Say:
+		w.string(p.Room)
+		w.string(p.Text)
+	case Chat:
+		w.chat(p)
+	case History:
+		w.string(p.Room)
+		w.uvarint(uint64(len(p.Messages)))
+		for _, c := range p.Messages {
+			w.chat(c)
+		}
+		w.bool(p.More)
+	default:
+		return nil, fmt.Errorf("cannot encode payload %T", m.Payload)
+	}
+
+	return w.b, nil
+}
+
+func decodeBinary(b []byte) (Message, error) {
+	r := &reader{b: b}
+
+	t := Type(r.byte())
+	m := Message{
+		Seq:  uint32(r.uvarint()),
+		Time: time.UnixMilli(r.varint()),
+	}
+	if r.err != nil {
+		return Message{}, r.err
+	}
+
+	switch t {
+	case TypeHello:
+		var p Hello
+		n := r.length(maxListLength)
+		for i := 0; i < n && r.err == nil; i++ {
+			p.Versions = append(p.Versions, uint16(r.uvarint()))
+		}
+		p.Encoding = Encoding(r.string())
+		m.Payload = p
+	case TypeWelcome:
+		m.Payload = Welcome{
+			Version:  uint16(r.uvarint()),
+			Encoding: Encoding(r.string()),
+			You:      r.string(),
+		}
+	case TypeError:
+		m.Payload = Error{Message: r.string()}
+	case TypePing:
+		m.Payload = Ping{Nonce: r.uvarint()}
+	case TypePong:
+		m.Payload = Pong{Nonce: r.uvarint()}
+	case TypeText:
+		m.Payload = Text{From: r.string(), Text: r.string()}
+	case TypeMove:
+		m.Payload = Move{DX: int8(r.varint()), DY: int8(r.varint())}
+	case TypeSnapshot:
+		p := Snapshot{Tick: r.uvarint(), You: r.string()}
+		n := r.length(maxListLength)
+		for i := 0; i < n && r.err == nil; i++ {
+			p.Players = append(p.Players, r.player())
+		}
+		m.Payload = p
+	case TypeDelta:
+		p := Delta{Tick: r.uvarint()}
+		n := r.length(maxListLength)
+		for i := 0; i < n && r.err == nil; i++ {
+			p.Players = append(p.Players, r.player())
+		}
+		n = r.length(maxListLength)
+		for i := 0; i < n && r.err == nil; i++ {
+			p.Removed = append(p.Removed, r.string())
+		}
+		m.Payload = p
+	case TypeJoin:
+		m.Payload = Join{
+			Room:   r.string(),
+			Before: r.string(),
+			Limit:  uint16(r.uvarint()),
+		}
+	case TypeLeave:
+		m.Payload = Leave{Room: r.string()}
+	case TypeSay:
+		m.Payload = Say{Room: r.string(), Text: r.string()}
+	case TypeChat:
+		m.Payload = r.chat()
+	case TypeHistory:
+		p := History{Room: r.string()}
+		n := r.length(maxListLength)
+		for i := 0; i < n && r.err == nil; i++ {
+			p.Messages = append(p.Messages, r.chat())
+		}
+		p.More = r.bool()
+		m.Payload = p
+	default:
+		return Message{}, fmt.Errorf("unknown message type %d", uint8(t))
+	}
+
+	if r.err != nil {
+		return Message{}, fmt.Errorf("%s: %w", t, r.err)
+	}
+	if len(r.b) != 0 {
+		return Message{}, fmt.Errorf("%s: %d trailing bytes", t, len(r.b))
+	}
+
+	return m, nil
+}
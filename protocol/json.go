@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type jsonEnvelope struct {
+	Type    string          `json:"type"`
+	Seq     uint32          `json:"seq"`
+	Time    int64           `json:"time"` // unix milliseconds
+	Payload json.RawMessage `json:"payload"`
+}
+
+func encodeJSON(m Message) ([]byte, error) {
+	payload, err := json.Marshal(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonEnvelope{
+		Type:    m.Type().String(),
+		Seq:     m.Seq,
+		Time:    m.Time.UnixMilli(),
+		Payload: payload,
+	})
+}
+
+func decodeJSON(b []byte) (Message, error) {
+	var e jsonEnvelope
+	err := json.Unmarshal(b, &e)
+	if err != nil {
+		return Message{}, err
+	}
+
+	t, ok := typeFromName(e.Type)
+	if !ok {
+		return Message{}, fmt.Errorf("unknown message type %q", e.Type)
+	}
+
+	p, err := newPayload(t)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if len(e.Payload) > 0 {
+		err = json.Unmarshal(e.Payload, p)
+		if err != nil {
+			return Message{}, fmt.Errorf("%s payload: %w", t, err)
+		}
+	}
+
+	return Message{
+		Seq:     e.Seq,
+		Time:    time.UnixMilli(e.Time),
+		Payload: deref(p),
+	}, nil
+}
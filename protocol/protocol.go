@@ -0,0 +1,325 @@
+// Package protocol defines the messages exchanged over the realm websocket
+// by the server (handler package) and the client. Every message is an
+// envelope with a type, a sequence number, a timestamp and a payload. It
+// can be encoded as JSON, sent in text frames and handy for debugging, or
+// in a compact binary form sent in binary frames.
+//
+// The first message of a connection is a Hello from the client listing
+// the protocol versions it speaks, the server answers with a Welcome
+// carrying the version chosen or with an Error and closes.
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version is the newest protocol version known by this package.
+const Version = 1
+
+// SupportedVersions lists the versions this package can speak.
+var SupportedVersions = []uint16{1}
+
+type Type uint8
+
+const (
+	TypeHello Type = iota + 1
+	TypeWelcome
+	TypeError
+	TypePing
+	TypePong
+	TypeText
+	TypeMove
+	TypeSnapshot
+	TypeDelta
+	TypeJoin
+	TypeLeave
+	TypeSay
+	TypeChat
+	TypeHistory
+)
+
+var typeNames = map[Type]string{
+	TypeHello:    "hello",
+	TypeWelcome:  "welcome",
+	TypeError:    "error",
+	TypePing:     "ping",
+	TypePong:     "pong",
+	TypeText:     "text",
+	TypeMove:     "move",
+	TypeSnapshot: "snapshot",
+	TypeDelta:    "delta",
+	TypeJoin:     "join",
+	TypeLeave:    "leave",
+	TypeSay:      "say",
+	TypeChat:     "chat",
+	TypeHistory:  "history",
+}
+
+func (t Type) String() string {
+	name, ok := typeNames[t]
+	if !ok {
+		return fmt.Sprintf("type(%d)", uint8(t))
+	}
+	return name
+}
+
+// typeFromName is the inverse of String.
+func typeFromName(name string) (Type, bool) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+type Encoding string
+
+const (
+	JSON   Encoding = "json"
+	Binary Encoding = "binary"
+)
+
+// Payload is implemented by every message body.
+type Payload interface {
+	Type() Type
+}
+
+// Message is the envelope of every message.
+type Message struct {
+	Seq     uint32
+	Time    time.Time // millisecond precision on the wire
+	Payload Payload
+}
+
+func (m Message) Type() Type {
+	if m.Payload == nil {
+		return 0
+	}
+	return m.Payload.Type()
+}
+
+// Hello is the first message sent by the client.
+type Hello struct {
+	Versions []uint16 `json:"versions"`
+	Encoding Encoding `json:"encoding"`
+}
+
+// Welcome accepts a connection, Version and Encoding are the ones the
+// server will use. You is the public id of the player.
+type Welcome struct {
+	Version  uint16   `json:"version"`
+	Encoding Encoding `json:"encoding"`
+	You      string   `json:"you"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+}
+
+type Ping struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+type Pong struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+// Text is a free text message, From is filled by the server with the
+// public id of the sender.
+type Text struct {
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+// Move is a movement intent, DX and DY are -1, 0 or 1.
+type Move struct {
+	DX int8 `json:"dx"`
+	DY int8 `json:"dy"`
+}
+
+// Player is the public state of a player.
+type Player struct {
+	ID   string `json:"id"`
+	Nick string `json:"nick"`
+	X    int32  `json:"x"`
+	Y    int32  `json:"y"`
+}
+
+// Snapshot lists every player visible to the receiver.
+type Snapshot struct {
+	Tick    uint64   `json:"tick"`
+	You     string   `json:"you"`
+	Players []Player `json:"players"`
+}
+
+// Delta lists the visible players that appeared or moved since the last
+// message and the ids of the ones that left the view.
+type Delta struct {
+	Tick    uint64   `json:"tick"`
+	Players []Player `json:"players,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Join joins a chat room, the server answers with a History holding the
+// latest Limit messages. Sending Join again for a joined room with Before
+// set to the oldest message id received pages back through the history.
+type Join struct {
+	Room   string `json:"room"`
+	Before string `json:"before,omitempty"`
+	Limit  uint16 `json:"limit,omitempty"`
+}
+
+type Leave struct {
+	Room string `json:"room"`
+}
+
+// Say sends a message to a joined chat room.
+type Say struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+// Chat is a chat room message, sent live to the members of the room and
+// in History.
+type Chat struct {
+	ID   string    `json:"id"`
+	Room string    `json:"room"`
+	From string    `json:"from"` // user name of the author
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// History is a page of messages of a room, oldest first. More tells that
+// older messages exist.
+type History struct {
+	Room     string `json:"room"`
+	Messages []Chat `json:"messages"`
+	More     bool   `json:"more"`
+}
+
+func (Hello) Type() Type    { return TypeHello }
+func (Welcome) Type() Type  { return TypeWelcome }
+func (Error) Type() Type    { return TypeError }
+func (Ping) Type() Type     { return TypePing }
+func (Pong) Type() Type     { return TypePong }
+func (Text) Type() Type     { return TypeText }
+func (Move) Type() Type     { return TypeMove }
+func (Snapshot) Type() Type { return TypeSnapshot }
+func (Delta) Type() Type    { return TypeDelta }
+func (Join) Type() Type     { return TypeJoin }
+func (Leave) Type() Type    { return TypeLeave }
+func (Say) Type() Type      { return TypeSay }
+func (Chat) Type() Type     { return TypeChat }
+func (History) Type() Type  { return TypeHistory }
+
+// newPayload returns a pointer to an empty payload of type t.
+func newPayload(t Type) (Payload, error) {
+	switch t {
+	case TypeHello:
+		return &Hello{}, nil
+	case TypeWelcome:
+		return &Welcome{}, nil
+	case TypeError:
+		return &Error{}, nil
+	case TypePing:
+		return &Ping{}, nil
+	case TypePong:
+		return &Pong{}, nil
+	case TypeText:
+		return &Text{}, nil
+	case TypeMove:
+		return &Move{}, nil
+	case TypeSnapshot:
+		return &Snapshot{}, nil
+	case TypeDelta:
+		return &Delta{}, nil
+	case TypeJoin:
+		return &Join{}, nil
+	case TypeLeave:
+		return &Leave{}, nil
+	case TypeSay:
+		return &Say{}, nil
+	case TypeChat:
+		return &Chat{}, nil
+	case TypeHistory:
+		return &History{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %d", uint8(t))
+}
+
+// deref turns the pointer returned by newPayload back into a value, so
+// decoded messages hold the same types callers encode.
+func deref(p Payload) Payload {
+	switch v := p.(type) {
+	case *Hello:
+		return *v
+	case *Welcome:
+		return *v
+	case *Error:
+		return *v
+	case *Ping:
+		return *v
+	case *Pong:
+		return *v
+	case *Text:
+		return *v
+	case *Move:
+		return *v
+	case *Snapshot:
+		return *v
+	case *Delta:
+		return *v
+	case *Join:
+		return *v
+	case *Leave:
+		return *v
+	case *Say:
+		return *v
+	case *Chat:
+		return *v
+	case *History:
+		return *v
+	}
+	return p
+}
+
+// Negotiate returns the highest version present in both lists.
+func Negotiate(client, server []uint16) (uint16, bool) {
+	var best uint16
+	for _, c := range client {
+		for _, s := range server {
+			if c == s && c > best {
+				best = c
+			}
+		}
+	}
+	return best, best != 0
+}
+
+// Encode encodes m with the given encoding.
+func Encode(enc Encoding, m Message) ([]byte, error) {
+	if m.Payload == nil {
+		return nil, fmt.Errorf("message without payload")
+	}
+
+	switch enc {
+	case JSON:
+		return encodeJSON(m)
+	case Binary:
+		return encodeBinary(m)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", enc)
+}
+
+// Decode decodes a message in the given encoding.
+func Decode(enc Encoding, b []byte) (Message, error) {
+	switch enc {
+	case JSON:
+		return decodeJSON(b)
+	case Binary:
+		return decodeBinary(b)
+	}
+	return Message{}, fmt.Errorf("unknown encoding %q", enc)
+}
@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.UnixMilli(1700000000123)
+
+var testChat = Chat{
+	ID:   "m1",
+	Room: "lobby",
+	From: "Alice",
+	Text: "olá, mundo",
+	Time: testTime,
+}
+
+// testPayloads holds at least one payload of every type.
+var testPayloads = []Payload{
+	Hello{Versions: []uint16{1, 2}, Encoding: Binary},
+	Hello{Versions: []uint16{1}},
+	Welcome{Version: 1, Encoding: JSON, You: "p1"},
+	Error{Message: "no common protocol version"},
+	Ping{Nonce: 1<<63 + 7},
+	Pong{Nonce: 42},
+	Text{From: "p1", Text: "hi"},
+	Text{Text: ""},
+	Move{DX: -1, DY: 1},
+	Move{},
+	Snapshot{Tick: 20, You: "p1", Players: []Player{
+		{ID: "p1", Nick: "Alice", X: 512, Y: 0},
+		{ID: "p2", Nick: "Bob", X: -3, Y: 1023},
+	}},
+	Delta{Tick: 21, Players: []Player{{ID: "p2", Nick: "Bob", X: 1, Y: 2}}, Removed: []string{"p3", "p4"}},
+	Delta{Tick: 22, Removed: []string{"p2"}},
+	Join{Room: "lobby", Before: "m9", Limit: 50},
+	Join{Room: "lobby"},
+	Leave{Room: "lobby"},
+	Say{Room: "lobby", Text: "hello"},
+	testChat,
+	History{Room: "lobby", Messages: []Chat{testChat, testChat}, More: true},
+	History{Room: "empty"},
+}
+
+// inUTC returns p with its times in UTC, JSON keeps the instant but not
+// the location.
+func inUTC(p Payload) Payload {
+	switch v := p.(type) {
+	case Chat:
+		v.Time = v.Time.UTC()
+		return v
+	case History:
+		messages := make([]Chat, len(v.Messages))
+		for i, c := range v.Messages {
+			c.Time = c.Time.UTC()
+			messages[i] = c
+		}
+		if v.Messages == nil {
+			messages = nil
+		}
+		v.Messages = messages
+		return v
+	}
+	return p
+}
+
+func TestPayloadsCoverEveryType(t *testing.T) {
+	seen := make(map[Type]bool)
+	for _, p := range testPayloads {
+		seen[p.Type()] = true
+	}
+	for typ := range typeNames {
+		if !seen[typ] {
+			t.Errorf("no test payload of type %s", typ)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, enc := range []Encoding{JSON, Binary} {
+		for _, p := range testPayloads {
+			t.Run(string(enc)+"/"+p.Type().String(), func(t *testing.T) {
+				m := Message{Seq: 7, Time: testTime, Payload: p}
+
+				b, err := Encode(enc, m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := Decode(enc, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got.Seq != m.Seq || !got.Time.Equal(m.Time) {
+					t.Errorf("envelope: got seq %d time %v, want %d %v", got.Seq, got.Time, m.Seq, m.Time)
+				}
+				if !reflect.DeepEqual(inUTC(got.Payload), inUTC(p)) {
+					t.Errorf("payload:\ngot  %#v\nwant %#v", got.Payload, p)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeWithoutPayload(t *testing.T) {
+	for _, enc := range []Encoding{JSON, Binary} {
+		_, err := Encode(enc, Message{Seq: 1})
+		if err == nil {
+			t.Errorf("%s: encoded a message without payload", enc)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, enc := range []Encoding{JSON, Binary} {
+		for _, p := range testPayloads {
+			b, err := Encode(enc, Message{Seq: 300, Time: testTime, Payload: p})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(b); i++ {
+				_, err := Decode(enc, b[:i])
+				if err == nil {
+					t.Errorf("%s %s: decoded the first %d of %d bytes", enc, p.Type(), i, len(b))
+				}
+			}
+		}
+	}
+}
+
+// binaryHeader returns the type, seq and time of a binary message.
+func binaryHeader(t Type) []byte {
+	b := []byte{byte(t)}
+	b = binary.AppendUvarint(b, 1)
+	return binary.AppendVarint(b, testTime.UnixMilli())
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  Encoding
+		b    []byte
+		want string
+	}{
+		{"json unknown type", JSON, []byte(`{"type":"teleport","seq":1,"time":0,"payload":{}}`), "unknown message type"},
+		{"json empty type", JSON, []byte(`{"seq":1,"time":0}`), "unknown message type"},
+		{"json wrong field type", JSON, []byte(`{"type":"move","seq":1,"time":0,"payload":{"dx":"left"}}`), "move payload"},
+		{"json not an object", JSON, []byte(`[1,2,3]`), ""},
+		{"binary empty", Binary, nil, "truncated"},
+		{"binary zero type", Binary, binaryHeader(0), "unknown message type"},
+		{"binary unknown type", Binary, append(binaryHeader(200), 0), "unknown message type"},
+		{"binary string over the limit", Binary,
+			binary.AppendUvarint(binaryHeader(TypeError), maxStringLength+1), "over the limit"},
+		{"binary string longer than the message", Binary,
+			append(binary.AppendUvarint(binaryHeader(TypeError), 10), "short"...), "truncated"},
+		{"binary list over the limit", Binary,
+			binary.AppendUvarint(binaryHeader(TypeHello), maxListLength+1), "over the limit"},
+		{"binary huge list length", Binary,
+			binary.AppendUvarint(binary.AppendUvarint(binaryHeader(TypeDelta), 1), 1<<62), "over the limit"},
+		{"binary overflowing varint", Binary,
+			append(binaryHeader(TypePing), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), "truncated"},
+		{"binary trailing bytes", Binary,
+			append(binary.AppendUvarint(binaryHeader(TypePing), 9), 0), "trailing bytes"},
+		{"unknown encoding", "xml", []byte("<hello/>"), "unknown encoding"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Decode(tt.enc, tt.b)
+			if err == nil {
+				t.Fatalf("decoded %#v", m)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		client, server []uint16
+		want           uint16
+		ok             bool
+	}{
+		{[]uint16{1}, []uint16{1}, 1, true},
+		{[]uint16{1, 2, 3}, []uint16{2, 1}, 2, true},
+		{[]uint16{3}, []uint16{1, 2}, 0, false},
+		{nil, []uint16{1}, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := Negotiate(tt.client, tt.server)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Negotiate(%v, %v) = %d, %v, want %d, %v", tt.client, tt.server, got, ok, tt.want, tt.ok)
+		}
+	}
+}
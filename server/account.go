@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"realm/model"
+	"realm/oauth"
+	"realm/permission"
+	"realm/session"
+	"realm/store"
+)
+
+// linkCookieName holds the provider of a link started from the account
+// page, its callback links the identity instead of logging in with it.
+const linkCookieName = "forum_link"
+
+// accountMessages are shown on the account page after a link.
+var accountMessages = map[string]string{
+	"linked": "The login was linked to your account.",
+	"merged": "The login had its own account, it was merged into yours.",
+}
+
+// accountHandler lists the identities of the logged in user and the
+// providers that can still be linked.
+func (f *forumServer) accountHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	if !sd.LoggedIn {
+		http.Redirect(w, r, "/forum/login", http.StatusFound)
+		return
+	}
+
+	identityList, err := f.store.GetUserIdentityList(sd.UserID)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	data := struct {
+		page
+		IdentityList []model.UserIdentity
+		Providers    []*oauth.Provider
+		Titles       map[string]string
+		Message      string
+	}{
+		page:         newPage(sd),
+		IdentityList: identityList,
+		Providers:    f.providers.List(),
+		Titles:       make(map[string]string),
+		Message:      accountMessages[r.URL.Query().Get("done")],
+	}
+	for _, p := range data.Providers {
+		data.Titles[p.Name] = p.Title
+	}
+
+	renderTemplate(w, "account.html", data)
+}
+
+// linkHandler starts the OAuth login of the identity to link.
+func (f *forumServer) linkHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	p, ok := f.providers.Get(r.PostForm.Get("provider"))
+	if !ok {
+		renderError(w, sd, http.StatusNotFound, "unknown login provider")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/forum",
+		Name:     linkCookieName,
+		Value:    p.Name,
+		MaxAge:   10 * 60,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, "/forum/oauth/"+p.Name+"/login", http.StatusSeeOther)
+}
+
+// unlinkHandler removes an identity from the logged in user.
+func (f *forumServer) unlinkHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	err := f.store.UnlinkUserIdentity(sd.UserID, r.PostForm.Get("provider"), r.PostForm.Get("oauth_user_id"))
+	switch {
+	case errors.Is(err, store.ErrLastIdentity):
+		renderError(w, sd, http.StatusBadRequest, "you cannot unlink your only login")
+		return
+	case errors.Is(err, store.ErrNotFound):
+		renderError(w, sd, http.StatusNotFound, "identity not found")
+		return
+	case err != nil:
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/forum/account", http.StatusSeeOther)
+}
+
+// sessionsHandler lists the devices logged in to the account of the
+// session user.
+func (f *forumServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sid, sd := f.currentSession(w, r)
+
+	if !sd.LoggedIn {
+		http.Redirect(w, r, "/forum/login", http.StatusFound)
+		return
+	}
+
+	devices, err := f.sessions.Devices(sd.UserID, sid)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	data := struct {
+		page
+		Devices []session.Device
+	}{
+		page:    newPage(sd),
+		Devices: devices,
+	}
+
+	renderTemplate(w, "sessions.html", data)
+}
+
+// revokeHandler logs out another device of the session user.
+func (f *forumServer) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := f.sessions.Revoke(sd.UserID, r.PostForm.Get("session"))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		renderError(w, sd, http.StatusNotFound, "session not found")
+		return
+	case err != nil:
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+	f.conns.CloseSession(id)
+
+	http.Redirect(w, r, "/forum/account/sessions", http.StatusSeeOther)
+}
+
+// reloadSessions ends the sessions deleted from the database behind the
+// server, by the admin command, and closes their websockets.
+func (f *forumServer) reloadSessions() {
+	f.sessions.Reload()
+	f.conns.CloseEnded()
+}
+
+// tokenHandler shows a connection token for the game client, which
+// cannot send the session cookie.
+func (f *forumServer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	sid, sd := f.currentSession(w, r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderError(w, sd, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	if !sd.LoggedIn {
+		renderError(w, sd, http.StatusUnauthorized, "you must be logged in")
+		return
+	}
+
+	token, expireAt := f.sessions.Token(sid, sd)
+
+	data := struct {
+		page
+		Token    string
+		ExpireAt time.Time
+	}{
+		page:     newPage(sd),
+		Token:    token,
+		ExpireAt: expireAt,
+	}
+
+	renderTemplate(w, "token.html", data)
+}
+
+// postSession returns the session of a POST from a logged in user and
+// parses the form, writing an error page otherwise.
+func (f *forumServer) postSession(w http.ResponseWriter, r *http.Request) (*model.SessionData, bool) {
+	_, sd := f.currentSession(w, r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderError(w, sd, http.StatusMethodNotAllowed, "")
+		return nil, false
+	}
+
+	if !sd.LoggedIn {
+		renderError(w, sd, http.StatusUnauthorized, "you must be logged in")
+		return nil, false
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		renderError(w, sd, http.StatusBadRequest, "invalid form")
+		return nil, false
+	}
+
+	return sd, true
+}
+
+// linkRequested reports whether the OAuth callback of p finishes a link
+// started by linkHandler, and clears the link cookie.
+func linkRequested(w http.ResponseWriter, r *http.Request, p *oauth.Provider) bool {
+	cookie, err := r.Cookie(linkCookieName)
+	if err != nil {
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Path:   "/forum",
+		Name:   linkCookieName,
+		MaxAge: -1,
+	})
+
+	return cookie.Value == p.Name
+}
+
+// mergeRefused returns why user may not merge other into its account, or
+// an empty string. The merge drops the role of other, so it must not lift
+// a ban or demote a user that outranks user.
+func mergeRefused(user, other *model.User, now time.Time) string {
+	role, otherRole := user.RoleAt(now), other.RoleAt(now)
+	if otherRole == model.RoleBanned {
+		return "the login belongs to a banned account"
+	}
+	if otherRole != role && permission.Outranks(otherRole, role) {
+		return "the login belongs to an account with a higher role"
+	}
+	return ""
+}
+
+// linkIdentity links the profile to the logged in user. An identity that
+// already has an account proves the user owns both, so that account is
+// merged into this one.
+func (f *forumServer) linkIdentity(w http.ResponseWriter, r *http.Request, sd *model.SessionData, p *oauth.Provider, profile oauth.Profile) {
+	identity := model.UserIdentity{
+		OAuthProvider: p.Name,
+		OAuthUserID:   profile.ID,
+		UserID:        sd.UserID,
+		UserName:      profile.Name,
+	}
+
+	done := "linked"
+
+	err := f.store.LinkUserIdentity(&identity)
+	if errors.Is(err, store.ErrIdentityLinked) {
+		var user, other *model.User
+		user, err = f.store.GetUser(sd.UserID)
+		if err == nil {
+			other, err = f.store.GetUserFromOAuthID(p.Name, profile.ID)
+		}
+		if err == nil {
+			reason := mergeRefused(user, other, time.Now())
+			if reason != "" {
+				renderError(w, sd, http.StatusForbidden, reason)
+				return
+			}
+			err = f.store.MergeUsers(sd.UserID, other.ID)
+		}
+		if err == nil {
+			log.Println("merged user", other.ID, "into", sd.UserID)
+			f.audit(sd, "merge_user", "user", other.ID, other.UserName+" into "+user.UserName)
+			f.sessions.RemoveUser(other.ID)
+			f.conns.CloseUser(other.ID)
+			done = "merged"
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/forum/account?done="+done, http.StatusFound)
+}
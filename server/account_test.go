@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"realm/model"
+	"realm/protocol"
+	"realm/session"
+
+	"nhooyr.io/websocket"
+)
+
+func TestMergeRefused(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		user, other model.User
+		refused     bool
+	}{
+		{"members", model.User{Role: model.RoleMember}, model.User{Role: model.RoleMember}, false},
+		{"admins", model.User{Role: model.RoleAdmin}, model.User{Role: model.RoleAdmin}, false},
+		{"admin takes member", model.User{Role: model.RoleAdmin}, model.User{Role: model.RoleMember}, false},
+		{"member takes admin", model.User{Role: model.RoleMember}, model.User{Role: model.RoleAdmin}, true},
+		{"member takes moderator", model.User{Role: model.RoleMember}, model.User{Role: model.RoleModerator}, true},
+		{"banned takes member", model.User{Role: model.RoleBanned}, model.User{Role: model.RoleMember}, false},
+		{"member takes banned", model.User{Role: model.RoleMember}, model.User{Role: model.RoleBanned}, true},
+		{"member takes banned until later", model.User{Role: model.RoleMember}, model.User{Role: model.RoleBanned, BannedUntil: &future}, true},
+		{"member takes ban that ended", model.User{Role: model.RoleMember}, model.User{Role: model.RoleBanned, BannedUntil: &past}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := mergeRefused(&tt.user, &tt.other, now)
+			if (reason != "") != tt.refused {
+				t.Errorf("mergeRefused = %q, want refused %v", reason, tt.refused)
+			}
+		})
+	}
+}
+
+// connectWebsocket opens a websocket to f with cookie and completes the
+// handshake.
+func connectWebsocket(ctx context.Context, t *testing.T, f *forumServer, cookie *http.Cookie) *websocket.Conn {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(f.conns.Websocket))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{
+		HTTPHeader: http.Header{"Cookie": {cookie.String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+
+	hello, err := protocol.Encode(protocol.JSON, protocol.Message{
+		Seq:     1,
+		Time:    time.Now(),
+		Payload: protocol.Hello{Versions: protocol.SupportedVersions, Encoding: protocol.JSON},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Write(ctx, websocket.MessageText, hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.Read(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// wantClosed reads conn until the server closes it for the ended session.
+func wantClosed(ctx context.Context, t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	for {
+		_, _, err := conn.Read(ctx)
+		if err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+				t.Errorf("read %v, want the connection closed", err)
+			}
+			return
+		}
+	}
+}
+
+func TestRevokeClosesWebsocket(t *testing.T) {
+	f := newTestServer(t)
+	cookie, sd := login(t, f, "alice")
+	phoneCookie, _ := login(t, f, "alice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectWebsocket(ctx, t, f, phoneCookie)
+
+	phone := httptest.NewRequest(http.MethodGet, "/forum/", nil)
+	phone.AddCookie(phoneCookie)
+	phoneID, _, _ := f.sessions.Get(phone)
+
+	form := url.Values{"session": {session.Handle(phoneID)}, "csrf_token": {sd.CSRFToken}}
+	r := httptest.NewRequest(http.MethodPost, "/forum/account/sessions/revoke", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	f.csrfProtect(f.revokeHandler)(rec, r)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	wantClosed(ctx, t, conn)
+}
+
+func TestAdminRevoke(t *testing.T) {
+	f := newTestServer(t)
+	cookie, _ := login(t, f, "alice")
+	otherCookie, _ := login(t, f, "alice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := connectWebsocket(ctx, t, f, cookie)
+	otherConn := connectWebsocket(ctx, t, f, otherCookie)
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/", nil)
+	r.AddCookie(cookie)
+	id, _, ok := f.sessions.Get(r)
+	if !ok {
+		t.Fatal("no session")
+	}
+
+	// the admin command runs in another process, on the database only
+	a := &adminCLI{store: f.store, out: io.Discard}
+	if err := a.sessionRevoke([]string{id}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reloadSessions()
+
+	if _, _, ok := f.sessions.Get(r); ok {
+		t.Error("revoked session still valid after the reload")
+	}
+	wantClosed(ctx, t, conn)
+
+	// the other session of the user is left alone
+	r = httptest.NewRequest(http.MethodGet, "/forum/", nil)
+	r.AddCookie(otherCookie)
+	if _, sd, ok := f.sessions.Get(r); !ok || !sd.LoggedIn {
+		t.Error("other session ended by the reload")
+	}
+	ping, err := protocol.Encode(protocol.JSON, protocol.Message{Seq: 2, Time: time.Now(), Payload: protocol.Ping{Nonce: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := otherConn.Write(ctx, websocket.MessageText, ping); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, b, err := otherConn.Read(ctx)
+		if err != nil {
+			t.Fatalf("other connection: %v", err)
+		}
+		m, err := protocol.Decode(protocol.JSON, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.Payload.(protocol.Pong); ok {
+			break
+		}
+	}
+}
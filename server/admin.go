@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"realm/globalconst"
+	"realm/model"
+	"realm/store"
+)
+
+const adminUsage = `usage: realm-server admin [-json] COMMAND
+
+  forum create [FLAGS] NAME  create a forum, flags: -description TEXT
+                             -order N -category SLUG
+  forum update [FLAGS] SLUG  change a forum, flags: -name NAME and the
+                             create flags, -archived=true|false
+  forum list                 list the forums
+  forum delete SLUG          delete a forum without threads
+  category create [-order N] NAME
+                             create a category
+  category update [-name NAME] [-order N] SLUG
+                             change a category
+  category list              list the categories
+  category delete SLUG       delete a category, its forums are left
+                             without one
+  chatroom create NAME       create a chat room
+  chatroom list              list the chat rooms
+  chatroom delete SLUG       delete a chat room
+  user list [ROLE]           list the users, or those with a role
+  user promote ID ROLE       set the role of a user: admin, moderator or member
+  user ban ID [DAYS]         ban a user for DAYS days, forever when omitted
+  session list               list the sessions that did not expire
+  session revoke ID          delete a session
+
+A running server reads the sessions from the database again every
+minute, a revoked session can be used there until then.`
+
+// adminCLI runs the admin subcommands on a store, writing the results to
+// out as text or JSON.
+type adminCLI struct {
+	store store.Store
+	out   io.Writer
+	json  bool
+}
+
+// runAdmin implements the "admin" subcommand.
+func runAdmin(db store.Store, args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), adminUsage) }
+	jsonOutput := fs.Bool("json", false, "write JSON")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	a := &adminCLI{store: db, out: os.Stdout, json: *jsonOutput}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		fs.Usage()
+		return errors.New("missing admin command")
+	}
+
+	cmd, args := args[0]+" "+args[1], args[2:]
+	switch cmd {
+	case "forum create":
+		return a.forumCreate(args)
+	case "forum update":
+		return a.forumUpdate(args)
+	case "forum list":
+		return a.forumList(args)
+	case "forum delete":
+		return a.forumDelete(args)
+	case "category create":
+		return a.categoryCreate(args)
+	case "category update":
+		return a.categoryUpdate(args)
+	case "category list":
+		return a.categoryList(args)
+	case "category delete":
+		return a.categoryDelete(args)
+	case "chatroom create":
+		return a.chatRoomCreate(args)
+	case "chatroom list":
+		return a.chatRoomList(args)
+	case "chatroom delete":
+		return a.chatRoomDelete(args)
+	case "user list":
+		return a.userList(args)
+	case "user promote":
+		return a.userPromote(args)
+	case "user ban":
+		return a.userBan(args)
+	case "session list":
+		return a.sessionList(args)
+	case "session revoke":
+		return a.sessionRevoke(args)
+	}
+
+	fs.Usage()
+	return fmt.Errorf("unknown admin command %q", cmd)
+}
+
+// wantArgs returns an error unless args has between min and max items.
+func wantArgs(args []string, min, max int, usage string) error {
+	if len(args) < min || len(args) > max {
+		return errors.New("usage: realm-server admin " + usage)
+	}
+	return nil
+}
+
+// print writes v as JSON, or calls text to write it for people.
+func (a *adminCLI) print(v any, text func(w io.Writer)) error {
+	if a.json {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+// done reports a change that has no other output.
+func (a *adminCLI) done(action, id string) error {
+	return a.print(map[string]string{"action": action, "id": id}, func(w io.Writer) {
+		fmt.Fprintln(w, action, id)
+	})
+}
+
+// forumFlags are the flags of forum create and forum update.
+func forumFlags(name string, forum *model.Forum) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&forum.Description, "description", forum.Description, "forum description")
+	fs.IntVar(&forum.SortOrder, "order", forum.SortOrder, "display order on the index, lower first")
+	fs.StringVar(&forum.CategorySlug, "category", forum.CategorySlug, "parent category slug")
+	return fs
+}
+
+func (a *adminCLI) forumCreate(args []string) error {
+	var forum model.Forum
+	fs := forumFlags("forum create", &forum)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	args = fs.Args()
+	err = wantArgs(args, 1, 1, "forum create [FLAGS] NAME")
+	if err != nil {
+		return err
+	}
+
+	forum.Name = strings.TrimSpace(args[0])
+	if forum.Name == "" {
+		return errors.New("the forum name is empty")
+	}
+
+	err = a.checkCategory(forum.CategorySlug)
+	if err != nil {
+		return err
+	}
+
+	err = a.store.CreateForum(&forum)
+	if err != nil {
+		return err
+	}
+
+	return a.print(forum, func(w io.Writer) {
+		fmt.Fprintf(w, "created forum %s\t%s\n", forum.NameSlug, forum.Name)
+	})
+}
+
+func (a *adminCLI) forumUpdate(args []string) error {
+	// read the slug first so the flags start from the saved values
+	if len(args) == 0 {
+		return errors.New("usage: realm-server admin forum update [FLAGS] SLUG")
+	}
+
+	forum, err := a.store.GetForum(args[len(args)-1])
+	if err != nil {
+		return notFound(err, "forum", args[len(args)-1])
+	}
+
+	fs := forumFlags("forum update", forum)
+	fs.StringVar(&forum.Name, "name", forum.Name, "forum name, the slug does not change")
+	fs.BoolVar(&forum.Archived, "archived", forum.Archived, "archived forums are read only")
+	err = fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = wantArgs(fs.Args(), 1, 1, "forum update [FLAGS] SLUG")
+	if err != nil {
+		return err
+	}
+
+	forum.Name = strings.TrimSpace(forum.Name)
+	if forum.Name == "" {
+		return errors.New("the forum name is empty")
+	}
+
+	err = a.checkCategory(forum.CategorySlug)
+	if err != nil {
+		return err
+	}
+
+	err = a.store.UpdateForum(forum)
+	if err != nil {
+		return err
+	}
+
+	return a.print(forum, func(w io.Writer) {
+		fmt.Fprintf(w, "updated forum %s\t%s\n", forum.NameSlug, forum.Name)
+	})
+}
+
+func (a *adminCLI) forumList(args []string) error {
+	err := wantArgs(args, 0, 0, "forum list")
+	if err != nil {
+		return err
+	}
+
+	forumList, err := a.store.GetForumList()
+	if err != nil {
+		return err
+	}
+
+	return a.print(forumList, func(w io.Writer) {
+		fmt.Fprintln(w, "SLUG\tNAME\tORDER\tCATEGORY\tARCHIVED\tDESCRIPTION")
+		for _, f := range forumList {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%t\t%s\n", f.NameSlug, f.Name, f.SortOrder, f.CategorySlug, f.Archived, f.Description)
+		}
+	})
+}
+
+func (a *adminCLI) forumDelete(args []string) error {
+	err := wantArgs(args, 1, 1, "forum delete SLUG")
+	if err != nil {
+		return err
+	}
+
+	forum, err := a.store.GetForum(args[0])
+	if err != nil {
+		return notFound(err, "forum", args[0])
+	}
+
+	threadList, err := a.store.GetThreadList(forum.NameSlug)
+	if err != nil {
+		return err
+	}
+	if len(threadList) > 0 {
+		return fmt.Errorf("forum %s has %d threads, move or delete them first", forum.NameSlug, len(threadList))
+	}
+
+	err = a.store.DeleteForum(forum.NameSlug)
+	if err != nil {
+		return err
+	}
+
+	return a.done("deleted forum", forum.NameSlug)
+}
+
+// checkCategory returns an error unless slug is empty or names a category.
+func (a *adminCLI) checkCategory(slug string) error {
+	if slug == "" {
+		return nil
+	}
+
+	_, err := a.store.GetCategory(slug)
+
+	return notFound(err, "category", slug)
+}
+
+func (a *adminCLI) categoryCreate(args []string) error {
+	var category model.Category
+	fs := flag.NewFlagSet("category create", flag.ContinueOnError)
+	fs.IntVar(&category.SortOrder, "order", 0, "display order on the index, lower first")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	args = fs.Args()
+	err = wantArgs(args, 1, 1, "category create [-order N] NAME")
+	if err != nil {
+		return err
+	}
+
+	category.Name = strings.TrimSpace(args[0])
+	if category.Name == "" {
+		return errors.New("the category name is empty")
+	}
+
+	err = a.store.CreateCategory(&category)
+	if err != nil {
+		return err
+	}
+
+	return a.print(category, func(w io.Writer) {
+		fmt.Fprintf(w, "created category %s\t%s\n", category.NameSlug, category.Name)
+	})
+}
+
+func (a *adminCLI) categoryUpdate(args []string) error {
+	// read the slug first so the flags start from the saved values
+	if len(args) == 0 {
+		return errors.New("usage: realm-server admin category update [-name NAME] [-order N] SLUG")
+	}
+
+	category, err := a.store.GetCategory(args[len(args)-1])
+	if err != nil {
+		return notFound(err, "category", args[len(args)-1])
+	}
+
+	fs := flag.NewFlagSet("category update", flag.ContinueOnError)
+	fs.StringVar(&category.Name, "name", category.Name, "category name, the slug does not change")
+	fs.IntVar(&category.SortOrder, "order", category.SortOrder, "display order on the index, lower first")
+	err = fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = wantArgs(fs.Args(), 1, 1, "category update [-name NAME] [-order N] SLUG")
+	if err != nil {
+		return err
+	}
+
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		return errors.New("the category name is empty")
+	}
+
+	err = a.store.UpdateCategory(category)
+	if err != nil {
+		return err
+	}
+
+	return a.print(category, func(w io.Writer) {
+		fmt.Fprintf(w, "updated category %s\t%s\n", category.NameSlug, category.Name)
+	})
+}
+
+func (a *adminCLI) categoryList(args []string) error {
+	err := wantArgs(args, 0, 0, "category list")
+	if err != nil {
+		return err
+	}
+
+	categoryList, err := a.store.GetCategoryList()
+	if err != nil {
+		return err
+	}
+
+	return a.print(categoryList, func(w io.Writer) {
+		fmt.Fprintln(w, "SLUG\tNAME\tORDER")
+		for _, c := range categoryList {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", c.NameSlug, c.Name, c.SortOrder)
+		}
+	})
+}
+
+func (a *adminCLI) categoryDelete(args []string) error {
+	err := wantArgs(args, 1, 1, "category delete SLUG")
+	if err != nil {
+		return err
+	}
+
+	category, err := a.store.GetCategory(args[0])
+	if err != nil {
+		return notFound(err, "category", args[0])
+	}
+
+	err = a.store.DeleteCategory(category.NameSlug)
+	if err != nil {
+		return err
+	}
+
+	return a.done("deleted category", category.NameSlug)
+}
+
+func (a *adminCLI) chatRoomCreate(args []string) error {
+	err := wantArgs(args, 1, 1, "chatroom create NAME")
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSpace(args[0])
+	if name == "" {
+		return errors.New("the chat room name is empty")
+	}
+
+	created := model.ChatRoom{Name: name}
+	err = a.store.CreateChatRoom(&created)
+	if err != nil {
+		return err
+	}
+
+	// read it back for the times set by the database
+	room, err := a.store.GetChatRoom(created.NameSlug)
+	if err != nil {
+		return err
+	}
+
+	return a.print(room, func(w io.Writer) {
+		fmt.Fprintf(w, "created chat room %s\t%s\n", room.NameSlug, room.Name)
+	})
+}
+
+func (a *adminCLI) chatRoomList(args []string) error {
+	err := wantArgs(args, 0, 0, "chatroom list")
+	if err != nil {
+		return err
+	}
+
+	roomList, err := a.store.GetChatRoomList()
+	if err != nil {
+		return err
+	}
+	sort.Slice(roomList, func(i, j int) bool {
+		return roomList[i].NameSlug < roomList[j].NameSlug
+	})
+
+	return a.print(roomList, func(w io.Writer) {
+		fmt.Fprintln(w, "SLUG\tNAME\tCREATED")
+		for _, r := range roomList {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.NameSlug, r.Name, r.CreatedAt.Format("2006-01-02 15:04"))
+		}
+	})
+}
+
+func (a *adminCLI) chatRoomDelete(args []string) error {
+	err := wantArgs(args, 1, 1, "chatroom delete SLUG")
+	if err != nil {
+		return err
+	}
+
+	room, err := a.store.GetChatRoom(args[0])
+	if err != nil {
+		return notFound(err, "chat room", args[0])
+	}
+
+	err = a.store.DeleteChatRoom(room.NameSlug)
+	if err != nil {
+		return err
+	}
+
+	return a.done("deleted chat room", room.NameSlug)
+}
+
+func (a *adminCLI) userList(args []string) error {
+	err := wantArgs(args, 0, 1, "user list [ROLE]")
+	if err != nil {
+		return err
+	}
+
+	var role model.Role
+	if len(args) == 1 {
+		role = model.Role(args[0])
+		if !role.Valid() {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+
+	userList, err := a.store.GetUserList(role)
+	if err != nil {
+		return err
+	}
+
+	return a.print(userList, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tNAME\tROLE\tLOGIN")
+		for _, u := range userList {
+			r := string(u.Role)
+			if u.BannedUntil != nil {
+				r += " until " + u.BannedUntil.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s:%s\n", u.ID, u.UserName, r, u.OAuthProvider, u.OAuthUserID)
+		}
+	})
+}
+
+func (a *adminCLI) userPromote(args []string) error {
+	err := wantArgs(args, 2, 2, "user promote ID ROLE")
+	if err != nil {
+		return err
+	}
+
+	role := model.Role(args[1])
+	if !role.Valid() || role == model.RoleBanned {
+		return fmt.Errorf("invalid role %q, use user ban to ban", role)
+	}
+
+	err = a.store.SetUserRole(args[0], role)
+	if err != nil {
+		return notFound(err, "user", args[0])
+	}
+
+	a.audit("set_role", args[0], string(role))
+
+	return a.printUser(args[0])
+}
+
+func (a *adminCLI) userBan(args []string) error {
+	err := wantArgs(args, 1, 2, "user ban ID [DAYS]")
+	if err != nil {
+		return err
+	}
+
+	var until time.Time
+	detail := "permanent"
+	if len(args) == 2 {
+		days, err := strconv.Atoi(args[1])
+		if err != nil || days <= 0 {
+			return fmt.Errorf("invalid number of days %q", args[1])
+		}
+		if days > globalconst.MaxBanDays {
+			return fmt.Errorf("a ban lasts at most %d days, omit DAYS for a permanent ban", globalconst.MaxBanDays)
+		}
+		until = time.Now().AddDate(0, 0, days)
+		detail = "until " + until.UTC().Format("2006-01-02 15:04")
+	}
+
+	err = a.store.BanUser(args[0], until)
+	if err != nil {
+		return notFound(err, "user", args[0])
+	}
+
+	a.audit("ban_user", args[0], detail)
+
+	return a.printUser(args[0])
+}
+
+// audit records a user change made from the command line, which has no
+// moderator user.
+func (a *adminCLI) audit(action, userID, detail string) {
+	err := a.store.CreateAuditLog(&model.AuditLog{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   userID,
+		Detail:     detail + " (admin command)",
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "audit log:", err)
+	}
+}
+
+func (a *adminCLI) printUser(id string) error {
+	user, err := a.store.GetUser(id)
+	if err != nil {
+		return err
+	}
+
+	return a.print(user, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", user.ID, user.UserName, user.Role)
+	})
+}
+
+func (a *adminCLI) sessionList(args []string) error {
+	err := wantArgs(args, 0, 0, "session list")
+	if err != nil {
+		return err
+	}
+
+	sessions, err := a.store.LoadAllSessions()
+	if err != nil {
+		return err
+	}
+
+	sessionList := make([]model.SessionData, 0, len(sessions))
+	for id, sd := range sessions {
+		sd.SessionID = id
+		sessionList = append(sessionList, sd)
+	}
+	sort.Slice(sessionList, func(i, j int) bool {
+		return sessionList[i].ExpireAt.Before(sessionList[j].ExpireAt)
+	})
+
+	return a.print(sessionList, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tUSER\tNAME\tEXPIRES\tLAST SEEN\tIP")
+		for _, sd := range sessionList {
+			user := sd.UserID
+			if !sd.LoggedIn {
+				user = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", sd.SessionID, user, sd.UserName,
+				sd.ExpireAt.Format("2006-01-02 15:04"), sd.LastSeenAt.Format("2006-01-02 15:04"), sd.IP)
+		}
+	})
+}
+
+func (a *adminCLI) sessionRevoke(args []string) error {
+	err := wantArgs(args, 1, 1, "session revoke ID")
+	if err != nil {
+		return err
+	}
+
+	_, err = a.store.GetSession(args[0])
+	if err != nil {
+		return notFound(err, "session", args[0])
+	}
+
+	err = a.store.DeleteSession(args[0])
+	if err != nil {
+		return err
+	}
+
+	return a.done("revoked session", args[0])
+}
+
+// notFound names the missing item when err is store.ErrNotFound.
+func notFound(err error, kind, id string) error {
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("%s %q not found", kind, id)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"realm/globalconst"
+	"realm/model"
+)
+
+// csrfProtect rejects POST, PUT, PATCH and DELETE requests whose
+// csrf_token form field or X-CSRF-Token header does not match the token
+// stored in the session.
+func (f *forumServer) csrfProtect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next(w, r)
+			return
+		}
+
+		_, sd, ok := f.sessions.Get(r)
+		if !ok {
+			sd = &model.SessionData{}
+		}
+
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" {
+			r.Body = http.MaxBytesReader(w, r.Body, 4*globalconst.MaxContentLength)
+			err := r.ParseForm()
+			if err != nil {
+				renderError(w, sd, http.StatusBadRequest, "invalid form")
+				return
+			}
+			token = r.PostForm.Get("csrf_token")
+		}
+
+		if !validCSRFToken(sd.CSRFToken, token) {
+			renderError(w, sd, http.StatusForbidden,
+				"invalid or missing CSRF token, reload the page and try again")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func validCSRFToken(expected, token string) bool {
+	if expected == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
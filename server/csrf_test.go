@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"realm/model"
+	"realm/oauth"
+)
+
+// anonymousSession returns the cookie and data of the session a visitor
+// gets on the first page.
+func anonymousSession(t *testing.T, f *forumServer) (*http.Cookie, *model.SessionData) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	f.currentSession(rec, httptest.NewRequest(http.MethodGet, "/forum/", nil))
+
+	return sessionCookie(t, rec), sessionOf(t, f, sessionCookie(t, rec))
+}
+
+// sessionOf returns the session data of a cookie.
+func sessionOf(t *testing.T, f *forumServer, cookie *http.Cookie) *model.SessionData {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/", nil)
+	r.AddCookie(cookie)
+	_, sd, ok := f.sessions.Get(r)
+	if !ok {
+		t.Fatal("session not found")
+	}
+	return sd
+}
+
+func TestIssueSessionRotatesCSRFToken(t *testing.T) {
+	f := newTestServer(t)
+	before, anonymous := anonymousSession(t, f)
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/oauth/github/callback", nil)
+	r.AddCookie(before)
+	rec := httptest.NewRecorder()
+	f.issueSession(rec, r, &oauth.Provider{Name: "github"}, oauth.Profile{ID: "1", Name: "alice"})
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusFound)
+	}
+	after := sessionCookie(t, rec)
+	if after.Value == before.Value {
+		t.Error("the session id did not change on login")
+	}
+
+	sd := sessionOf(t, f, after)
+	if !sd.LoggedIn || sd.UserName != "alice" {
+		t.Errorf("session after login = %+v", sd)
+	}
+	if sd.CSRFToken == "" || sd.CSRFToken == anonymous.CSRFToken {
+		t.Errorf("CSRF token %q after login, %q before", sd.CSRFToken, anonymous.CSRFToken)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/forum/", nil)
+	r.AddCookie(before)
+	if _, _, ok := f.sessions.Get(r); ok {
+		t.Error("the session from before the login still exists")
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	f := newTestServer(t)
+	anonymousCookie, anonymous := anonymousSession(t, f)
+	cookie, sd := login(t, f, "alice")
+
+	tests := []struct {
+		name   string
+		method string
+		cookie *http.Cookie
+		form   string // csrf_token form field
+		header string // X-CSRF-Token header
+		want   int
+	}{
+		{"get needs no token", http.MethodGet, cookie, "", "", http.StatusOK},
+		{"form token", http.MethodPost, cookie, sd.CSRFToken, "", http.StatusOK},
+		{"header token", http.MethodPost, cookie, "", sd.CSRFToken, http.StatusOK},
+		{"anonymous session token", http.MethodPost, anonymousCookie, anonymous.CSRFToken, "", http.StatusOK},
+		{"missing token", http.MethodPost, cookie, "", "", http.StatusForbidden},
+		{"wrong token", http.MethodPost, cookie, "forged", "", http.StatusForbidden},
+		{"token of another session", http.MethodPost, cookie, anonymous.CSRFToken, "", http.StatusForbidden},
+		{"no session", http.MethodPost, nil, sd.CSRFToken, "", http.StatusForbidden},
+		{"delete without token", http.MethodDelete, cookie, "", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.form != "" {
+				form.Set("csrf_token", tt.form)
+			}
+			r := httptest.NewRequest(tt.method, "/forum/post", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				r.Header.Set("X-CSRF-Token", tt.header)
+			}
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+
+			rec := httptest.NewRecorder()
+			f.csrfProtect(func(w http.ResponseWriter, r *http.Request) {})(rec, r)
+
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFTokenStaleAfterLogin(t *testing.T) {
+	f := newTestServer(t)
+	before, anonymous := anonymousSession(t, f)
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/oauth/github/callback", nil)
+	r.AddCookie(before)
+	rec := httptest.NewRecorder()
+	f.issueSession(rec, r, &oauth.Provider{Name: "github"}, oauth.Profile{ID: "1", Name: "alice"})
+	after := sessionCookie(t, rec)
+
+	// a form rendered before the login posts the token of that page
+	form := url.Values{"csrf_token": {anonymous.CSRFToken}}
+	r = httptest.NewRequest(http.MethodPost, "/forum/logout", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(after)
+	rec = httptest.NewRecorder()
+	f.csrfProtect(f.logoutHandler)(rec, r)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if !sessionOf(t, f, after).LoggedIn {
+		t.Error("logged out with a stale token")
+	}
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"realm/globalconst"
+	"realm/handler"
+	"realm/markdown"
+	"realm/model"
+	"realm/oauth"
+	"realm/permission"
+	"realm/session"
+	"realm/store"
+	"realm/util"
+)
+
+// forumServer holds what the forum handlers need, its methods are the HTTP
+// handlers.
+type forumServer struct {
+	store     store.Store
+	sessions  *session.Control
+	providers *oauth.Registry
+	perms     *permission.Checker
+	// conns serves the websockets, which end with their session
+	conns *handler.Handler
+}
+
+// page holds the data shared by every forum template.
+type page struct {
+	SessionData *model.SessionData
+	CSRFToken   string
+	LoginURL    string
+	LogoutURL   string
+}
+
+// currentSession returns the request session, creating an anonymous one
+// if needed, and renews its cookie.
+func (f *forumServer) currentSession(w http.ResponseWriter, r *http.Request) (string, *model.SessionData) {
+	sid, sd, ok := f.sessions.Get(r)
+	if !ok {
+		sid, sd = f.sessions.Create()
+	}
+
+	// sessions saved before csrf tokens existed
+	if sd.CSRFToken == "" {
+		sd.CSRFToken = util.RandomID()
+	}
+
+	// renew session
+	f.sessions.Save(w, r, sid, sd)
+
+	return sid, sd
+}
+
+func newPage(sd *model.SessionData) page {
+	return page{
+		SessionData: sd,
+		CSRFToken:   sd.CSRFToken,
+		LoginURL:    "/forum/login",
+		LogoutURL:   "/forum/logout",
+	}
+}
+
+var markdownCache = markdown.NewCache(1000)
+
+// renderMarkdown renders post content.
+func renderMarkdown(src string) template.HTML {
+	return template.HTML(markdownCache.Render(src))
+}
+
+// renderSnippet escapes a search snippet and marks the matched terms.
+func renderSnippet(snippet string) template.HTML {
+	return template.HTML(strings.NewReplacer(
+		store.HighlightStart, "<mark>",
+		store.HighlightEnd, "</mark>",
+	).Replace(template.HTMLEscapeString(snippet)))
+}
+
+var templateFuncs = template.FuncMap{
+	"markdown": renderMarkdown,
+	"snippet":  renderSnippet,
+	"banForm":  newBanForm,
+}
+
+// renderTemplate parses the named template from the embedded assets
+// together with the shared menu and page links and writes it to w.
+func renderTemplate(w http.ResponseWriter, name string, data any) {
+	t, err := template.New(name).Funcs(templateFuncs).ParseFS(assets, "assets/"+name, "assets/menu.html", "assets/pages.html")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = t.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// renderError writes an error page with the given status code.
+func renderError(w http.ResponseWriter, sd *model.SessionData, status int, message string) {
+	data := struct {
+		page
+		Status     int
+		StatusText string
+		Message    string
+	}{
+		page:       newPage(sd),
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+	}
+
+	w.WriteHeader(status)
+	renderTemplate(w, "error.html", data)
+}
+
+// pageFromQuery reads the keyset cursors of a paginated page, limit is
+// the page size plus one, the extra item tells if there is a next page.
+func pageFromQuery(r *http.Request, size int) store.Page {
+	q := r.URL.Query()
+	page := store.Page{Limit: size + 1}
+	if before := q.Get("before"); before != "" {
+		page.Before = before
+		return page
+	}
+	page.After = q.Get("after")
+	return page
+}
+
+// pageLinks holds the query strings of the pages around the current
+// one, empty when there is no such page.
+type pageLinks struct {
+	Prev string
+	Next string
+}
+
+// paginate drops the extra item fetched by pageFromQuery and returns the
+// links to the neighbour pages, keep holds parameters the links retain.
+func paginate[T any](list []T, page store.Page, id func(T) string, keep url.Values) ([]T, pageLinks) {
+	size := page.Limit - 1
+	more := len(list) > size
+
+	hasPrev, hasNext := page.After != "", more
+	if page.Before != "" {
+		hasPrev, hasNext = more, true
+		if more {
+			list = list[len(list)-size:]
+		}
+	} else if more {
+		list = list[:size]
+	}
+
+	var links pageLinks
+	if len(list) == 0 {
+		return list, links
+	}
+
+	link := func(key, cursor string) string {
+		q := url.Values{}
+		for k, v := range keep {
+			q[k] = v
+		}
+		q.Set(key, cursor)
+		return "?" + q.Encode()
+	}
+	if hasPrev {
+		links.Prev = link("before", id(list[0]))
+	}
+	if hasNext {
+		links.Next = link("after", id(list[len(list)-1]))
+	}
+
+	return list, links
+}
+
+func (f *forumServer) threadListHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	forum, err := f.store.GetForum(r.PathValue("slug"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "forum not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	sort := store.ThreadSort(r.URL.Query().Get("sort"))
+	if !sort.Valid() {
+		sort = store.SortActivity
+	}
+
+	pg := pageFromQuery(r, globalconst.ThreadsPerPage)
+	tl, err := f.store.GetThreadViewPage(forum.NameSlug, sort, pg)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	keep := url.Values{}
+	if sort != store.SortActivity {
+		keep.Set("sort", string(sort))
+	}
+	tl, links := paginate(tl, pg, func(t model.ThreadView) string { return t.ID }, keep)
+
+	// pinned threads are on top of the first page
+	var pinned []model.ThreadView
+	if pg.After == "" && pg.Before == "" {
+		pinned, err = f.store.GetPinnedThreadViewList(forum.NameSlug)
+		if err != nil {
+			log.Println(err)
+			renderError(w, sd, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	data := struct {
+		page
+		Forum      *model.Forum
+		Pinned     []model.ThreadView
+		ThreadList []model.ThreadView
+		Sort       store.ThreadSort
+		Pages      pageLinks
+		CanPost    bool
+	}{
+		page:       newPage(sd),
+		Forum:      forum,
+		Pinned:     pinned,
+		ThreadList: tl,
+		Sort:       sort,
+		Pages:      links,
+		CanPost:    !forum.Archived && f.can(sd, permission.Post, forum.NameSlug),
+	}
+
+	renderTemplate(w, "thread_list.html", data)
+}
+
+func (f *forumServer) threadHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	forum, err := f.store.GetForum(r.PathValue("slug"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "forum not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	thread, err := f.store.GetThreadView(r.PathValue("threadID"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "thread not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	// the thread must belong to the forum in the URL
+	if thread.ForumName != forum.NameSlug {
+		renderError(w, sd, http.StatusNotFound, "thread not found")
+		return
+	}
+
+	// links to a comment, as in search results, go to the page holding it
+	if id := r.URL.Query().Get("comment"); id != "" {
+		http.Redirect(w, r, f.commentURL(&thread.Thread, id), http.StatusFound)
+		return
+	}
+
+	pg := pageFromQuery(r, globalconst.CommentsPerPage)
+	cl, err := f.store.GetCommentViewPage(thread.ID, pg)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+	cl, links := paginate(cl, pg, func(c model.CommentView) string { return c.ID }, nil)
+
+	data := struct {
+		page
+		Forum       *model.Forum
+		Thread      *model.ThreadView
+		CommentList []model.CommentView
+		Pages       pageLinks
+		CanPost     bool
+		CanModerate bool
+		CanBan      bool
+		ForumList   []model.Forum // move destinations
+	}{
+		page:        newPage(sd),
+		Forum:       forum,
+		Thread:      thread,
+		CommentList: cl,
+		Pages:       links,
+		CanPost:     !forum.Archived && f.can(sd, permission.Post, forum.NameSlug),
+		CanModerate: f.can(sd, permission.Moderate, forum.NameSlug),
+		CanBan:      f.can(sd, permission.Ban, ""),
+	}
+
+	if data.CanModerate {
+		data.ForumList, err = f.store.GetForumList()
+		if err != nil {
+			log.Println(err)
+			renderError(w, sd, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	renderTemplate(w, "thread.html", data)
+}
+
+// postHandler creates a thread when the form carries a forum slug, or a
+// comment when it carries a thread id, and redirects to the new item.
+func (f *forumServer) postHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderError(w, sd, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	if !sd.LoggedIn {
+		renderError(w, sd, http.StatusUnauthorized, "you must be logged in to post")
+		return
+	}
+
+	if !f.allow(w, sd, permission.Post, "", "you are not allowed to post") {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4*globalconst.MaxContentLength)
+	err := r.ParseForm()
+	if err != nil {
+		renderError(w, sd, http.StatusBadRequest, "invalid form")
+		return
+	}
+
+	content, ok := formContent(w, r, sd)
+	if !ok {
+		return
+	}
+
+	threadID := r.PostForm.Get("thread_id")
+	if threadID != "" {
+		f.createComment(w, r, sd, threadID, content)
+		return
+	}
+
+	f.createThread(w, r, sd, r.PostForm.Get("forum"), content)
+}
+
+func (f *forumServer) createThread(w http.ResponseWriter, r *http.Request, sd *model.SessionData, forumSlug, content string) {
+	forum, err := f.store.GetForum(forumSlug)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "forum not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	if forum.Archived {
+		renderError(w, sd, http.StatusForbidden, "the forum is archived")
+		return
+	}
+
+	title := strings.TrimSpace(r.PostForm.Get("title"))
+	if title == "" || utf8.RuneCountInString(title) > globalconst.MaxTitleLength {
+		renderError(w, sd, http.StatusBadRequest,
+			fmt.Sprintf("title must have between 1 and %d characters", globalconst.MaxTitleLength))
+		return
+	}
+
+	thread := model.Thread{
+		ID:        util.RandomID(),
+		ForumName: forum.NameSlug,
+		Title:     title,
+		Content:   content,
+		UserID:    sd.UserID,
+	}
+
+	err = f.store.CreateThread(&thread)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/forum/"+forum.NameSlug+"/"+thread.ID, http.StatusSeeOther)
+}
+
+func (f *forumServer) createComment(w http.ResponseWriter, r *http.Request, sd *model.SessionData, threadID, content string) {
+	thread, err := f.store.GetThread(threadID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "thread not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	if thread.Deleted {
+		renderError(w, sd, http.StatusBadRequest, "the thread was deleted")
+		return
+	}
+
+	if !f.writable(w, sd, thread) {
+		return
+	}
+
+	comment := model.Comment{
+		ID:       util.RandomID(),
+		ThreadID: thread.ID,
+		UserID:   sd.UserID,
+		Content:  content,
+	}
+
+	err = f.store.CreateComment(&comment)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, f.commentURL(thread, comment.ID), http.StatusSeeOther)
+}
+
+// commentURL returns the URL of the thread page ending with the comment.
+func (f *forumServer) commentURL(thread *model.Thread, commentID string) string {
+	query := ""
+	prev, err := f.store.GetCommentViewPage(thread.ID, store.Page{
+		Before: commentID,
+		Limit:  globalconst.CommentsPerPage,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	if len(prev) == globalconst.CommentsPerPage {
+		query = "?after=" + url.QueryEscape(prev[0].ID)
+	}
+
+	return "/forum/" + thread.ForumName + "/" + thread.ID + query + "#" + commentID
+}
+
+// editHandler shows the edit form on GET and saves the changes on POST.
+// The item is a thread when thread_id is set or a comment when comment_id
+// is set, only its author can edit it.
+func (f *forumServer) editHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		renderError(w, sd, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	if !sd.LoggedIn {
+		renderError(w, sd, http.StatusUnauthorized, "you must be logged in to edit")
+		return
+	}
+
+	if !f.allow(w, sd, permission.Post, "", "you are not allowed to edit") {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4*globalconst.MaxContentLength)
+	err := r.ParseForm()
+	if err != nil {
+		renderError(w, sd, http.StatusBadRequest, "invalid form")
+		return
+	}
+
+	if r.Form.Get("comment_id") != "" {
+		f.editComment(w, r, sd, r.Form.Get("comment_id"))
+		return
+	}
+
+	f.editThread(w, r, sd, r.Form.Get("thread_id"))
+}
+
+func (f *forumServer) editThread(w http.ResponseWriter, r *http.Request, sd *model.SessionData, threadID string) {
+	thread, ok := f.ownThread(w, sd, threadID, false)
+	if !ok || !f.writable(w, sd, thread) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		data := struct {
+			page
+			Thread  *model.Thread
+			Comment *model.Comment
+		}{
+			page:   newPage(sd),
+			Thread: thread,
+		}
+		renderTemplate(w, "edit.html", data)
+		return
+	}
+
+	title := strings.TrimSpace(r.PostForm.Get("title"))
+	if title == "" || utf8.RuneCountInString(title) > globalconst.MaxTitleLength {
+		renderError(w, sd, http.StatusBadRequest,
+			fmt.Sprintf("title must have between 1 and %d characters", globalconst.MaxTitleLength))
+		return
+	}
+
+	content, ok := formContent(w, r, sd)
+	if !ok {
+		return
+	}
+
+	thread.Title = title
+	thread.Content = content
+
+	err := f.store.UpdateThread(thread)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/forum/"+thread.ForumName+"/"+thread.ID, http.StatusSeeOther)
+}
+
+func (f *forumServer) editComment(w http.ResponseWriter, r *http.Request, sd *model.SessionData, commentID string) {
+	comment, thread, ok := f.ownComment(w, sd, commentID, false)
+	if !ok || !f.writable(w, sd, thread) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		data := struct {
+			page
+			Thread  *model.Thread
+			Comment *model.Comment
+		}{
+			page:    newPage(sd),
+			Thread:  thread,
+			Comment: comment,
+		}
+		renderTemplate(w, "edit.html", data)
+		return
+	}
+
+	content, ok := formContent(w, r, sd)
+	if !ok {
+		return
+	}
+
+	comment.Content = content
+
+	err := f.store.UpdateComment(comment)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, f.commentURL(thread, comment.ID), http.StatusSeeOther)
+}
+
+// deleteHandler soft deletes a thread or a comment owned by the user, or
+// one in a forum the user moderates.
+func (f *forumServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderError(w, sd, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	if !sd.LoggedIn {
+		renderError(w, sd, http.StatusUnauthorized, "you must be logged in to delete")
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		renderError(w, sd, http.StatusBadRequest, "invalid form")
+		return
+	}
+
+	if r.PostForm.Get("comment_id") != "" {
+		comment, thread, ok := f.ownComment(w, sd, r.PostForm.Get("comment_id"), true)
+		if !ok {
+			return
+		}
+
+		err = f.store.DeleteComment(comment.ID)
+		if err != nil {
+			log.Println(err)
+			renderError(w, sd, http.StatusInternalServerError, "")
+			return
+		}
+
+		if comment.UserID != sd.UserID {
+			f.audit(sd, "delete_comment", "comment", comment.ID, "in "+thread.Title)
+		}
+
+		http.Redirect(w, r, f.commentURL(thread, comment.ID), http.StatusSeeOther)
+		return
+	}
+
+	thread, ok := f.ownThread(w, sd, r.PostForm.Get("thread_id"), true)
+	if !ok {
+		return
+	}
+
+	err = f.store.DeleteThread(thread.ID)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	if thread.UserID != sd.UserID {
+		f.audit(sd, "delete_thread", "thread", thread.ID, thread.Title)
+	}
+
+	http.Redirect(w, r, "/forum/"+thread.ForumName+"/"+thread.ID, http.StatusSeeOther)
+}
+
+// ownThread loads a thread that is not deleted and belongs to the session
+// user, or to its forum's moderators when moderate is set, writing the
+// error page and returning false otherwise.
+func (f *forumServer) ownThread(w http.ResponseWriter, sd *model.SessionData, threadID string, moderate bool) (*model.Thread, bool) {
+	thread, err := f.store.GetThread(threadID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "thread not found")
+			return nil, false
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return nil, false
+	}
+
+	if thread.Deleted {
+		renderError(w, sd, http.StatusNotFound, "thread not found")
+		return nil, false
+	}
+
+	if thread.UserID != sd.UserID && !(moderate && f.can(sd, permission.Moderate, thread.ForumName)) {
+		renderError(w, sd, http.StatusForbidden, "you can only change your own threads")
+		return nil, false
+	}
+
+	return thread, true
+}
+
+// ownComment loads a comment that is not deleted, in a thread that is not
+// deleted, and belongs to the session user together with its thread, as
+// ownThread does.
+func (f *forumServer) ownComment(w http.ResponseWriter, sd *model.SessionData, commentID string, moderate bool) (*model.Comment, *model.Thread, bool) {
+	comment, err := f.store.GetComment(commentID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "comment not found")
+			return nil, nil, false
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return nil, nil, false
+	}
+
+	if comment.Deleted {
+		renderError(w, sd, http.StatusNotFound, "comment not found")
+		return nil, nil, false
+	}
+
+	thread, err := f.store.GetThread(comment.ThreadID)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return nil, nil, false
+	}
+
+	if thread.Deleted {
+		renderError(w, sd, http.StatusNotFound, "thread not found")
+		return nil, nil, false
+	}
+
+	if comment.UserID != sd.UserID && !(moderate && f.can(sd, permission.Moderate, thread.ForumName)) {
+		renderError(w, sd, http.StatusForbidden, "you can only change your own comments")
+		return nil, nil, false
+	}
+
+	return comment, thread, true
+}
+
+// writable reports whether the session user may post to the thread,
+// writing a 403 page if its forum is archived, or if it is locked and the
+// user does not moderate it.
+func (f *forumServer) writable(w http.ResponseWriter, sd *model.SessionData, thread *model.Thread) bool {
+	forum, err := f.store.GetForum(thread.ForumName)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return false
+	}
+
+	if forum.Archived {
+		renderError(w, sd, http.StatusForbidden, "the forum is archived")
+		return false
+	}
+
+	if !thread.Locked {
+		return true
+	}
+
+	return f.allow(w, sd, permission.Moderate, thread.ForumName, "the thread is locked")
+}
+
+// formContent returns the trimmed content field, writing a 400 page if its
+// length is out of bounds.
+func formContent(w http.ResponseWriter, r *http.Request, sd *model.SessionData) (string, bool) {
+	content := strings.TrimSpace(r.PostForm.Get("content"))
+	if content == "" || utf8.RuneCountInString(content) > globalconst.MaxContentLength {
+		renderError(w, sd, http.StatusBadRequest,
+			fmt.Sprintf("content must have between 1 and %d characters", globalconst.MaxContentLength))
+		return "", false
+	}
+
+	return content, true
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"realm/globalconst"
+	"realm/handler"
+	"realm/memory"
+	"realm/model"
+	"realm/oauth"
+	"realm/permission"
+	"realm/session"
+)
+
+// newTestServer returns a forumServer on a memory store.
+func newTestServer(t *testing.T) *forumServer {
+	t.Helper()
+
+	st := memory.New()
+	backend, err := session.NewWriteThrough(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := session.New(globalconst.CookieName, backend, []byte("secret"))
+
+	return &forumServer{
+		store:     st,
+		sessions:  sc,
+		providers: oauth.NewRegistry(),
+		perms:     permission.New(st),
+		conns:     handler.New(st, sc, handler.Options{}),
+	}
+}
+
+// login creates a user and a logged in session for it, it returns the
+// session cookie and data.
+func login(t *testing.T, f *forumServer, name string) (*http.Cookie, *model.SessionData) {
+	t.Helper()
+
+	user, err := f.store.SaveUser(&model.User{
+		OAuthProvider: "github",
+		OAuthUserID:   name,
+		UserName:      name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := &model.SessionData{
+		OAuthProvider: "github",
+		OAuthUserID:   name,
+		UserName:      name,
+		LoggedIn:      true,
+		UserID:        user.ID,
+	}
+	rec := httptest.NewRecorder()
+	f.sessions.Rotate(rec, httptest.NewRequest(http.MethodGet, "/forum/", nil), "", sd)
+
+	return sessionCookie(t, rec), sd
+}
+
+// sessionCookie returns the session cookie set in a response.
+func sessionCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == globalconst.CookieName {
+			return c
+		}
+	}
+	t.Fatal("no session cookie set")
+	return nil
+}
+
+func TestForumIndex(t *testing.T) {
+	f := newTestServer(t)
+	cookie, sd := login(t, f, "alice")
+
+	forum := model.Forum{Name: "Gophers", Description: "all about go"}
+	if err := f.store.CreateForum(&forum); err != nil {
+		t.Fatal(err)
+	}
+	err := f.store.CreateThread(&model.Thread{
+		ID:        "t1",
+		ForumName: forum.NameSlug,
+		Title:     "Generics at last",
+		Content:   "hello",
+		UserID:    sd.UserID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/", nil)
+	r.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	f.forumHandler(rec, r)
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, body)
+	}
+	for _, want := range []string{"Gophers", "all about go", "Generics at last", "alice"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("forum index does not show %q", want)
+		}
+	}
+}
+
+func TestThreadListNotFound(t *testing.T) {
+	f := newTestServer(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/missing", nil)
+	r.SetPathValue("slug", "missing")
+	rec := httptest.NewRecorder()
+	f.threadListHandler(rec, r)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestThreadShowsEditInSameSecond(t *testing.T) {
+	f := newTestServer(t)
+	_, sd := login(t, f, "alice")
+
+	forum := model.Forum{Name: "Gophers"}
+	if err := f.store.CreateForum(&forum); err != nil {
+		t.Fatal(err)
+	}
+	thread := model.Thread{ID: "t1", ForumName: forum.NameSlug, Title: "Typo", Content: "teh *first* text", UserID: sd.UserID}
+	if err := f.store.CreateThread(&thread); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/forum/"+forum.NameSlug+"/t1", nil)
+		r.SetPathValue("slug", forum.NameSlug)
+		r.SetPathValue("threadID", "t1")
+		rec := httptest.NewRecorder()
+		f.threadHandler(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	body := get()
+	if !strings.Contains(body, "<em>first</em>") {
+		t.Fatal("thread content not rendered")
+	}
+	if strings.Contains(body, "edited at") {
+		t.Error("new thread shown as edited")
+	}
+
+	// the store keeps whole seconds, the edit may keep the same time
+	thread.Content = "the *second* text"
+	if err := f.store.UpdateThread(&thread); err != nil {
+		t.Fatal(err)
+	}
+	body = get()
+	if !strings.Contains(body, "<em>second</em>") {
+		t.Error("the edited content is not shown")
+	}
+	if !strings.Contains(body, "edited at") {
+		t.Error("the edit made in the same second is not marked")
+	}
+}
+
+// postForm sends a form to handler as the user of cookie.
+func postForm(f *forumServer, handler http.HandlerFunc, cookie *http.Cookie, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+
+	return rec
+}
+
+// getThread returns the page of a thread as the user of cookie, which
+// may be nil.
+func getThread(t *testing.T, f *forumServer, cookie *http.Cookie, forum, threadID string) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/"+forum+"/"+threadID, nil)
+	r.SetPathValue("slug", forum)
+	r.SetPathValue("threadID", threadID)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	f.threadHandler(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	return rec.Body.String()
+}
+
+// newPost creates a forum with a thread and a comment by the user of sd.
+func newPost(t *testing.T, f *forumServer, sd *model.SessionData) (model.Forum, model.Thread, model.Comment) {
+	t.Helper()
+
+	forum := model.Forum{Name: "Gophers"}
+	if err := f.store.CreateForum(&forum); err != nil {
+		t.Fatal(err)
+	}
+	thread := model.Thread{ID: "t1", ForumName: forum.NameSlug, Title: "Secret title", Content: "thread text", UserID: sd.UserID}
+	if err := f.store.CreateThread(&thread); err != nil {
+		t.Fatal(err)
+	}
+	comment := model.Comment{ID: "c1", ThreadID: thread.ID, UserID: sd.UserID, Content: "comment text"}
+	if err := f.store.CreateComment(&comment); err != nil {
+		t.Fatal(err)
+	}
+
+	return forum, thread, comment
+}
+
+func TestChangeOthersPostsRefused(t *testing.T) {
+	f := newTestServer(t)
+	_, alice := login(t, f, "alice")
+	bobCookie, _ := login(t, f, "bob")
+	_, thread, comment := newPost(t, f, alice)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		form    url.Values
+	}{
+		{"edit thread", f.editHandler, "/forum/edit", url.Values{"thread_id": {thread.ID}, "title": {"mine"}, "content": {"mine"}}},
+		{"edit comment", f.editHandler, "/forum/edit", url.Values{"comment_id": {comment.ID}, "content": {"mine"}}},
+		{"delete thread", f.deleteHandler, "/forum/delete", url.Values{"thread_id": {thread.ID}}},
+		{"delete comment", f.deleteHandler, "/forum/delete", url.Values{"comment_id": {comment.ID}}},
+	}
+	for _, tt := range tests {
+		rec := postForm(f, tt.handler, bobCookie, tt.path, tt.form)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	gotThread, err := f.store.GetThread(thread.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotThread.Deleted || gotThread.Title != thread.Title || gotThread.Content != thread.Content {
+		t.Errorf("thread changed by another user: %+v", gotThread)
+	}
+	gotComment, err := f.store.GetComment(comment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotComment.Deleted || gotComment.Content != comment.Content {
+		t.Errorf("comment changed by another user: %+v", gotComment)
+	}
+}
+
+func TestDeletedPostsHidden(t *testing.T) {
+	f := newTestServer(t)
+	cookie, alice := login(t, f, "alice")
+	forum, thread, comment := newPost(t, f, alice)
+	other := model.Comment{ID: "c2", ThreadID: thread.ID, UserID: alice.UserID, Content: "other comment"}
+	if err := f.store.CreateComment(&other); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postForm(f, f.deleteHandler, cookie, "/forum/delete", url.Values{"comment_id": {comment.ID}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("delete comment: status %d: %s", rec.Code, rec.Body)
+	}
+	body := getThread(t, f, cookie, forum.NameSlug, thread.ID)
+	if strings.Contains(body, comment.Content) || !strings.Contains(body, other.Content) {
+		t.Error("deleted comment shown, or the other one hidden")
+	}
+
+	// a deleted comment can no longer be edited or deleted
+	rec = postForm(f, f.editHandler, cookie, "/forum/edit", url.Values{"comment_id": {comment.ID}, "content": {"back"}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("edit deleted comment: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec = postForm(f, f.deleteHandler, cookie, "/forum/delete", url.Values{"thread_id": {thread.ID}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("delete thread: status %d: %s", rec.Code, rec.Body)
+	}
+	body = getThread(t, f, nil, forum.NameSlug, thread.ID)
+	if strings.Contains(body, thread.Title) || strings.Contains(body, thread.Content) {
+		t.Error("deleted thread shown")
+	}
+
+	// nor are the comments left in a deleted thread
+	rec = postForm(f, f.editHandler, cookie, "/forum/edit", url.Values{"comment_id": {other.ID}, "content": {"changed"}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("edit comment of a deleted thread: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	rec = postForm(f, f.deleteHandler, cookie, "/forum/delete", url.Values{"comment_id": {other.ID}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("delete comment of a deleted thread: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	rec = postForm(f, f.editHandler, cookie, "/forum/edit", url.Values{"thread_id": {thread.ID}, "title": {"back"}, "content": {"back"}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("edit deleted thread: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/forum/"+forum.NameSlug, nil)
+	r.SetPathValue("slug", forum.NameSlug)
+	rec = httptest.NewRecorder()
+	f.threadListHandler(rec, r)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), thread.Title) {
+		t.Errorf("thread list: status %d, shows the deleted title: %v", rec.Code, strings.Contains(rec.Body.String(), thread.Title))
+	}
+}
+
+func TestCommentRefused(t *testing.T) {
+	f := newTestServer(t)
+	_, alice := login(t, f, "alice")
+	bobCookie, _ := login(t, f, "bob")
+	_, thread, _ := newPost(t, f, alice)
+
+	comment := func() int {
+		t.Helper()
+		rec := postForm(f, f.postHandler, bobCookie, "/forum/post", url.Values{"thread_id": {thread.ID}, "content": {"reply"}})
+		return rec.Code
+	}
+
+	if code := comment(); code != http.StatusSeeOther {
+		t.Fatalf("comment on an open thread: status %d", code)
+	}
+
+	if err := f.store.SetThreadLocked(thread.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if code := comment(); code != http.StatusForbidden {
+		t.Errorf("comment on a locked thread: status %d, want %d", code, http.StatusForbidden)
+	}
+
+	if err := f.store.SetThreadLocked(thread.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.store.DeleteThread(thread.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code := comment(); code != http.StatusBadRequest {
+		t.Errorf("comment on a deleted thread: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	list, err := f.store.GetCommentList(thread.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("%d comments, want the first one and the one that was allowed", len(list))
+	}
+}
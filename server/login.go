@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"realm/oauth"
+)
+
+// loginHandler lists the enabled OAuth providers.
+func (f *forumServer) loginHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	data := struct {
+		page
+		Providers []*oauth.Provider
+	}{
+		page:      newPage(sd),
+		Providers: f.providers.List(),
+	}
+
+	renderTemplate(w, "login.html", data)
+}
+
+// withProvider serves h with the {provider} path value set to name, for
+// routes that name the provider in a fixed path.
+func withProvider(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("provider", name)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,37 +1,64 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"slices"
 	"strings"
-	"text/template"
 	"time"
 
 	"realm/globalconst"
 	"realm/handler"
 	"realm/model"
+	"realm/oauth"
+	"realm/permission"
+	"realm/postgres"
 	"realm/session"
+	"realm/sqldb"
 	"realm/sqlite"
+	"realm/store"
 
 	"github.com/dghubble/gologin/v2"
-	"github.com/dghubble/gologin/v2/github"
-	"golang.org/x/oauth2"
-	githubOAuth2 "golang.org/x/oauth2/github"
 
 	"crg.eti.br/go/config"
 	_ "crg.eti.br/go/config/ini"
 )
 
+// Config enables an OAuth provider when its client id is set.
 type Config struct {
-	GithubClientID     string `ini:"github_client_id" cfg:"github_client_id" cfgRequired:"true" cfgHelper:"Github Client ID"`
-	GithubClientSecret string `ini:"github_client_secret" cfg:"github_client_secret" cfgRequired:"true" cfgHelper:"Github Client Secret"`
-	GithubCallbackURL  string `ini:"github_callback_url" cfg:"github_callback_url" cfgRequired:"true" cfgHelper:"Github Callback URL"`
-	DatabaseName       string `ini:"database_name" cfg:"database_name" cfgRequired:"true" cfgHelper:"Database Name"`
+	GithubClientID     string `ini:"github_client_id" cfg:"github_client_id" cfgHelper:"Github Client ID"`
+	GithubClientSecret string `ini:"github_client_secret" cfg:"github_client_secret" cfgHelper:"Github Client Secret"`
+	GithubCallbackURL  string `ini:"github_callback_url" cfg:"github_callback_url" cfgHelper:"Github Callback URL"`
+	GitlabURL          string `ini:"gitlab_url" cfg:"gitlab_url" cfgDefault:"https://gitlab.com" cfgHelper:"GitLab URL, for self-hosted instances"`
+	GitlabClientID     string `ini:"gitlab_client_id" cfg:"gitlab_client_id" cfgHelper:"GitLab Client ID"`
+	GitlabClientSecret string `ini:"gitlab_client_secret" cfg:"gitlab_client_secret" cfgHelper:"GitLab Client Secret"`
+	GitlabCallbackURL  string `ini:"gitlab_callback_url" cfg:"gitlab_callback_url" cfgHelper:"GitLab Callback URL"`
+	GoogleClientID     string `ini:"google_client_id" cfg:"google_client_id" cfgHelper:"Google Client ID"`
+	GoogleClientSecret string `ini:"google_client_secret" cfg:"google_client_secret" cfgHelper:"Google Client Secret"`
+	GoogleCallbackURL  string `ini:"google_callback_url" cfg:"google_callback_url" cfgHelper:"Google Callback URL"`
+	OIDCName           string `ini:"oidc_name" cfg:"oidc_name" cfgHelper:"OpenID Connect provider name shown on the login page"`
+	OIDCIssuerURL      string `ini:"oidc_issuer_url" cfg:"oidc_issuer_url" cfgHelper:"OpenID Connect Issuer URL"`
+	OIDCClientID       string `ini:"oidc_client_id" cfg:"oidc_client_id" cfgHelper:"OpenID Connect Client ID"`
+	OIDCClientSecret   string `ini:"oidc_client_secret" cfg:"oidc_client_secret" cfgHelper:"OpenID Connect Client Secret"`
+	OIDCCallbackURL    string `ini:"oidc_callback_url" cfg:"oidc_callback_url" cfgHelper:"OpenID Connect Callback URL"`
+	DatabaseDriver     string `ini:"database_driver" cfg:"database_driver" cfgDefault:"sqlite" cfgHelper:"Database driver, sqlite or postgres"`
+	DatabaseName       string `ini:"database_name" cfg:"database_name" cfgHelper:"Database Name, the sqlite file"`
+	DatabaseDSN        string `ini:"database_dsn" cfg:"database_dsn" cfgHelper:"Database DSN, for postgres"`
+	AutoMigrate        bool   `ini:"auto_migrate" cfg:"auto_migrate" cfgDefault:"false" cfgHelper:"Apply pending database migrations when the server starts"`
 	Port               int    `ini:"port" cfg:"port" cfgDefault:"8080" cfgHelper:"Port"`
+	SessionBackend     string `ini:"session_backend" cfg:"session_backend" cfgDefault:"memory" cfgHelper:"Session backend: memory, database or lru"`
+	SessionCacheSize   int    `ini:"session_cache_size" cfg:"session_cache_size" cfgDefault:"10000" cfgHelper:"Sessions kept in memory by the lru session backend"`
+	HeartbeatInterval  int    `ini:"heartbeat_interval" cfg:"heartbeat_interval" cfgDefault:"15" cfgHelper:"Seconds between the pings sent to each websocket connection"`
+	HeartbeatMisses    int    `ini:"heartbeat_misses" cfg:"heartbeat_misses" cfgDefault:"3" cfgHelper:"Unanswered pings in a row that close a websocket connection"`
+	SessionSecret      string `ini:"session_secret" cfg:"session_secret" cfgHelper:"Key to sign the session cookie with, unsigned when empty"`
+	WebsocketGuests    bool   `ini:"websocket_guests" cfg:"websocket_guests" cfgDefault:"false" cfgHelper:"Let visitors that are not logged in connect to the game"`
+	WebsocketOrigins   string `ini:"websocket_origins" cfg:"websocket_origins" cfgHelper:"Comma separated origin patterns allowed to open the websocket, besides the server host"`
 }
 
 var (
@@ -39,139 +66,233 @@ var (
 	assets embed.FS
 )
 
-// ///////////////////////////////////
-func forumHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("homeHandler")
-
-	log.Println("r.URL.Path:", r.URL.Path)
-
-	sid, sd, ok := session.SC.Get(r)
-	if !ok {
-		log.Println("1 session not found")
-		sid, sd = session.SC.Create()
+// newSessionBackend returns the session backend named in the config:
+// memory keeps every session in memory and writes it to the database,
+// database keeps them only there and lru caches the most recent ones.
+func newSessionBackend(cfg Config, db store.SessionStore) (session.Backend, error) {
+	switch cfg.SessionBackend {
+	case "", "memory":
+		return session.NewWriteThrough(db)
+	case "database":
+		return session.NewStoreOnly(db), nil
+	case "lru":
+		return session.NewLRU(db, cfg.SessionCacheSize)
 	}
 
-	if !sd.LoggedIn {
-		log.Println("not logged in")
-	}
-	log.Println("name:", sd.UserName)
-
-	// renew session
-	session.SC.Save(w, sid, sd)
-
-	log.Println("sid:", sid)
-	//////////////////////////
+	return nil, fmt.Errorf("unknown session backend %q", cfg.SessionBackend)
+}
 
-	index, err := assets.ReadFile("assets/forum.html")
-	if err != nil {
-		log.Fatal(err)
+// splitList returns the trimmed, non empty items of a comma separated
+// config value.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
+}
+
+// ///////////////////////////////////
+func (f *forumServer) forumHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
 
-	t, err := template.New("forum.html").Parse(string(index))
+	fl, err := f.store.GetForumViewList()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
 	}
 
-	fl, err := sqlite.DB.GetForumList()
+	cl, err := f.store.GetCategoryList()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
 	}
 
 	data := struct {
-		SessionData    *model.SessionData
-		GitHubLoginURL string
-		LogoutURL      string
-		ForumList      []model.Forum
+		page
+		Groups []forumGroup
 	}{
-		SessionData:    sd,
-		GitHubLoginURL: "/forum/github/login",
-		LogoutURL:      "/forum/logout",
-		ForumList:      fl,
+		page:   newPage(sd),
+		Groups: groupForums(cl, fl),
 	}
-	err = t.Execute(w, data)
-	if err != nil {
-		log.Fatal(err)
+
+	renderTemplate(w, "forum.html", data)
+}
+
+// forumGroup is a category and its forums on the forum index, the group
+// of forums without a category has a zero Category.
+type forumGroup struct {
+	Category  model.Category
+	ForumList []model.ForumView
+}
+
+// groupForums groups forums by category keeping the order of both lists,
+// forums without a known category come first.
+func groupForums(categoryList []model.Category, forumList []model.ForumView) []forumGroup {
+	groups := make([]forumGroup, len(categoryList)+1)
+	index := make(map[string]int)
+	for i, c := range categoryList {
+		groups[i+1].Category = c
+		index[c.NameSlug] = i + 1
+	}
+
+	for _, fv := range forumList {
+		i := index[fv.CategorySlug]
+		groups[i].ForumList = append(groups[i].ForumList, fv)
 	}
 
+	return slices.DeleteFunc(groups, func(g forumGroup) bool { return len(g.ForumList) == 0 })
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
+func (f *forumServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("logoutHandler")
-	sid, sd, ok := session.SC.Get(r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	sid, _, ok := f.sessions.Get(r)
 	if !ok {
 		http.Redirect(w, r, "/forum", http.StatusFound)
 		return
 	}
 
-	sd.LoggedIn = false
+	// continue with an anonymous session under a new id
+	f.sessions.Rotate(w, r, sid, &model.SessionData{})
+	f.conns.CloseSession(sid)
+
+	http.Redirect(w, r, "/forum", http.StatusFound)
+}
+
+// issueSession logs in the user of a finished OAuth login, creating the
+// user on the first login, or links the identity when the login was
+// started from the account page.
+func (f *forumServer) issueSession(w http.ResponseWriter, r *http.Request, p *oauth.Provider, profile oauth.Profile) {
+	sid, sd, ok := f.sessions.Get(r)
+	if linkRequested(w, r, p) && ok && sd.LoggedIn {
+		f.linkIdentity(w, r, sd, p, profile)
+		return
+	}
+	if !ok {
+		log.Println("2 session not found")
+		sd = &model.SessionData{}
+	}
+
+	log.Println("provider:", p.Name, "ID:", profile.ID)
+
+	/////////////////
+	// save user data
+	user := model.User{
+		ID:            sd.UserID,
+		UserName:      profile.Name,
+		AvatarURL:     profile.AvatarURL,
+		OAuthProvider: p.Name,
+		OAuthUserID:   profile.ID,
+	}
 
-	// remove session
-	session.SC.Delete(w, sid)
+	user, err := f.store.SaveUser(&user)
+	if err != nil {
+		log.Println(err)
+	}
+
+	///////////////////
+	// save session data
+	sdAUX := model.SessionData{
+		OAuthProvider: p.Name,
+		OAuthUserID:   profile.ID,
+		UserName:      profile.Name,
+		AvatarURL:     profile.AvatarURL,
+		LoggedIn:      true,
+		UserID:        user.ID,
+	}
+
+	log.Println("name:", sdAUX.UserName)
+	// new session id and CSRF token on login, the ones seen before it are
+	// not reused
+	f.sessions.Rotate(w, r, sid, &sdAUX)
+	f.conns.CloseSession(sid)
 
 	http.Redirect(w, r, "/forum", http.StatusFound)
 }
 
-func issueSession() http.Handler {
-	log.Println("issueSession")
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		sid, sd, ok := session.SC.Get(r)
-		if !ok {
-			log.Println("2 session not found")
-			sid, sd = session.SC.Create()
-		}
+// newProviders registers the OAuth providers enabled in cfg.
+func newProviders(ctx context.Context, cfg Config) (*oauth.Registry, error) {
+	providers := oauth.NewRegistry()
+	var list []*oauth.Provider
 
-		ctx := r.Context()
-		githubUser, err := github.UserFromContext(ctx)
+	if cfg.GithubClientID != "" {
+		list = append(list, oauth.GitHub(cfg.GithubClientID, cfg.GithubClientSecret, cfg.GithubCallbackURL))
+	}
+	if cfg.GitlabClientID != "" {
+		list = append(list, oauth.GitLab(cfg.GitlabURL, cfg.GitlabClientID, cfg.GitlabClientSecret, cfg.GitlabCallbackURL))
+	}
+	if cfg.GoogleClientID != "" {
+		list = append(list, oauth.Google(cfg.GoogleClientID, cfg.GoogleClientSecret, cfg.GoogleCallbackURL))
+	}
+	if cfg.OIDCClientID != "" {
+		p, err := oauth.OIDC(ctx, cfg.OIDCName, cfg.OIDCIssuerURL, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCCallbackURL)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
+		list = append(list, p)
+	}
 
-		// TODO: validar todos os campos, se for nil trocar por um valor padrão
-		log.Println("sid:", sid)
-		//log.Printf("githubUser: %#v\n", githubUser)
-		log.Println("ID:", *githubUser.ID)
-		log.Println("Login:", *githubUser.Login)
-
-		/////////////////
-		// save user data
-		user := model.User{
-			ID:            sd.UserID,
-			UserName:      *githubUser.Name,
-			AvatarURL:     *githubUser.AvatarURL,
-			OAuthProvider: "github",
-			OAuthUserID:   fmt.Sprintf("%d", *githubUser.ID),
+	for _, p := range list {
+		err := providers.Register(p)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		user, err = sqlite.DB.SaveUser(&user)
+	if len(providers.List()) == 0 {
+		log.Println("no oauth provider configured, login is disabled")
+	}
+
+	return providers, nil
+}
+
+/////////////////////////////////////
+
+// database is a store whose schema is kept by migrations.
+type database interface {
+	store.Store
+	sqldb.Migrator
+}
+
+// openStore opens the database selected by cfg.DatabaseDriver.
+func openStore(cfg Config) (database, error) {
+	switch cfg.DatabaseDriver {
+	case "sqlite":
+		if cfg.DatabaseName == "" {
+			return nil, errors.New("database_name is required for sqlite")
+		}
+		log.Printf("database name: %s\n", cfg.DatabaseName)
+		db, err := sqlite.Open(cfg.DatabaseName)
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
+		return db, nil
 
-		///////////////////
-		// save session data
-		sdAUX := model.SessionData{
-			OAuthProvider: "github",
-			OAuthUserID:   fmt.Sprintf("%d", *githubUser.ID),
-			UserName:      *githubUser.Name,
-			AvatarURL:     *githubUser.AvatarURL,
-			SessionID:     sid,
-			LoggedIn:      true,
-			ExpireAt:      time.Now().Add(globalconst.TimeToExpire * time.Second),
-			UserID:        user.ID,
+	case "postgres":
+		if cfg.DatabaseDSN == "" {
+			return nil, errors.New("database_dsn is required for postgres")
 		}
-		sd = &sdAUX
-
-		log.Println("name:", sdAUX.UserName)
-		// renew session
-		session.SC.Save(w, sid, sd)
-
-		http.Redirect(w, r, "/forum", http.StatusFound)
+		log.Println("database driver: postgres")
+		db, err := postgres.Open(cfg.DatabaseDSN)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
 	}
-	return http.HandlerFunc(fn)
-}
 
-/////////////////////////////////////
+	return nil, fmt.Errorf("unknown database driver %q", cfg.DatabaseDriver)
+}
 
 func main() {
 	cfg := Config{}
@@ -183,48 +304,76 @@ func main() {
 		return
 	}
 
-	log.Printf("database name: %s\n", cfg.DatabaseName)
-	err = sqlite.Open(cfg.DatabaseName)
+	db, err := openStore(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = sqlite.DB.CreateSessionTables()
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err = runMigrate(db, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = sqlite.DB.CreateForumTables()
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		err = prepareSchema(db, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = runAdmin(db, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	err = sqlite.DB.CreateChatTables()
+	err = prepareSchema(db, cfg.AutoMigrate)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = sqlite.DB.CreateUserTables()
+	backend, err := newSessionBackend(cfg, db)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	session.New(globalconst.CookieName)
+	sc := session.New(globalconst.CookieName, backend, []byte(cfg.SessionSecret))
 
 	go func() {
 		for {
 			time.Sleep(5 * time.Minute)
-			session.SC.RemoveExpired()
+			sc.RemoveExpired()
 		}
 	}()
 
-	oauth2Config := &oauth2.Config{
-		ClientID:     cfg.GithubClientID,
-		ClientSecret: cfg.GithubClientSecret,
-		RedirectURL:  cfg.GithubCallbackURL,
-		Endpoint:     githubOAuth2.Endpoint,
+	providers, err := newProviders(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f := &forumServer{
+		store:     db,
+		sessions:  sc,
+		providers: providers,
+		perms:     permission.New(db),
+		conns: handler.New(db, sc, handler.Options{
+			Heartbeat: handler.Heartbeat{
+				Interval:  time.Duration(cfg.HeartbeatInterval) * time.Second,
+				MaxMissed: cfg.HeartbeatMisses,
+			},
+			Guests:  cfg.WebsocketGuests,
+			Origins: splitList(cfg.WebsocketOrigins),
+		}),
 	}
 
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			f.reloadSessions()
+		}
+	}()
+
 	// state param cookies require HTTPS by default; disable for localhost development
 	//stateConfig := gologin.DebugOnlyCookieConfig
 	stateConfig := gologin.DefaultCookieConfig
@@ -244,48 +393,42 @@ func main() {
 		fs.ServeHTTP(w, r)
 	})
 
-	mux.HandleFunc("/ws", handler.Websocket)
-	mux.HandleFunc("/forum/", forumHandler)
-	mux.HandleFunc("/forum/logout", logoutHandler)
-
-	mux.Handle(
-		"/forum/github/login",
-		github.StateHandler(
-			stateConfig,
-			github.LoginHandler(oauth2Config, nil)))
-	mux.Handle(
-		"/forum/github/callback",
-		github.StateHandler(
-			stateConfig,
-			github.CallbackHandler(oauth2Config, issueSession(), nil)))
+	mux.HandleFunc("/ws", f.conns.Websocket)
+	mux.Handle("/forum", http.RedirectHandler("/forum/", http.StatusMovedPermanently))
+	mux.HandleFunc("/forum/{$}", f.forumHandler)
+	mux.HandleFunc("/forum/logout", f.csrfProtect(f.logoutHandler))
+	mux.HandleFunc("/forum/search", f.searchHandler)
+	mux.HandleFunc("/forum/account", f.accountHandler)
+	mux.HandleFunc("/forum/account/link", f.csrfProtect(f.linkHandler))
+	mux.HandleFunc("/forum/account/unlink", f.csrfProtect(f.unlinkHandler))
+	mux.HandleFunc("/forum/account/sessions", f.sessionsHandler)
+	mux.HandleFunc("/forum/account/sessions/revoke", f.csrfProtect(f.revokeHandler))
+	mux.HandleFunc("/forum/account/token", f.csrfProtect(f.tokenHandler))
+	mux.HandleFunc("/forum/mod", f.modHandler)
+	mux.HandleFunc("/forum/mod/lock", f.csrfProtect(f.lockHandler))
+	mux.HandleFunc("/forum/mod/pin", f.csrfProtect(f.pinHandler))
+	mux.HandleFunc("/forum/mod/move", f.csrfProtect(f.moveHandler))
+	mux.HandleFunc("/forum/mod/ban", f.csrfProtect(f.banHandler))
+	mux.HandleFunc("/forum/mod/unban", f.csrfProtect(f.unbanHandler))
+	mux.HandleFunc("/forum/mod/role", f.csrfProtect(f.roleHandler))
+	mux.HandleFunc("/forum/mod/moderator", f.csrfProtect(f.forumModeratorHandler))
+	mux.HandleFunc("/forum/mod/revisions", f.revisionsHandler)
+	mux.HandleFunc("/forum/{slug}", f.threadListHandler)
+	mux.HandleFunc("/forum/{slug}/{threadID}", f.threadHandler)
+
+	loginHandler := providers.LoginHandler(stateConfig)
+	callbackHandler := providers.CallbackHandler(stateConfig, f.issueSession)
+	mux.HandleFunc("/forum/login", f.loginHandler)
+	mux.Handle("/forum/oauth/{provider}/login", loginHandler)
+	mux.Handle("/forum/oauth/{provider}/callback", callbackHandler)
+	// callback URLs registered with GitHub before the other providers
+	mux.Handle("/forum/github/login", withProvider("github", loginHandler))
+	mux.Handle("/forum/github/callback", withProvider("github", callbackHandler))
 
 	// recebe post de usuário
-	mux.HandleFunc("/forum/post", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("postHandler")
-		sid, sd, ok := session.SC.Get(r)
-		if !ok {
-			http.Redirect(w, r, "/forum", http.StatusFound)
-			return
-		}
-
-		if sd.UserName != "" {
-			log.Println("name:", sd.UserName)
-		}
-
-		post := ""
-		if r.Method == http.MethodPost {
-			b, err := io.ReadAll(r.Body)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			post = string(b)
-		}
-
-		log.Println("sid:", sid)
-		log.Println("post:", post)
-
-	})
+	mux.HandleFunc("/forum/post", f.csrfProtect(f.postHandler))
+	mux.HandleFunc("/forum/edit", f.csrfProtect(f.editHandler))
+	mux.HandleFunc("/forum/delete", f.csrfProtect(f.deleteHandler))
 
 	s := &http.Server{
 		Handler:        mux,
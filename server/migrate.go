@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"realm/sqldb"
+)
+
+// prepareSchema returns an error unless the database is at the schema of
+// this binary. With autoMigrate set it applies the pending migrations
+// first.
+func prepareSchema(db sqldb.Migrator, autoMigrate bool) error {
+	err := db.CheckSchema()
+	if !errors.Is(err, sqldb.ErrSchemaOutdated) {
+		return err
+	}
+
+	if !autoMigrate {
+		return fmt.Errorf("%w, run \"realm-server migrate up\" or set auto_migrate", err)
+	}
+
+	log.Println("applying pending migrations")
+	return db.MigrateUp()
+}
+
+const migrateUsage = "usage: realm-server migrate status|up|down|to N"
+
+// runMigrate implements the "migrate" subcommand.
+func runMigrate(db sqldb.Migrator, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	switch args[0] {
+	case "status":
+		statusList, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		version, err := db.SchemaVersion()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("schema version %d of %d\n", version, len(statusList))
+		for _, st := range statusList {
+			applied := "pending"
+			if !st.AppliedAt.IsZero() {
+				applied = "applied " + st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-20s %s\n", st.Version, st.Name, applied)
+		}
+		return nil
+
+	case "up":
+		return db.MigrateUp()
+
+	case "down":
+		return db.MigrateDown()
+
+	case "to":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return db.MigrateTo(version)
+	}
+
+	fmt.Fprintln(os.Stderr, migrateUsage)
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
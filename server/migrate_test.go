@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"realm/sqldb"
+	"realm/sqlite"
+)
+
+func TestPrepareSchema(t *testing.T) {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "realm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = prepareSchema(db, false)
+	if !errors.Is(err, sqldb.ErrSchemaOutdated) {
+		t.Fatalf("new database without auto migration: got %v, want sqldb.ErrSchemaOutdated", err)
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatalf("migrated to version %d without auto migration", version)
+	}
+
+	if err := prepareSchema(db, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckSchema(); err != nil {
+		t.Fatalf("CheckSchema after auto migration: %v", err)
+	}
+
+	// one migration behind
+	if err := db.MigrateDown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareSchema(db, false); !errors.Is(err, sqldb.ErrSchemaOutdated) {
+		t.Errorf("database a migration behind: got %v, want sqldb.ErrSchemaOutdated", err)
+	}
+}
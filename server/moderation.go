@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"realm/globalconst"
+	"realm/model"
+	"realm/permission"
+	"realm/store"
+)
+
+// auditLogSize is how many entries the moderation page shows.
+const auditLogSize = 100
+
+// can reports whether the session user may do action in forum, errors
+// are logged and deny.
+func (f *forumServer) can(sd *model.SessionData, action permission.Action, forum string) bool {
+	if !sd.LoggedIn {
+		return false
+	}
+
+	ok, err := f.perms.Can(sd.UserID, action, forum)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return ok
+}
+
+// allow writes a 403 page with message and returns false if the session
+// user may not do action in forum.
+func (f *forumServer) allow(w http.ResponseWriter, sd *model.SessionData, action permission.Action, forum, message string) bool {
+	if f.can(sd, action, forum) {
+		return true
+	}
+
+	renderError(w, sd, http.StatusForbidden, message)
+	return false
+}
+
+// audit records a moderation action done by the session user.
+func (f *forumServer) audit(sd *model.SessionData, action, targetType, targetID, detail string) {
+	err := f.store.CreateAuditLog(&model.AuditLog{
+		UserID:     sd.UserID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Detail:     detail,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// modThread loads the thread of a moderation action, writing an error
+// page if it does not exist or the user may not moderate its forum.
+func (f *forumServer) modThread(w http.ResponseWriter, r *http.Request, sd *model.SessionData) (*model.Thread, bool) {
+	thread, err := f.store.GetThread(r.PostForm.Get("thread_id"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "thread not found")
+			return nil, false
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return nil, false
+	}
+
+	if !f.allow(w, sd, permission.Moderate, thread.ForumName, "you do not moderate this forum") {
+		return nil, false
+	}
+
+	return thread, true
+}
+
+// lockHandler locks or unlocks a thread.
+func (f *forumServer) lockHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	thread, ok := f.modThread(w, r, sd)
+	if !ok {
+		return
+	}
+
+	locked := r.PostForm.Get("locked") == "true"
+	err := f.store.SetThreadLocked(thread.ID, locked)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	action := "lock_thread"
+	if !locked {
+		action = "unlock_thread"
+	}
+	f.audit(sd, action, "thread", thread.ID, thread.Title)
+
+	http.Redirect(w, r, "/forum/"+thread.ForumName+"/"+thread.ID, http.StatusSeeOther)
+}
+
+// pinHandler pins or unpins a thread.
+func (f *forumServer) pinHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	thread, ok := f.modThread(w, r, sd)
+	if !ok {
+		return
+	}
+
+	pinned := r.PostForm.Get("pinned") == "true"
+	err := f.store.SetThreadPinned(thread.ID, pinned)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	action := "pin_thread"
+	if !pinned {
+		action = "unpin_thread"
+	}
+	f.audit(sd, action, "thread", thread.ID, thread.Title)
+
+	http.Redirect(w, r, "/forum/"+thread.ForumName+"/"+thread.ID, http.StatusSeeOther)
+}
+
+// moveHandler moves a thread to another forum, the user must moderate
+// both.
+func (f *forumServer) moveHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	thread, ok := f.modThread(w, r, sd)
+	if !ok {
+		return
+	}
+
+	forum, err := f.store.GetForum(r.PostForm.Get("forum"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "forum not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !f.allow(w, sd, permission.Moderate, forum.NameSlug, "you do not moderate the destination forum") {
+		return
+	}
+
+	err = f.store.MoveThread(thread.ID, forum.NameSlug)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	f.audit(sd, "move_thread", "thread", thread.ID,
+		fmt.Sprintf("%s: %s -> %s", thread.Title, thread.ForumName, forum.NameSlug))
+
+	http.Redirect(w, r, "/forum/"+forum.NameSlug+"/"+thread.ID, http.StatusSeeOther)
+}
+
+// modUser loads the user a ban or role change applies to, writing an
+// error page if it does not exist or outranks the session user.
+func (f *forumServer) modUser(w http.ResponseWriter, r *http.Request, sd *model.SessionData) (*model.User, bool) {
+	user, err := f.store.GetUser(r.PostForm.Get("user_id"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "user not found")
+			return nil, false
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return nil, false
+	}
+
+	self, err := f.store.GetUser(sd.UserID)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return nil, false
+	}
+
+	now := time.Now()
+	if user.ID == self.ID || !permission.Outranks(self.RoleAt(now), user.RoleAt(now)) {
+		renderError(w, sd, http.StatusForbidden, "you cannot change this user")
+		return nil, false
+	}
+
+	return user, true
+}
+
+// banHandler bans a user for the number of days in the form, forever
+// when it is zero.
+func (f *forumServer) banHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	if !f.allow(w, sd, permission.Ban, "", "you cannot ban users") {
+		return
+	}
+
+	user, ok := f.modUser(w, r, sd)
+	if !ok {
+		return
+	}
+
+	days, err := strconv.Atoi(r.PostForm.Get("days"))
+	if err != nil || days < 0 {
+		renderError(w, sd, http.StatusBadRequest, "invalid ban length")
+		return
+	}
+	if days > globalconst.MaxBanDays {
+		renderError(w, sd, http.StatusBadRequest,
+			fmt.Sprintf("a ban lasts at most %d days, use 0 for a permanent ban", globalconst.MaxBanDays))
+		return
+	}
+
+	var until time.Time
+	detail := "permanent"
+	if days > 0 {
+		until = time.Now().AddDate(0, 0, days)
+		detail = "until " + until.UTC().Format("2006-01-02 15:04")
+	}
+
+	err = f.store.BanUser(user.ID, until)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	f.audit(sd, "ban_user", "user", user.ID, user.UserName+": "+detail)
+
+	http.Redirect(w, r, "/forum/mod", http.StatusSeeOther)
+}
+
+// unbanHandler lifts the ban of a user, who becomes a member.
+func (f *forumServer) unbanHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	if !f.allow(w, sd, permission.Ban, "", "you cannot unban users") {
+		return
+	}
+
+	user, ok := f.modUser(w, r, sd)
+	if !ok {
+		return
+	}
+
+	err := f.store.SetUserRole(user.ID, model.RoleMember)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	f.audit(sd, "unban_user", "user", user.ID, user.UserName)
+
+	http.Redirect(w, r, "/forum/mod", http.StatusSeeOther)
+}
+
+// roleHandler sets the role of a user.
+func (f *forumServer) roleHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	if !f.allow(w, sd, permission.Manage, "", "only admins can change roles") {
+		return
+	}
+
+	user, ok := f.modUser(w, r, sd)
+	if !ok {
+		return
+	}
+
+	role := model.Role(r.PostForm.Get("role"))
+	if !role.Valid() || role == model.RoleBanned {
+		renderError(w, sd, http.StatusBadRequest, "invalid role")
+		return
+	}
+
+	err := f.store.SetUserRole(user.ID, role)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	f.audit(sd, "set_role", "user", user.ID, user.UserName+": "+string(role))
+
+	http.Redirect(w, r, "/forum/mod", http.StatusSeeOther)
+}
+
+// forumModeratorHandler adds or removes a moderator of a forum.
+func (f *forumServer) forumModeratorHandler(w http.ResponseWriter, r *http.Request) {
+	sd, ok := f.postSession(w, r)
+	if !ok {
+		return
+	}
+
+	if !f.allow(w, sd, permission.Manage, "", "only admins can assign forum moderators") {
+		return
+	}
+
+	forum, err := f.store.GetForum(r.PostForm.Get("forum"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "forum not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	user, err := f.store.GetUser(r.PostForm.Get("user_id"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "user not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	action := "add_forum_moderator"
+	if r.PostForm.Get("remove") == "true" {
+		action = "remove_forum_moderator"
+		err = f.store.RemoveForumModerator(forum.NameSlug, user.ID)
+	} else {
+		err = f.store.AddForumModerator(forum.NameSlug, user.ID)
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	f.audit(sd, action, "user", user.ID, user.UserName+": "+forum.NameSlug)
+
+	http.Redirect(w, r, "/forum/mod", http.StatusSeeOther)
+}
+
+// banForm is the data of the ban form shown next to post authors.
+type banForm struct {
+	CSRFToken string
+	UserID    string
+}
+
+func newBanForm(csrfToken, userID string) banForm {
+	return banForm{CSRFToken: csrfToken, UserID: userID}
+}
+
+// forumModerators is a forum with its moderators, for the moderation page.
+type forumModerators struct {
+	Forum      model.Forum
+	Moderators []model.User
+}
+
+// modHandler shows the audit log and the banned users to moderators, and
+// the role and forum moderator forms to admins.
+func (f *forumServer) modHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	if !f.allow(w, sd, permission.Ban, "", "only moderators can see this page") {
+		return
+	}
+
+	entryList, err := f.store.GetAuditLogList(auditLogSize)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	banned, err := f.store.GetUserList(model.RoleBanned)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	data := struct {
+		page
+		AuditLog  []model.AuditLogView
+		Banned    []model.User
+		CanManage bool
+		Staff     []model.User
+		Forums    []forumModerators
+		Now       time.Time
+	}{
+		page:      newPage(sd),
+		AuditLog:  entryList,
+		Banned:    banned,
+		CanManage: f.can(sd, permission.Manage, ""),
+		Now:       time.Now(),
+	}
+
+	if data.CanManage {
+		for _, role := range []model.Role{model.RoleAdmin, model.RoleModerator} {
+			ul, err := f.store.GetUserList(role)
+			if err != nil {
+				log.Println(err)
+				renderError(w, sd, http.StatusInternalServerError, "")
+				return
+			}
+			data.Staff = append(data.Staff, ul...)
+		}
+
+		fl, err := f.store.GetForumList()
+		if err != nil {
+			log.Println(err)
+			renderError(w, sd, http.StatusInternalServerError, "")
+			return
+		}
+		for _, forum := range fl {
+			ul, err := f.store.GetForumModeratorList(forum.NameSlug)
+			if err != nil {
+				log.Println(err)
+				renderError(w, sd, http.StatusInternalServerError, "")
+				return
+			}
+			data.Forums = append(data.Forums, forumModerators{Forum: forum, Moderators: ul})
+		}
+	}
+
+	renderTemplate(w, "mod.html", data)
+}
+
+// revisionsHandler shows the versions of a thread or comment kept on each
+// edit and delete, to the moderators of its forum. The item is a comment
+// when comment_id is set, a thread otherwise.
+func (f *forumServer) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	var comment *model.Comment
+	threadID := r.URL.Query().Get("thread_id")
+	if id := r.URL.Query().Get("comment_id"); id != "" {
+		var err error
+		comment, err = f.store.GetComment(id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				renderError(w, sd, http.StatusNotFound, "comment not found")
+				return
+			}
+			log.Println(err)
+			renderError(w, sd, http.StatusInternalServerError, "")
+			return
+		}
+		threadID = comment.ThreadID
+	}
+
+	thread, err := f.store.GetThread(threadID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			renderError(w, sd, http.StatusNotFound, "thread not found")
+			return
+		}
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !f.allow(w, sd, permission.Moderate, thread.ForumName, "you do not moderate this forum") {
+		return
+	}
+
+	itemID := thread.ID
+	if comment != nil {
+		itemID = comment.ID
+	}
+	revisionList, err := f.store.GetRevisionList(itemID)
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	data := struct {
+		page
+		Thread       *model.Thread
+		Comment      *model.Comment
+		RevisionList []model.Revision
+	}{
+		page:         newPage(sd),
+		Thread:       thread,
+		Comment:      comment,
+		RevisionList: revisionList,
+	}
+
+	renderTemplate(w, "revisions.html", data)
+}
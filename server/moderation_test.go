@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"realm/globalconst"
+	"realm/model"
+)
+
+func TestBanDays(t *testing.T) {
+	tests := []struct {
+		days  string
+		want  int
+		until time.Duration // zero for a permanent ban
+	}{
+		{"7", http.StatusSeeOther, 7 * 24 * time.Hour},
+		{"0", http.StatusSeeOther, 0},
+		{strconv.Itoa(globalconst.MaxBanDays), http.StatusSeeOther, globalconst.MaxBanDays * 24 * time.Hour},
+		{strconv.Itoa(globalconst.MaxBanDays + 1), http.StatusBadRequest, 0},
+		{"9223372036854775807", http.StatusBadRequest, 0},
+		{"-1", http.StatusBadRequest, 0},
+		{"soon", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.days, func(t *testing.T) {
+			f := newTestServer(t)
+			cookie, admin := login(t, f, "admin")
+			if err := f.store.SetUserRole(admin.UserID, model.RoleAdmin); err != nil {
+				t.Fatal(err)
+			}
+			_, member := login(t, f, "member")
+
+			form := url.Values{"user_id": {member.UserID}, "days": {tt.days}}
+			r := httptest.NewRequest(http.MethodPost, "/forum/mod/ban", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(cookie)
+			rec := httptest.NewRecorder()
+			f.banHandler(rec, r)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			user, err := f.store.GetUser(member.UserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != http.StatusSeeOther {
+				if user.Role != model.RoleMember {
+					t.Errorf("role %s after a refused ban", user.Role)
+				}
+				return
+			}
+
+			if user.Role != model.RoleBanned {
+				t.Fatalf("role %s, want banned", user.Role)
+			}
+			if tt.until == 0 {
+				if user.BannedUntil != nil {
+					t.Errorf("banned until %v, want forever", user.BannedUntil)
+				}
+				return
+			}
+			if user.BannedUntil == nil {
+				t.Fatal("banned forever")
+			}
+			if d := time.Until(*user.BannedUntil) - tt.until; d < -time.Minute || d > time.Minute {
+				t.Errorf("banned until %v", user.BannedUntil)
+			}
+		})
+	}
+}
+
+func TestAdminBanDays(t *testing.T) {
+	f := newTestServer(t)
+	_, member := login(t, f, "member")
+
+	err := runAdmin(f.store, []string{"user", "ban", member.UserID, strconv.Itoa(globalconst.MaxBanDays + 1)})
+	if err == nil || !strings.Contains(err.Error(), "at most") {
+		t.Errorf("error %v, want one about the longest ban", err)
+	}
+
+	user, err := f.store.GetUser(member.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != model.RoleMember {
+		t.Errorf("role %s after a refused ban", user.Role)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	f := newTestServer(t)
+	aliceCookie, alice := login(t, f, "alice")
+	modCookie, mod := login(t, f, "mod")
+	if err := f.store.SetUserRole(mod.UserID, model.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	forum, thread, comment := newPost(t, f, alice)
+
+	rec := postForm(f, f.editHandler, aliceCookie, "/forum/edit", url.Values{"comment_id": {comment.ID}, "content": {"edited text"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("edit comment: status %d: %s", rec.Code, rec.Body)
+	}
+
+	get := func(cookie *http.Cookie, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/forum/mod/revisions?"+query, nil)
+		r.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		f.revisionsHandler(rec, r)
+		return rec
+	}
+
+	rec = get(modCookie, "comment_id="+comment.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, comment.Content) || !strings.Contains(body, "edited text") {
+		t.Error("revisions page misses the old or the current text")
+	}
+
+	if body := getThread(t, f, modCookie, forum.NameSlug, thread.ID); !strings.Contains(body, "/forum/mod/revisions?comment_id="+comment.ID) {
+		t.Error("no history link for the moderator")
+	}
+	if body := getThread(t, f, aliceCookie, forum.NameSlug, thread.ID); strings.Contains(body, "/forum/mod/revisions") {
+		t.Error("history link shown to a member")
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		query  string
+		want   int
+	}{
+		{"member", aliceCookie, "comment_id=" + comment.ID, http.StatusForbidden},
+		{"member thread", aliceCookie, "thread_id=" + thread.ID, http.StatusForbidden},
+		{"missing comment", modCookie, "comment_id=nope", http.StatusNotFound},
+		{"missing thread", modCookie, "thread_id=nope", http.StatusNotFound},
+		{"thread", modCookie, "thread_id=" + thread.ID, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := get(tt.cookie, tt.query); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"realm/globalconst"
+	"realm/model"
+	"realm/store"
+)
+
+// dateFormat is the format of the date filters of the search form.
+const dateFormat = "2006-01-02"
+
+// searchHandler shows the search form and, when a query is given, a page
+// of results.
+func (f *forumServer) searchHandler(w http.ResponseWriter, r *http.Request) {
+	_, sd := f.currentSession(w, r)
+
+	params := r.URL.Query()
+
+	query := store.SearchQuery{
+		Text:   strings.TrimSpace(params.Get("q")),
+		Forum:  params.Get("forum"),
+		Author: strings.TrimSpace(params.Get("author")),
+		Limit:  globalconst.SearchPerPage + 1,
+	}
+
+	scope := store.SearchScope(params.Get("scope"))
+	if !scope.Valid() {
+		scope = store.SearchAll
+	}
+
+	pageNumber, err := strconv.Atoi(params.Get("page"))
+	if err != nil || pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	var message string
+	if from := params.Get("from"); from != "" {
+		query.From, err = time.Parse(dateFormat, from)
+		if err != nil {
+			message = "invalid from date, use YYYY-MM-DD"
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		query.To, err = time.Parse(dateFormat, to)
+		if err != nil {
+			message = "invalid to date, use YYYY-MM-DD"
+		}
+		// the whole day is included
+		if err == nil {
+			query.To = query.To.AddDate(0, 0, 1)
+		}
+	}
+
+	fl, err := f.store.GetForumList()
+	if err != nil {
+		log.Println(err)
+		renderError(w, sd, http.StatusInternalServerError, "")
+		return
+	}
+
+	var (
+		resultList []model.SearchResult
+		links      pageLinks
+	)
+	if query.Text != "" && message == "" {
+		resultList, err = f.store.Search(query, scope, pageNumber)
+		if err != nil {
+			log.Println(err)
+			renderError(w, sd, http.StatusInternalServerError, "")
+			return
+		}
+
+		link := func(n int) string {
+			q := url.Values{}
+			for k, v := range params {
+				q[k] = v
+			}
+			q.Set("page", strconv.Itoa(n))
+			return "?" + q.Encode()
+		}
+		if pageNumber > 1 {
+			links.Prev = link(pageNumber - 1)
+		}
+		if len(resultList) > globalconst.SearchPerPage {
+			resultList = resultList[:globalconst.SearchPerPage]
+			links.Next = link(pageNumber + 1)
+		}
+	}
+
+	data := struct {
+		page
+		Query      string
+		Scope      store.SearchScope
+		Forum      string
+		Author     string
+		From       string
+		To         string
+		ForumList  []model.Forum
+		ResultList []model.SearchResult
+		Message    string
+		Pages      pageLinks
+	}{
+		page:       newPage(sd),
+		Query:      query.Text,
+		Scope:      scope,
+		Forum:      query.Forum,
+		Author:     query.Author,
+		From:       params.Get("from"),
+		To:         params.Get("to"),
+		ForumList:  fl,
+		ResultList: resultList,
+		Message:    message,
+		Pages:      links,
+	}
+
+	renderTemplate(w, "search.html", data)
+}
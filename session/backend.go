@@ -0,0 +1,204 @@
+package session
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"realm/model"
+	"realm/store"
+)
+
+// Backend holds the session data of a Control. Implementations are safe
+// for concurrent use, Get returns store.ErrNotFound for unknown ids.
+type Backend interface {
+	Get(id string) (model.SessionData, error)
+	Save(id string, sd model.SessionData) error
+	Delete(id string) error
+	// DeleteUser deletes every session of a user.
+	DeleteUser(userID string) error
+	// GetUserSessionList lists the logged in sessions of a user that did
+	// not expire, latest used first.
+	GetUserSessionList(userID string) ([]model.SessionData, error)
+	// DeleteExpired deletes the sessions that expired before now.
+	DeleteExpired(now time.Time) error
+	// Reload drops what is kept in memory and reads the store again, for
+	// sessions changed there by another process.
+	Reload() error
+}
+
+var (
+	_ Backend = (*WriteThrough)(nil)
+	_ Backend = (*StoreOnly)(nil)
+	_ Backend = (*LRU)(nil)
+)
+
+// WriteThrough keeps every session in memory and writes the changes
+// through to the store, which is only read at startup and on Reload.
+type WriteThrough struct {
+	// write serializes the changes, so the store sees them in the order
+	// they were made to the map
+	write   sync.Mutex
+	mu      sync.RWMutex
+	store   store.SessionStore
+	dataMap map[string]model.SessionData
+}
+
+// NewWriteThrough loads the sessions saved in st.
+func NewWriteThrough(st store.SessionStore) (*WriteThrough, error) {
+	dm, err := st.LoadAllSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WriteThrough{
+		store:   st,
+		dataMap: dm,
+	}, nil
+}
+
+func (b *WriteThrough) Get(id string) (model.SessionData, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	sd, ok := b.dataMap[id]
+	if !ok {
+		return model.SessionData{}, store.ErrNotFound
+	}
+
+	return sd, nil
+}
+
+func (b *WriteThrough) Save(id string, sd model.SessionData) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.mu.Lock()
+	b.dataMap[id] = sd
+	b.mu.Unlock()
+
+	return b.store.SaveSession(id, &sd)
+}
+
+func (b *WriteThrough) Delete(id string) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.mu.Lock()
+	delete(b.dataMap, id)
+	b.mu.Unlock()
+
+	return b.store.DeleteSession(id)
+}
+
+func (b *WriteThrough) DeleteUser(userID string) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.mu.Lock()
+	for k, v := range b.dataMap {
+		if v.UserID == userID {
+			delete(b.dataMap, k)
+		}
+	}
+	b.mu.Unlock()
+
+	return b.store.DeleteUserSessions(userID)
+}
+
+func (b *WriteThrough) GetUserSessionList(userID string) ([]model.SessionData, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	var sessionList []model.SessionData
+	for id, v := range b.dataMap {
+		if v.UserID == userID && v.LoggedIn && v.ExpireAt.After(now) {
+			v.SessionID = id
+			sessionList = append(sessionList, v)
+		}
+	}
+	sort.Slice(sessionList, func(i, j int) bool {
+		a, b := sessionList[i], sessionList[j]
+		if !a.LastSeenAt.Equal(b.LastSeenAt) {
+			return a.LastSeenAt.After(b.LastSeenAt)
+		}
+		return a.SessionID < b.SessionID
+	})
+
+	return sessionList, nil
+}
+
+func (b *WriteThrough) DeleteExpired(now time.Time) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.mu.Lock()
+	for k, v := range b.dataMap {
+		if v.ExpireAt.Before(now) {
+			delete(b.dataMap, k)
+		}
+	}
+	b.mu.Unlock()
+
+	return b.store.DeleteExpiredSessions()
+}
+
+func (b *WriteThrough) Reload() error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	dm, err := b.store.LoadAllSessions()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.dataMap = dm
+	b.mu.Unlock()
+
+	return nil
+}
+
+// StoreOnly reads and writes every session in the store, so several
+// servers can share a database and sessions revoked there end at once.
+type StoreOnly struct {
+	store store.SessionStore
+}
+
+func NewStoreOnly(st store.SessionStore) *StoreOnly {
+	return &StoreOnly{store: st}
+}
+
+func (b *StoreOnly) Get(id string) (model.SessionData, error) {
+	sd, err := b.store.GetSession(id)
+	if err != nil {
+		return model.SessionData{}, err
+	}
+
+	return *sd, nil
+}
+
+func (b *StoreOnly) Save(id string, sd model.SessionData) error {
+	return b.store.SaveSession(id, &sd)
+}
+
+func (b *StoreOnly) Delete(id string) error {
+	return b.store.DeleteSession(id)
+}
+
+func (b *StoreOnly) DeleteUser(userID string) error {
+	return b.store.DeleteUserSessions(userID)
+}
+
+func (b *StoreOnly) GetUserSessionList(userID string) ([]model.SessionData, error) {
+	return b.store.GetUserSessionList(userID)
+}
+
+func (b *StoreOnly) DeleteExpired(now time.Time) error {
+	return b.store.DeleteExpiredSessions()
+}
+
+func (b *StoreOnly) Reload() error {
+	return nil
+}
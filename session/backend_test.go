@@ -0,0 +1,239 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"realm/memory"
+	"realm/model"
+	"realm/store"
+)
+
+// slowStore delays the writes to the store, so a change that reaches the
+// store out of order has time to show.
+type slowStore struct {
+	store.SessionStore
+}
+
+func pause() {
+	time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+}
+
+func (s slowStore) SaveSession(id string, sd *model.SessionData) error {
+	pause()
+	return s.SessionStore.SaveSession(id, sd)
+}
+
+func (s slowStore) DeleteSession(id string) error {
+	pause()
+	return s.SessionStore.DeleteSession(id)
+}
+
+func (s slowStore) DeleteUserSessions(userID string) error {
+	pause()
+	return s.SessionStore.DeleteUserSessions(userID)
+}
+
+// testBackend makes a backend and returns the sessions it holds in
+// memory, nil for a backend that holds none.
+type testBackend struct {
+	name   string
+	new    func(st store.SessionStore) (Backend, error)
+	cached func(b Backend) map[string]model.SessionData
+}
+
+var testBackends = []testBackend{
+	{
+		name: "memory",
+		new: func(st store.SessionStore) (Backend, error) {
+			return NewWriteThrough(st)
+		},
+		cached: func(b Backend) map[string]model.SessionData {
+			wt := b.(*WriteThrough)
+			wt.mu.RLock()
+			defer wt.mu.RUnlock()
+
+			cached := make(map[string]model.SessionData)
+			for id, sd := range wt.dataMap {
+				cached[id] = sd
+			}
+			return cached
+		},
+	},
+	{
+		name: "database",
+		new: func(st store.SessionStore) (Backend, error) {
+			return NewStoreOnly(st), nil
+		},
+		cached: func(b Backend) map[string]model.SessionData { return nil },
+	},
+	{
+		name: "lru",
+		new: func(st store.SessionStore) (Backend, error) {
+			return NewLRU(st, 8)
+		},
+		cached: func(b Backend) map[string]model.SessionData {
+			lru := b.(*LRU)
+			lru.mu.Lock()
+			defer lru.mu.Unlock()
+
+			cached := make(map[string]model.SessionData)
+			for id, e := range lru.items {
+				cached[id] = e.Value.(*lruEntry).sd
+			}
+			return cached
+		},
+	},
+}
+
+func TestBackendConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		ops     = 200
+		ids     = 24
+		users   = 4
+	)
+
+	for _, tb := range testBackends {
+		t.Run(tb.name, func(t *testing.T) {
+			st := slowStore{memory.New()}
+			b, err := tb.new(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := New("session", b, nil)
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(int64(w)))
+					for i := 0; i < ops; i++ {
+						id := fmt.Sprintf("s%d", r.Intn(ids))
+						userID := fmt.Sprintf("u%d", r.Intn(users))
+						switch r.Intn(6) {
+						case 0, 1:
+							_, err := b.Get(id)
+							if err != nil && !errors.Is(err, store.ErrNotFound) {
+								t.Error(err)
+							}
+						case 2:
+							expireAt := time.Now().Add(time.Hour)
+							if r.Intn(4) == 0 {
+								expireAt = time.Now().Add(-time.Hour)
+							}
+							err := b.Save(id, model.SessionData{
+								SessionID: id,
+								UserID:    userID,
+								LoggedIn:  true,
+								ExpireAt:  expireAt,
+								CSRFToken: fmt.Sprintf("w%d-%d", w, i),
+							})
+							if err != nil {
+								t.Error(err)
+							}
+						case 3:
+							if err := b.Delete(id); err != nil {
+								t.Error(err)
+							}
+						case 4:
+							if err := b.DeleteUser(userID); err != nil {
+								t.Error(err)
+							}
+						case 5:
+							c.RemoveExpired()
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			// every session held in memory is the one in the store
+			for id, sd := range tb.cached(b) {
+				saved, err := st.GetSession(id)
+				if err != nil {
+					t.Errorf("session %s is cached but not stored: %v", id, err)
+					continue
+				}
+				if saved.CSRFToken != sd.CSRFToken {
+					t.Errorf("session %s is cached from save %s, stored from %s", id, sd.CSRFToken, saved.CSRFToken)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendDeleteAfterSave(t *testing.T) {
+	for _, tb := range testBackends {
+		t.Run(tb.name, func(t *testing.T) {
+			st := memory.New()
+			b, err := tb.new(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sd := model.SessionData{UserID: "u1", LoggedIn: true, ExpireAt: time.Now().Add(time.Hour)}
+			if err := b.Save("s1", sd); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Delete("s1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.Get("s1"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("Get after Delete: %v", err)
+			}
+			if _, err := st.GetSession("s1"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("store GetSession after Delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendReload(t *testing.T) {
+	for _, tb := range testBackends {
+		t.Run(tb.name, func(t *testing.T) {
+			st := memory.New()
+			b, err := tb.new(st)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sd := model.SessionData{UserID: "u1", LoggedIn: true, ExpireAt: time.Now().Add(time.Hour)}
+			for _, id := range []string{"s1", "s2"} {
+				if err := b.Save(id, sd); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := b.Get(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// another process deletes s1 and adds s3
+			if err := st.DeleteSession("s1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SaveSession("s3", &sd); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := b.Reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.Get("s1"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("Get deleted session after Reload: %v", err)
+			}
+			for _, id := range []string{"s2", "s3"} {
+				if _, err := b.Get(id); err != nil {
+					t.Errorf("Get %s after Reload: %v", id, err)
+				}
+			}
+		})
+	}
+}
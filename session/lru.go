@@ -0,0 +1,165 @@
+package session
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"realm/model"
+	"realm/store"
+)
+
+// LRU caches up to size sessions in front of the store, dropping the
+// least recently used one when it is full. Writes go through to the
+// store, misses are read from it.
+type LRU struct {
+	// write serializes the changes, so the store sees them in the order
+	// they were made to the cache
+	write sync.Mutex
+	mu    sync.Mutex
+	store store.SessionStore
+	size  int
+	order *list.List // of *lruEntry, most recently used first
+	items map[string]*list.Element
+	// deletes counts the deletions, a miss read from the store is not
+	// cached if one happened meanwhile
+	deletes uint64
+}
+
+type lruEntry struct {
+	id string
+	sd model.SessionData
+}
+
+func NewLRU(st store.SessionStore, size int) (*LRU, error) {
+	if size <= 0 {
+		return nil, errors.New("session: LRU size must be positive")
+	}
+
+	return &LRU{
+		store: st,
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}, nil
+}
+
+func (b *LRU) Get(id string) (model.SessionData, error) {
+	b.mu.Lock()
+	if e, ok := b.items[id]; ok {
+		b.order.MoveToFront(e)
+		sd := e.Value.(*lruEntry).sd
+		b.mu.Unlock()
+		return sd, nil
+	}
+	deletes := b.deletes
+	b.mu.Unlock()
+
+	sd, err := b.store.GetSession(id)
+	if err != nil {
+		return model.SessionData{}, err
+	}
+
+	b.mu.Lock()
+	// a Save while the store was read wins
+	if _, ok := b.items[id]; !ok && deletes == b.deletes {
+		b.add(id, *sd)
+	}
+	b.mu.Unlock()
+
+	return *sd, nil
+}
+
+func (b *LRU) Save(id string, sd model.SessionData) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.mu.Lock()
+	b.add(id, sd)
+	b.mu.Unlock()
+
+	return b.store.SaveSession(id, &sd)
+}
+
+// add must be called with b.mu held.
+func (b *LRU) add(id string, sd model.SessionData) {
+	if e, ok := b.items[id]; ok {
+		e.Value.(*lruEntry).sd = sd
+		b.order.MoveToFront(e)
+		return
+	}
+
+	b.items[id] = b.order.PushFront(&lruEntry{id: id, sd: sd})
+
+	if b.order.Len() > b.size {
+		last := b.order.Back()
+		b.order.Remove(last)
+		delete(b.items, last.Value.(*lruEntry).id)
+	}
+}
+
+func (b *LRU) Delete(id string) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.mu.Lock()
+	b.deletes++
+	if e, ok := b.items[id]; ok {
+		b.order.Remove(e)
+		delete(b.items, id)
+	}
+	b.mu.Unlock()
+
+	return b.store.DeleteSession(id)
+}
+
+func (b *LRU) DeleteUser(userID string) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.removeIf(func(sd model.SessionData) bool { return sd.UserID == userID })
+
+	return b.store.DeleteUserSessions(userID)
+}
+
+// GetUserSessionList reads the store, which has every session.
+func (b *LRU) GetUserSessionList(userID string) ([]model.SessionData, error) {
+	return b.store.GetUserSessionList(userID)
+}
+
+func (b *LRU) DeleteExpired(now time.Time) error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.removeIf(func(sd model.SessionData) bool { return sd.ExpireAt.Before(now) })
+
+	return b.store.DeleteExpiredSessions()
+}
+
+// Reload empties the cache, the sessions are read from the store again
+// as they are used.
+func (b *LRU) Reload() error {
+	b.write.Lock()
+	defer b.write.Unlock()
+
+	b.removeIf(func(sd model.SessionData) bool { return true })
+
+	return nil
+}
+
+func (b *LRU) removeIf(match func(sd model.SessionData) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deletes++
+	for e := b.order.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*lruEntry)
+		if match(entry.sd) {
+			b.order.Remove(e)
+			delete(b.items, entry.id)
+		}
+		e = next
+	}
+}
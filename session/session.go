@@ -1,34 +1,55 @@
 package session
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"realm/globalconst"
 	"realm/model"
-	"realm/sqlite"
+	"realm/store"
 	"realm/util"
 )
 
-var (
-	SC *Control // Session Control
-)
-
+// Control reads and writes the session cookie and keeps the session data
+// in a Backend. It is safe for concurrent use.
 type Control struct {
 	cookieName string
-	DataMap    map[string]model.SessionData
+	backend    Backend
+	// secret signs the cookie with HMAC-SHA256 when set
+	secret []byte
+	// tokenKey signs the connection tokens
+	tokenKey []byte
 }
 
-func New(cookieName string) {
-	dm, err := sqlite.DB.LoadAllSessions()
-	if err != nil {
-		panic(err)
+// New returns a Control for backend. Cookies are signed with secret, or
+// hold the bare session id when secret is empty. Connection tokens are
+// signed with a key derived from secret, or with a random key that does
+// not outlive the process when secret is empty.
+func New(cookieName string, backend Backend, secret []byte) *Control {
+	tokenKey := make([]byte, sha256.Size)
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("connection token"))
+		tokenKey = mac.Sum(nil)
+	} else if _, err := rand.Read(tokenKey); err != nil {
+		panic("session: crypto/rand failed: " + err.Error())
 	}
 
-	SC = &Control{
+	return &Control{
 		cookieName: cookieName,
-		DataMap:    dm,
+		backend:    backend,
+		secret:     secret,
+		tokenKey:   tokenKey,
 	}
 }
 
@@ -44,32 +65,62 @@ func (c *Control) Get(r *http.Request) (string, *model.SessionData, bool) {
 		return "", nil, false
 	}
 
-	s, ok := c.DataMap[cookie.Value]
+	id, ok := c.verify(cookie.Value)
 	if !ok {
 		return "", nil, false
 	}
 
+	s, err := c.backend.Get(id)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("GetSession: %v\n", err)
+		}
+		return "", nil, false
+	}
+
 	if s.ExpireAt.Before(time.Now()) {
-		delete(c.DataMap, cookie.Value)
-		err = sqlite.DB.DeleteSession(cookie.Value)
+		err = c.backend.Delete(id)
 		if err != nil {
 			log.Printf("DeleteSession: %v\n", err)
 		}
 		return "", nil, false
 	}
 
-	return cookie.Value, &s, true
+	return id, &s, true
 }
 
-func (c *Control) Delete(w http.ResponseWriter, id string) {
-	delete(c.DataMap, id)
+// sign returns the cookie value of a session id.
+func (c *Control) sign(id string) string {
+	if len(c.secret) == 0 {
+		return id
+	}
+
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(id))
 
-	err := sqlite.DB.DeleteSession(id)
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session id of a cookie value, ok is false if the
+// signature does not match.
+func (c *Control) verify(value string) (string, bool) {
+	if len(c.secret) == 0 {
+		return value, true
+	}
+
+	id, _, _ := strings.Cut(value, ".")
+
+	return id, hmac.Equal([]byte(value), []byte(c.sign(id)))
+}
+
+func (c *Control) Delete(w http.ResponseWriter, id string) {
+	err := c.backend.Delete(id)
 	if err != nil {
 		log.Printf("DeleteSession: %v\n", err)
 	}
 
 	cookie := http.Cookie{
+		Path:   "/",
 		Name:   c.cookieName,
 		Value:  "",
 		MaxAge: -1,
@@ -77,22 +128,28 @@ func (c *Control) Delete(w http.ResponseWriter, id string) {
 	http.SetCookie(w, &cookie)
 }
 
-func (c *Control) Save(w http.ResponseWriter, id string, sessionData *model.SessionData) {
-	expireAt := time.Now().Add(globalconst.TimeToExpire * time.Second)
+// Save renews a session and its cookie, recording the device of the
+// request as the last one to use it.
+func (c *Control) Save(w http.ResponseWriter, r *http.Request, id string, sessionData *model.SessionData) {
+	now := time.Now()
+	expireAt := now.Add(globalconst.TimeToExpire * time.Second)
 	cookie := &http.Cookie{
 		Path:     "/",
 		Name:     c.cookieName,
-		Value:    id,
+		Value:    c.sign(id),
 		Expires:  expireAt,
 		Secure:   true,
 		HttpOnly: true,
-		SameSite: http.SameSiteDefaultMode,
+		SameSite: http.SameSiteLaxMode,
 	}
 
+	sessionData.SessionID = id
 	sessionData.ExpireAt = expireAt
-	c.DataMap[id] = *sessionData
+	sessionData.UserAgent = r.UserAgent()
+	sessionData.IP = remoteIP(r)
+	sessionData.LastSeenAt = now.UTC().Truncate(time.Second)
 
-	err := sqlite.DB.SaveSession(id, sessionData)
+	err := c.backend.Save(id, *sessionData)
 	if err != nil {
 		log.Printf("SaveSession: %v\n", err)
 	}
@@ -100,32 +157,195 @@ func (c *Control) Save(w http.ResponseWriter, id string, sessionData *model.Sess
 	http.SetCookie(w, cookie)
 }
 
+// remoteIP returns the address of the client, or of the last proxy.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (c *Control) Create() (string, *model.SessionData) {
+	id := util.RandomID()
 	sessionData := &model.SessionData{
-		ExpireAt: time.Now().Add(globalconst.TimeToExpire * time.Second),
+		SessionID: id,
+		ExpireAt:  time.Now().Add(globalconst.TimeToExpire * time.Second),
+		CSRFToken: util.RandomID(),
 	}
 
-	rand := util.RandomID()
-
-	c.DataMap[rand] = *sessionData
-
-	err := sqlite.DB.SaveSession(rand, sessionData)
+	err := c.backend.Save(id, *sessionData)
 	if err != nil {
 		log.Printf("SaveSession: %v\n", err)
 	}
 
-	return rand, sessionData
+	return id, sessionData
 }
 
-func (c *Control) RemoveExpired() {
-	for k, v := range c.DataMap {
-		if v.ExpireAt.Before(time.Now()) {
-			delete(c.DataMap, k)
+// Rotate moves the data of session oldID, which may be empty, to a new
+// id with a new CSRF token and sets the cookie, so an id seen before a
+// login or logout is worthless after it. It returns the new id.
+func (c *Control) Rotate(w http.ResponseWriter, r *http.Request, oldID string, sessionData *model.SessionData) string {
+	if oldID != "" {
+		err := c.backend.Delete(oldID)
+		if err != nil {
+			log.Printf("DeleteSession: %v\n", err)
 		}
 	}
 
-	err := sqlite.DB.DeleteExpiredSessions()
+	id := util.RandomID()
+	sessionData.CSRFToken = util.RandomID()
+	c.Save(w, r, id, sessionData)
+
+	return id
+}
+
+func (c *Control) RemoveExpired() {
+	err := c.backend.DeleteExpired(time.Now())
 	if err != nil {
 		log.Printf("DeleteExpiredSessions: %v\n", err)
 	}
 }
+
+// Reload makes the backend read the sessions from the store again, so
+// the ones deleted there by another process, such as the admin command,
+// end.
+func (c *Control) Reload() {
+	err := c.backend.Reload()
+	if err != nil {
+		log.Printf("LoadAllSessions: %v\n", err)
+	}
+}
+
+// RemoveUser ends every session of a user.
+func (c *Control) RemoveUser(userID string) {
+	err := c.backend.DeleteUser(userID)
+	if err != nil {
+		log.Printf("DeleteUserSessions: %v\n", err)
+	}
+}
+
+// Device is a logged in session as shown to its user, Handle names it
+// without revealing the session id.
+type Device struct {
+	Handle     string
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	Current    bool
+}
+
+// Handle returns the name of a session on the devices page.
+func Handle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Devices lists the logged in sessions of a user, currentID is the
+// session of the request.
+func (c *Control) Devices(userID, currentID string) ([]Device, error) {
+	sessionList, err := c.backend.GetUserSessionList(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(sessionList))
+	for _, sd := range sessionList {
+		devices = append(devices, Device{
+			Handle:     Handle(sd.SessionID),
+			UserAgent:  sd.UserAgent,
+			IP:         sd.IP,
+			LastSeenAt: sd.LastSeenAt,
+			Current:    sd.SessionID == currentID,
+		})
+	}
+
+	return devices, nil
+}
+
+// Revoke ends the session of a user named by handle and returns its id,
+// it returns store.ErrNotFound if the user has no such session.
+func (c *Control) Revoke(userID, handle string) (string, error) {
+	sessionList, err := c.backend.GetUserSessionList(userID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, sd := range sessionList {
+		if hmac.Equal([]byte(Handle(sd.SessionID)), []byte(handle)) {
+			return sd.SessionID, c.backend.Delete(sd.SessionID)
+		}
+	}
+
+	return "", store.ErrNotFound
+}
+
+// Active reports whether the session id exists and did not expire.
+func (c *Control) Active(id string) bool {
+	s, err := c.backend.Get(id)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("GetSession: %v\n", err)
+		}
+		return false
+	}
+
+	return !s.ExpireAt.Before(time.Now())
+}
+
+// TokenTTL is how long a connection token can be used to connect.
+const TokenTTL = 5 * time.Minute
+
+// Token returns a connection token for the logged in session id, for
+// clients that cannot send the cookie. It names the user and the session
+// handle, so revoking the session also voids its tokens.
+func (c *Control) Token(id string, sessionData *model.SessionData) (string, time.Time) {
+	expireAt := time.Now().Add(TokenTTL).Truncate(time.Second)
+	payload := sessionData.UserID + "." + Handle(id) + "." + strconv.FormatInt(expireAt.Unix(), 10)
+
+	return payload + "." + c.tokenMAC(payload), expireAt
+}
+
+func (c *Control) tokenMAC(payload string) string {
+	mac := hmac.New(sha256.New, c.tokenKey)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// FromToken returns the session of a connection token, ok is false if
+// the token is invalid or expired, or the session ended.
+func (c *Control) FromToken(token string) (string, *model.SessionData, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", nil, false
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(c.tokenMAC(payload))) {
+		return "", nil, false
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return "", nil, false
+	}
+	userID, handle := parts[0], parts[1]
+	expireAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expireAt {
+		return "", nil, false
+	}
+
+	sessionList, err := c.backend.GetUserSessionList(userID)
+	if err != nil {
+		log.Printf("GetUserSessionList: %v\n", err)
+		return "", nil, false
+	}
+
+	for _, sd := range sessionList {
+		if Handle(sd.SessionID) == handle {
+			return sd.SessionID, &sd, true
+		}
+	}
+
+	return "", nil, false
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"realm/memory"
+	"realm/model"
+)
+
+// newTestControl returns a Control on a memory store with a logged in
+// session and the id of that session.
+func newTestControl(t *testing.T) (*Control, string, *model.SessionData) {
+	t.Helper()
+
+	b, err := NewWriteThrough(memory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New("session", b, []byte("secret"))
+
+	sd := &model.SessionData{UserID: "u1", UserName: "alice", LoggedIn: true}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	id := c.Rotate(httptest.NewRecorder(), r, "", sd)
+
+	return c, id, sd
+}
+
+func TestToken(t *testing.T) {
+	c, id, sd := newTestControl(t)
+
+	token, expireAt := c.Token(id, sd)
+	if d := time.Until(expireAt); d <= 0 || d > TokenTTL {
+		t.Errorf("token expires in %s, want within %s", d, TokenTTL)
+	}
+	gotID, got, ok := c.FromToken(token)
+	if !ok || gotID != id || got.UserID != sd.UserID {
+		t.Fatalf("FromToken = %q, %+v, %v, want session %q", gotID, got, ok, id)
+	}
+
+	i := strings.LastIndexByte(token, '.')
+	payload, sig := token[:i], token[i+1:]
+	parts := strings.Split(payload, ".")
+
+	// same sessions, other key
+	other := New("session", c.backend, []byte("other secret"))
+	otherToken, _ := other.Token(id, sd)
+
+	// signed by c, so only the expiry decides
+	expired := parts[0] + "." + parts[1] + "." + strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	expired += "." + c.tokenMAC(expired)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", payload},
+		{"empty signature", payload + "."},
+		{"other signature", payload + "." + other.tokenMAC(payload)},
+		{"signed with another key", otherToken},
+		{"other user", "u2." + parts[1] + "." + parts[2] + "." + sig},
+		{"other handle", parts[0] + "." + Handle("s2") + "." + parts[2] + "." + sig},
+		{"later expiry", parts[0] + "." + parts[1] + "." + strconv.FormatInt(expireAt.Add(time.Hour).Unix(), 10) + "." + sig},
+		{"extra field", payload + ".x." + sig},
+		{"expired", expired},
+	}
+	for _, tt := range tests {
+		if _, _, ok := c.FromToken(tt.token); ok {
+			t.Errorf("%s: FromToken(%q) accepted", tt.name, tt.token)
+		}
+	}
+
+	// the token of the other control is valid there, only the key differs
+	if _, _, ok := other.FromToken(otherToken); !ok {
+		t.Error("token rejected by the control that signed it")
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	c, id, sd := newTestControl(t)
+	token, _ := c.Token(id, sd)
+
+	revoked, err := c.Revoke(sd.UserID, Handle(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != id {
+		t.Errorf("revoked %q, want %q", revoked, id)
+	}
+	if _, _, ok := c.FromToken(token); ok {
+		t.Error("token of a revoked session accepted")
+	}
+}
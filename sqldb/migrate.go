@@ -0,0 +1,295 @@
+package sqldb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSchemaTooNew is returned by CheckSchema when the database was
+// migrated by a newer binary.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// ErrSchemaOutdated is returned by CheckSchema when some migrations were
+// not applied to the database yet.
+var ErrSchemaOutdated = errors.New("database schema has pending migrations")
+
+// Migrator is implemented by Store, backends embedding it expose the
+// migration operations to the server.
+type Migrator interface {
+	SchemaVersion() (int, error)
+	CheckSchema() error
+	MigrationStatus() ([]MigrationStatus, error)
+	MigrateUp() error
+	MigrateDown() error
+	MigrateTo(version int) error
+}
+
+// Migration is a schema change, read from the files NNNN_name.up.sql and
+// NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a known migration and when it was applied, AppliedAt
+// is zero if it is pending.
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Migrations returns the migrations of the backend ordered by version.
+func (s *Store) Migrations() ([]Migration, error) {
+	files, err := fs.Glob(s.migrations, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, base := range files {
+		name, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q", base)
+		}
+
+		prefix, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", base)
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", base)
+		}
+
+		b, err := fs.ReadFile(s.migrations, base)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names, %q and %q", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+func (s *Store) createMigrationTable() error {
+	sqlStatement := s.sql(`
+	create table if not exists schema_migrations (
+		version integer primary key,
+		name text not null,
+		applied_at {{timestamp}} not null
+	);`)
+
+	_, err := s.DB.Exec(sqlStatement)
+
+	return err
+}
+
+// SchemaVersion returns the version of the last applied migration, zero
+// for a new database.
+func (s *Store) SchemaVersion() (int, error) {
+	err := s.createMigrationTable()
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = s.DB.Get(&version, `select coalesce(max(version), 0) from schema_migrations;`)
+
+	return version, err
+}
+
+// CheckSchema returns ErrSchemaTooNew if the database has migrations this
+// binary does not know about, and ErrSchemaOutdated if it lacks some.
+func (s *Store) CheckSchema() error {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return err
+	}
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("%w: database is at version %d, latest known is %d",
+			ErrSchemaTooNew, version, len(migrations))
+	}
+
+	if version < len(migrations) {
+		return fmt.Errorf("%w: database is at version %d, latest is %d",
+			ErrSchemaOutdated, version, len(migrations))
+	}
+
+	return nil
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func (s *Store) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.createMigrationTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	err = s.DB.Select(&applied, `select version, applied_at from schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[int]time.Time)
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	var statusList []MigrationStatus
+	for _, m := range migrations {
+		statusList = append(statusList, MigrationStatus{
+			Migration: m,
+			AppliedAt: appliedAt[m.Version],
+		})
+	}
+
+	return statusList, nil
+}
+
+// MigrateUp applies every pending migration.
+func (s *Store) MigrateUp() error {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return err
+	}
+
+	return s.MigrateTo(len(migrations))
+}
+
+// MigrateDown reverts the last applied migration.
+func (s *Store) MigrateDown() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return nil
+	}
+
+	return s.MigrateTo(version - 1)
+}
+
+// MigrateTo applies or reverts migrations, one transaction each, until the
+// schema is at the given version.
+func (s *Store) MigrateTo(version int) error {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return err
+	}
+
+	if version < 0 || version > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, latest known is %d", version, len(migrations))
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("%w: database is at version %d, latest known is %d",
+			ErrSchemaTooNew, current, len(migrations))
+	}
+
+	for current < version {
+		m := migrations[current]
+		err = s.applyMigration(m.Up,
+			s.sql(`insert into schema_migrations (version, name, applied_at) values ($1, $2, {{now}});`),
+			m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("migration %d %s up: %w", m.Version, m.Name, err)
+		}
+		current++
+	}
+
+	for current > version {
+		m := migrations[current-1]
+		if m.Down == "" {
+			return fmt.Errorf("migration %d %s has no down file", m.Version, m.Name)
+		}
+		err = s.applyMigration(m.Down,
+			`delete from schema_migrations where version = $1 and name = $2;`,
+			m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("migration %d %s down: %w", m.Version, m.Name, err)
+		}
+		current--
+	}
+
+	return nil
+}
+
+func (s *Store) applyMigration(script, record string, version int, name string) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(script)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(record, version, name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,1454 @@
+// Package sqldb implements store.Store on top of database/sql. The SQL is
+// shared by the sqlite and postgres backends, the differences between them
+// are described by a Dialect.
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"realm/model"
+	"realm/store"
+	"realm/util"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Dialect holds the SQL that differs between databases.
+type Dialect struct {
+	Name string
+	// Now is the expression for the current UTC time.
+	Now string
+	// Timestamp is the column type for date and time.
+	Timestamp string
+}
+
+type Store struct {
+	DB         *sqlx.DB
+	dialect    Dialect
+	migrations fs.FS
+}
+
+// Store implements everything in store.Store but Search, the backends
+// embedding it provide their own full text search.
+var _ Migrator = (*Store)(nil)
+
+// New returns a Store using db, migrations holds the NNNN_name.up.sql and
+// NNNN_name.down.sql files of the backend.
+func New(db *sqlx.DB, dialect Dialect, migrations fs.FS) *Store {
+	return &Store{
+		DB:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}
+}
+
+// Dialect returns the dialect the store was created with.
+func (s *Store) Dialect() Dialect {
+	return s.dialect
+}
+
+// sql replaces the dialect placeholders in a statement.
+func (s *Store) sql(statement string) string {
+	return strings.NewReplacer(
+		"{{now}}", s.dialect.Now,
+		"{{timestamp}}", s.dialect.Timestamp,
+	).Replace(statement)
+}
+
+func (s *Store) Close() error {
+	return s.DB.Close()
+}
+
+func (s *Store) SaveUser(user *model.User) (model.User, error) {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return *user, err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.Get(&id, s.sql(`
+	select user_id from user_identity
+	where oauth_provider = $1
+	and oauth_user_id = $2;`),
+		user.OAuthProvider, // 1
+		user.OAuthUserID)   // 2
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		return *user, err
+	}
+
+	user.ID = id
+
+	if user.ID == "" {
+		// insert
+		sqlStatement := s.sql(`
+		insert into "user" (
+			id,
+			oauth_provider,
+			oauth_user_id,
+			user_name,
+			avatar_url
+		) values (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5
+		);`)
+
+		user.ID = util.RandomID()
+		_, err = tx.Exec(sqlStatement,
+			user.ID,
+			user.OAuthProvider,
+			user.OAuthUserID,
+			user.UserName,
+			user.AvatarURL)
+		if err != nil {
+			return *user, err
+		}
+
+		err = s.insertUserIdentity(tx, &model.UserIdentity{
+			OAuthProvider: user.OAuthProvider,
+			OAuthUserID:   user.OAuthUserID,
+			UserID:        user.ID,
+			UserName:      user.UserName,
+		})
+		if err != nil {
+			return *user, err
+		}
+
+		return *user, tx.Commit()
+	}
+
+	// update
+	sqlStatement := s.sql(`
+	update "user" set
+		user_name = $1,
+		avatar_url = $2
+	where id = $3;`)
+
+	_, err = tx.Exec(sqlStatement,
+		user.UserName,
+		user.AvatarURL,
+		user.ID)
+	if err != nil {
+		return *user, err
+	}
+
+	_, err = tx.Exec(s.sql(`
+	update user_identity set
+		user_name = $1
+	where oauth_provider = $2
+	and oauth_user_id = $3;`),
+		user.UserName,
+		user.OAuthProvider,
+		user.OAuthUserID)
+	if err != nil {
+		return *user, err
+	}
+
+	return *user, tx.Commit()
+}
+
+func (s *Store) GetUser(id string) (*model.User, error) {
+	sqlStatement := s.sql(`select * from "user" where id = $1;`)
+
+	var user model.User
+	err := s.DB.Get(&user, sqlStatement, id)
+
+	return &user, err
+}
+
+func (s *Store) GetUserFromOAuthID(oauthProvider string, oauthUserID string) (*model.User, error) {
+	sqlStatement := s.sql(`select u.*
+	from "user" u
+	join user_identity i on i.user_id = u.id
+	where i.oauth_provider = $1 
+	and i.oauth_user_id = $2;`)
+
+	var user model.User
+	err := s.DB.Get(&user,
+		sqlStatement,
+		oauthProvider, // 1
+		oauthUserID)   // 2
+
+	return &user, err
+}
+
+func (s *Store) GetUserIdentityList(userID string) ([]model.UserIdentity, error) {
+	sqlStatement := s.sql(`select * from user_identity
+	where user_id = $1
+	order by created_at, oauth_provider, oauth_user_id;`)
+
+	var identityList []model.UserIdentity
+	err := s.DB.Select(&identityList, sqlStatement, userID)
+
+	return identityList, err
+}
+
+// LinkUserIdentity links an identity to identity.UserID, it returns
+// store.ErrIdentityLinked if another user has it.
+func (s *Store) LinkUserIdentity(identity *model.UserIdentity) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.Get(&userID, s.sql(`
+	select user_id from user_identity
+	where oauth_provider = $1
+	and oauth_user_id = $2;`),
+		identity.OAuthProvider,
+		identity.OAuthUserID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		err = s.insertUserIdentity(tx, identity)
+	case err != nil:
+		return err
+	case userID != identity.UserID:
+		return store.ErrIdentityLinked
+	default:
+		_, err = tx.Exec(s.sql(`
+		update user_identity set
+			user_name = $1
+		where oauth_provider = $2
+		and oauth_user_id = $3;`),
+			identity.UserName,
+			identity.OAuthProvider,
+			identity.OAuthUserID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) insertUserIdentity(tx *sqlx.Tx, identity *model.UserIdentity) error {
+	sqlStatement := s.sql(`
+	insert into user_identity (
+		oauth_provider,
+		oauth_user_id,
+		user_id,
+		user_name,
+		created_at
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		{{now}}
+	);`)
+
+	_, err := tx.Exec(sqlStatement,
+		identity.OAuthProvider,
+		identity.OAuthUserID,
+		identity.UserID,
+		identity.UserName)
+
+	return err
+}
+
+// UnlinkUserIdentity removes an identity of userID, it returns
+// store.ErrLastIdentity if it is the only one.
+func (s *Store) UnlinkUserIdentity(userID, oauthProvider, oauthUserID string) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(s.sql(`
+	delete from user_identity
+	where user_id = $1
+	and oauth_provider = $2
+	and oauth_user_id = $3;`),
+		userID,
+		oauthProvider,
+		oauthUserID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return store.ErrNotFound
+	}
+
+	var count int
+	err = tx.Get(&count, s.sql(`select count(*) from user_identity where user_id = $1;`), userID)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return store.ErrLastIdentity
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) MergeUsers(intoID, fromID string) error {
+	if intoID == fromID {
+		return fmt.Errorf("cannot merge user %q into itself", intoID)
+	}
+
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range []string{intoID, fromID} {
+		var found string
+		err = tx.Get(&found, s.sql(`select id from "user" where id = $1;`), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a forum both users moderate would be a duplicate key
+	_, err = tx.Exec(s.sql(`
+	delete from forum_moderator
+	where user_id = $1
+	and forum_name in (select forum_name from forum_moderator where user_id = $2);`), fromID, intoID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"user_identity", "thread", "comment", "revision", "chat_message", "forum_moderator", "audit_log"} {
+		_, err = tx.Exec(s.sql(`update `+table+` set user_id = $1 where user_id = $2;`), intoID, fromID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(s.sql(`delete from session where user_id = $1;`), fromID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.sql(`delete from "user" where id = $1;`), fromID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) SaveSession(sessionID string, sd *model.SessionData) error {
+	// insert ou update
+	sqlStatement := s.sql(`
+	insert into session (
+		session_id,			-- 1
+		user_id,			-- 2
+		expire_at,			-- 3
+		logged_in,			-- 4
+		oauth_provider,		-- 5
+		oauth_user_id,		-- 6
+		user_name,			-- 7
+		avatar_url,			-- 8
+		csrf_token,			-- 9
+		user_agent,			-- 10
+		ip,					-- 11
+		last_seen_at		-- 12
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		$5,
+		$6,
+		$7,
+		$8,
+		$9,
+		$10,
+		$11,
+		$12
+	) on conflict(session_id) do update set
+		user_id = $2,
+		expire_at = $3,
+		logged_in = $4,
+		oauth_provider = $5,
+		oauth_user_id = $6,
+		user_name = $7,
+		avatar_url = $8,
+		csrf_token = $9,
+		user_agent = $10,
+		ip = $11,
+		last_seen_at = $12;`)
+
+	_, err := s.DB.Exec(sqlStatement,
+		sessionID,        // 1
+		sd.UserID,        // 2
+		sd.ExpireAt,      // 3
+		sd.LoggedIn,      // 4
+		sd.OAuthProvider, // 5
+		sd.OAuthUserID,   // 6
+		sd.UserName,      // 7
+		sd.AvatarURL,     // 8
+		sd.CSRFToken,     // 9
+		sd.UserAgent,     // 10
+		sd.IP,            // 11
+		sd.LastSeenAt)    // 12
+
+	return err
+}
+
+func (s *Store) DeleteSession(sessionID string) error {
+	sqlStatement := s.sql(`delete from session where session_id = $1;`)
+
+	_, err := s.DB.Exec(sqlStatement, sessionID)
+
+	return err
+}
+
+func (s *Store) GetSession(sessionID string) (*model.SessionData, error) {
+	sqlStatement := s.sql(`select * from session where session_id = $1;`)
+
+	var data model.SessionData
+	err := s.DB.Get(&data, sqlStatement, sessionID)
+
+	return &data, err
+}
+
+func (s *Store) GetUserSessionList(userID string) ([]model.SessionData, error) {
+	sqlStatement := s.sql(`select * from session
+	where user_id = $1
+	and logged_in = true
+	and expire_at > {{now}}
+	order by last_seen_at desc, session_id;`)
+
+	var sessionList []model.SessionData
+	err := s.DB.Select(&sessionList, sqlStatement, userID)
+
+	return sessionList, err
+}
+
+func (s *Store) DeleteExpiredSessions() error {
+	sqlStatement := s.sql(`delete from session where expire_at < {{now}};`)
+
+	_, err := s.DB.Exec(sqlStatement)
+
+	return err
+}
+
+func (s *Store) DeleteUserSessions(userID string) error {
+	sqlStatement := s.sql(`delete from session where user_id = $1;`)
+
+	_, err := s.DB.Exec(sqlStatement, userID)
+
+	return err
+}
+
+func (s *Store) DeleteAllSessions() error {
+	sqlStatement := s.sql(`delete from session;`)
+
+	_, err := s.DB.Exec(sqlStatement)
+
+	return err
+}
+
+func (s *Store) LoadAllSessions() (map[string]model.SessionData, error) {
+
+	var (
+		sqlStatement   = s.sql(`select * from session where expire_at > {{now}};`)
+		sessionDataMap = make(map[string]model.SessionData)
+		sessionData    []model.SessionData
+		err            error
+	)
+	err = s.DB.Select(&sessionData, sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sd := range sessionData {
+		sessionDataMap[sd.SessionID] = sd
+	}
+
+	return sessionDataMap, nil
+}
+
+/////////////////////////////////////////////////////////////////
+// forum
+
+func (s *Store) CreateForum(forum *model.Forum) error {
+	slug, err := s.uniqueSlug(forum.Name, "forum", `select count(*) from forum where name_slug = $1;`, store.ReservedForumSlugs)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	insert into forum (
+		name,
+		name_slug,
+		description,
+		sort_order,
+		category_slug,
+		archived
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		$5,
+		$6
+	);`)
+
+	_, err = s.DB.Exec(sqlStatement,
+		forum.Name,
+		slug,
+		forum.Description,
+		forum.SortOrder,
+		forum.CategorySlug,
+		forum.Archived)
+	if err != nil {
+		return err
+	}
+
+	forum.NameSlug = slug
+
+	return nil
+}
+
+// uniqueSlug returns a slug of name that count, a query counting the
+// rows with the slug in $1, does not find and that is not reserved.
+// fallback is the slug of names without letters or digits.
+func (s *Store) uniqueSlug(name, fallback, count string, reserved []string) (string, error) {
+	base := util.Slugify(name)
+	if base == "" {
+		base = fallback
+	}
+
+	return util.UniqueSlug(base, func(slug string) (bool, error) {
+		if slices.Contains(reserved, slug) {
+			return true, nil
+		}
+
+		var n int
+		err := s.DB.Get(&n, s.sql(count), slug)
+
+		return n > 0, err
+	})
+}
+
+func (s *Store) GetForum(name string) (*model.Forum, error) {
+	sqlStatement := s.sql(`select * from forum where name_slug = $1;`)
+
+	var forum model.Forum
+	err := s.DB.Get(&forum, sqlStatement, strings.ToLower(name))
+
+	return &forum, err
+}
+
+func (s *Store) GetForumList() ([]model.Forum, error) {
+	sqlStatement := s.sql(`select * from forum order by sort_order, name, name_slug;`)
+
+	var forumList []model.Forum
+	err := s.DB.Select(&forumList, sqlStatement)
+
+	return forumList, err
+}
+
+func (s *Store) UpdateForum(forum *model.Forum) error {
+	sqlStatement := s.sql(`
+	update forum set
+		name = $1,
+		description = $2,
+		sort_order = $3,
+		category_slug = $4,
+		archived = $5
+	where name_slug = $6;`)
+
+	return s.execOne(sqlStatement,
+		forum.Name,
+		forum.Description,
+		forum.SortOrder,
+		forum.CategorySlug,
+		forum.Archived,
+		forum.NameSlug)
+}
+
+func (s *Store) DeleteForum(name string) error {
+	sqlStatement := s.sql(`delete from forum where name_slug = $1;`)
+
+	_, err := s.DB.Exec(sqlStatement, strings.ToLower(name))
+
+	return err
+}
+
+func (s *Store) GetForumViewList() ([]model.ForumView, error) {
+	sqlStatement := s.sql(`select
+		f.*,
+		(select count(*) from thread t
+			where t.forum_name = f.name_slug and t.deleted = false) as thread_count,
+		(select count(*) from thread t
+			where t.forum_name = f.name_slug and t.deleted = false)
+		+ (select count(*) from comment c join thread t on t.id = c.thread_id
+			where t.forum_name = f.name_slug and t.deleted = false and c.deleted = false) as post_count,
+		coalesce(l.id, '') as last_thread_id,
+		coalesce(l.title, '') as last_thread_title,
+		coalesce((select u.user_name from comment c join "user" u on u.id = c.user_id
+			where c.thread_id = l.id and c.deleted = false
+			order by c.seq desc limit 1), lu.user_name, '') as last_user_name,
+		l.last_post_at
+	from forum f
+	left join thread l on l.id = (select t.id from thread t
+		where t.forum_name = f.name_slug and t.deleted = false
+		order by t.last_post_at desc, t.id desc limit 1)
+	left join "user" lu on lu.id = l.user_id
+	order by f.sort_order, f.name, f.name_slug;`)
+
+	var forumList []model.ForumView
+	err := s.DB.Select(&forumList, sqlStatement)
+
+	return forumList, err
+}
+
+/////////////////////////////////////////////////////////////////
+// category
+
+func (s *Store) CreateCategory(category *model.Category) error {
+	slug, err := s.uniqueSlug(category.Name, "category", `select count(*) from category where name_slug = $1;`, nil)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	insert into category (
+		name_slug,
+		name,
+		sort_order
+	) values (
+		$1,
+		$2,
+		$3
+	);`)
+
+	_, err = s.DB.Exec(sqlStatement, slug, category.Name, category.SortOrder)
+	if err != nil {
+		return err
+	}
+
+	category.NameSlug = slug
+
+	return nil
+}
+
+func (s *Store) GetCategory(name string) (*model.Category, error) {
+	sqlStatement := s.sql(`select * from category where name_slug = $1;`)
+
+	var category model.Category
+	err := s.DB.Get(&category, sqlStatement, strings.ToLower(name))
+
+	return &category, err
+}
+
+func (s *Store) GetCategoryList() ([]model.Category, error) {
+	sqlStatement := s.sql(`select * from category order by sort_order, name, name_slug;`)
+
+	var categoryList []model.Category
+	err := s.DB.Select(&categoryList, sqlStatement)
+
+	return categoryList, err
+}
+
+func (s *Store) UpdateCategory(category *model.Category) error {
+	sqlStatement := s.sql(`update category set name = $1, sort_order = $2 where name_slug = $3;`)
+
+	return s.execOne(sqlStatement, category.Name, category.SortOrder, category.NameSlug)
+}
+
+func (s *Store) DeleteCategory(name string) error {
+	name = strings.ToLower(name)
+
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.sql(`update forum set category_slug = '' where category_slug = $1;`), name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.sql(`delete from category where name_slug = $1;`), name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) CreateThread(thread *model.Thread) error {
+	sqlStatement := s.sql(`
+	insert into thread (
+		id,
+		forum_name,
+		title,
+		content,
+		user_id,
+		created_at,
+		updated_at,
+		last_post_at
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		$5,
+		{{now}},
+		{{now}},
+		{{now}}
+	);`)
+
+	_, err := s.DB.Exec(sqlStatement,
+		thread.ID,
+		thread.ForumName,
+		thread.Title,
+		thread.Content,
+		thread.UserID)
+
+	return err
+}
+
+func (s *Store) GetThread(id string) (*model.Thread, error) {
+	sqlStatement := s.sql(`select * from thread where id = $1;`)
+
+	var thread model.Thread
+	err := s.DB.Get(&thread, sqlStatement, id)
+
+	return &thread, err
+}
+
+func (s *Store) GetThreadList(forumName string) ([]model.Thread, error) {
+	sqlStatement := s.sql(`select * from thread
+	where forum_name = $1
+	order by last_post_at desc, id desc;`)
+
+	var threadList []model.Thread
+	err := s.DB.Select(&threadList, sqlStatement, forumName)
+
+	return threadList, err
+}
+
+func (s *Store) GetThreadView(id string) (*model.ThreadView, error) {
+	sqlStatement := s.sql(`select
+		t.*,
+		coalesce(u.user_name, '') as user_name,
+		(select count(*) from comment c where c.thread_id = t.id and c.deleted = false) as comment_count
+	from thread t
+	left join "user" u on u.id = t.user_id
+	where t.id = $1;`)
+
+	var thread model.ThreadView
+	err := s.DB.Get(&thread, sqlStatement, id)
+
+	return &thread, err
+}
+
+// GetPinnedThreadViewList lists the pinned threads of a forum, latest
+// activity first.
+func (s *Store) GetPinnedThreadViewList(forumName string) ([]model.ThreadView, error) {
+	sqlStatement := s.sql(`select
+		t.*,
+		coalesce(u.user_name, '') as user_name,
+		(select count(*) from comment c where c.thread_id = t.id and c.deleted = false) as comment_count
+	from thread t
+	left join "user" u on u.id = t.user_id
+	where t.forum_name = $1
+	and t.pinned = true
+	order by t.last_post_at desc, t.id desc;`)
+
+	var threadList []model.ThreadView
+	err := s.DB.Select(&threadList, sqlStatement, forumName)
+
+	return threadList, err
+}
+
+// threadSortKeys is the expression each sort orders threads by, descending,
+// the thread id breaks ties. %s is the thread table alias.
+var threadSortKeys = map[store.ThreadSort]string{
+	store.SortActivity: "%s.last_post_at",
+	store.SortNewest:   "%s.created_at",
+	store.SortComments: "(select count(*) from comment c where c.thread_id = %s.id and c.deleted = false)",
+}
+
+func (s *Store) GetThreadViewPage(forumName string, sort store.ThreadSort, page store.Page) ([]model.ThreadView, error) {
+	key, ok := threadSortKeys[sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown thread sort %q", sort)
+	}
+
+	where, order, cursor := keyset(
+		fmt.Sprintf(key, "t"), "t.id",
+		fmt.Sprintf("select %s, x.id from thread x where x.id = $2", fmt.Sprintf(key, "x")),
+		true, page)
+
+	sqlStatement := s.sql(`select
+		t.*,
+		coalesce(u.user_name, '') as user_name,
+		(select count(*) from comment c where c.thread_id = t.id and c.deleted = false) as comment_count
+	from thread t
+	left join "user" u on u.id = t.user_id
+	where t.forum_name = $1
+	and t.pinned = false` + where + `
+	order by ` + order + `
+	limit $3;`)
+
+	var threadList []model.ThreadView
+	err := s.DB.Select(&threadList, sqlStatement, forumName, cursor, page.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Before != "" {
+		slices.Reverse(threadList)
+	}
+
+	return threadList, nil
+}
+
+// keyset returns the condition and the order by clause selecting a page
+// of a list sorted by key then id, and the cursor id to bind to $2.
+// cursorKey selects the key and the id of the row with id $2. A page
+// before a cursor is read backwards, the caller reverses the rows.
+func keyset(key, id, cursorKey string, desc bool, page store.Page) (where, order, cursor string) {
+	back := page.Before != ""
+
+	cmp, dir := ">", "asc"
+	if desc != back {
+		cmp, dir = "<", "desc"
+	}
+	order = key + " " + dir + ", " + id + " " + dir
+
+	cursor = page.After
+	if back {
+		cursor = page.Before
+	}
+	if cursor == "" {
+		// $2 is still bound so the placeholders do not move
+		return " and cast($2 as text) = ''", order, ""
+	}
+
+	where = fmt.Sprintf(" and (%s, %s) %s (%s)", key, id, cmp, cursorKey)
+
+	return where, order, cursor
+}
+
+// UpdateThread saves the new title and content of a thread, keeping the
+// previous version in the revision table.
+func (s *Store) UpdateThread(thread *model.Thread) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.saveThreadRevision(tx, thread.ID)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	update thread set
+		title = $1,
+		content = $2,
+		updated_at = {{now}},
+		edited_at = {{now}}
+	where id = $3
+	and deleted = false;`)
+
+	_, err = tx.Exec(sqlStatement,
+		thread.Title,
+		thread.Content,
+		thread.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteThread marks a thread as deleted and clears its content. The
+// comments stay in place and the old content is kept as a revision.
+func (s *Store) DeleteThread(id string) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.saveThreadRevision(tx, id)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	update thread set
+		content = '',
+		deleted = true,
+		updated_at = {{now}}
+	where id = $1;`)
+
+	_, err = tx.Exec(sqlStatement, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) saveThreadRevision(tx *sqlx.Tx, id string) error {
+	sqlStatement := s.sql(`
+	insert into revision (
+		id,
+		item_type,
+		item_id,
+		title,
+		content,
+		user_id,
+		created_at
+	) select
+		cast($1 as text),
+		'thread',
+		id,
+		title,
+		content,
+		user_id,
+		updated_at
+	from thread
+	where id = $2;`)
+
+	_, err := tx.Exec(sqlStatement, util.RandomID(), id)
+
+	return err
+}
+
+func (s *Store) CreateComment(comment *model.Comment) error {
+	sqlStatement := s.sql(`
+	insert into comment (
+		id,
+		thread_id,
+		user_id,
+		content,
+		created_at,
+		updated_at
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		{{now}},
+		{{now}}
+	);`)
+
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sqlStatement,
+		comment.ID,
+		comment.ThreadID,
+		comment.UserID,
+		comment.Content)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement = s.sql(`update thread set last_post_at = {{now}} where id = $1;`)
+
+	_, err = tx.Exec(sqlStatement, comment.ThreadID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) GetComment(id string) (*model.Comment, error) {
+	sqlStatement := s.sql(`select * from comment where id = $1;`)
+
+	var comment model.Comment
+	err := s.DB.Get(&comment, sqlStatement, id)
+
+	return &comment, err
+}
+
+func (s *Store) GetCommentList(threadID string) ([]model.Comment, error) {
+	sqlStatement := s.sql(`select * from comment
+	where thread_id = $1
+	order by seq;`)
+
+	var commentList []model.Comment
+	err := s.DB.Select(&commentList, sqlStatement, threadID)
+
+	return commentList, err
+}
+
+func (s *Store) GetCommentViewPage(threadID string, page store.Page) ([]model.CommentView, error) {
+	where, order, cursor := keyset(
+		"c.seq", "c.id",
+		"select x.seq, x.id from comment x where x.id = $2",
+		false, page)
+
+	sqlStatement := s.sql(`select
+		c.*,
+		coalesce(u.user_name, '') as user_name
+	from comment c
+	left join "user" u on u.id = c.user_id
+	where c.thread_id = $1` + where + `
+	order by ` + order + `
+	limit $3;`)
+
+	var commentList []model.CommentView
+	err := s.DB.Select(&commentList, sqlStatement, threadID, cursor, page.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Before != "" {
+		slices.Reverse(commentList)
+	}
+
+	return commentList, nil
+}
+
+// UpdateComment saves the new content of a comment, keeping the previous
+// version in the revision table.
+func (s *Store) UpdateComment(comment *model.Comment) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.saveCommentRevision(tx, comment.ID)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	update comment set
+		content = $1,
+		updated_at = {{now}},
+		edited_at = {{now}}
+	where id = $2
+	and deleted = false;`)
+
+	_, err = tx.Exec(sqlStatement,
+		comment.Content,
+		comment.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteComment marks a comment as deleted and clears its content, the
+// old content is kept as a revision.
+func (s *Store) DeleteComment(id string) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.saveCommentRevision(tx, id)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	update comment set
+		content = '',
+		deleted = true,
+		updated_at = {{now}}
+	where id = $1;`)
+
+	_, err = tx.Exec(sqlStatement, id)
+	if err != nil {
+		return err
+	}
+
+	// the thread's last post may have been this one
+	sqlStatement = s.sql(`
+	update thread set last_post_at = coalesce(
+		(select max(c.created_at) from comment c
+			where c.thread_id = thread.id and c.deleted = false),
+		thread.created_at)
+	where id = (select thread_id from comment where id = $1);`)
+
+	_, err = tx.Exec(sqlStatement, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) saveCommentRevision(tx *sqlx.Tx, id string) error {
+	sqlStatement := s.sql(`
+	insert into revision (
+		id,
+		item_type,
+		item_id,
+		title,
+		content,
+		user_id,
+		created_at
+	) select
+		cast($1 as text),
+		'comment',
+		id,
+		'',
+		content,
+		user_id,
+		updated_at
+	from comment
+	where id = $2;`)
+
+	_, err := tx.Exec(sqlStatement, util.RandomID(), id)
+
+	return err
+}
+
+// GetRevisionList returns the previous versions of a thread or comment,
+// oldest first.
+func (s *Store) GetRevisionList(itemID string) ([]model.Revision, error) {
+	sqlStatement := s.sql(`select * from revision where item_id = $1 order by created_at, id;`)
+
+	var revisionList []model.Revision
+	err := s.DB.Select(&revisionList, sqlStatement, itemID)
+
+	return revisionList, err
+}
+
+/////////////////////////////////////////////////////////////////
+// moderation
+
+func (s *Store) SetUserRole(userID string, role model.Role) error {
+	sqlStatement := s.sql(`
+	update "user" set
+		role = $1,
+		banned_until = null
+	where id = $2;`)
+
+	return s.execOne(sqlStatement, role, userID)
+}
+
+func (s *Store) BanUser(userID string, until time.Time) error {
+	sqlStatement := s.sql(`
+	update "user" set
+		role = $1,
+		banned_until = $2
+	where id = $3;`)
+
+	var bannedUntil *time.Time
+	if !until.IsZero() {
+		until = until.UTC()
+		bannedUntil = &until
+	}
+
+	return s.execOne(sqlStatement, model.RoleBanned, bannedUntil, userID)
+}
+
+// execOne runs a statement on a single row, returning store.ErrNotFound
+// if no row matched.
+func (s *Store) execOne(sqlStatement string, args ...any) error {
+	res, err := s.DB.Exec(sqlStatement, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return store.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *Store) GetUserList(role model.Role) ([]model.User, error) {
+	sqlStatement := s.sql(`select * from "user"
+	where role = $1 or $1 = ''
+	order by user_name, id;`)
+
+	var userList []model.User
+	err := s.DB.Select(&userList, sqlStatement, role)
+
+	return userList, err
+}
+
+func (s *Store) AddForumModerator(forumName, userID string) error {
+	sqlStatement := s.sql(`
+	insert into forum_moderator (
+		forum_name,
+		user_id,
+		created_at
+	) values (
+		$1,
+		$2,
+		{{now}}
+	) on conflict do nothing;`)
+
+	_, err := s.DB.Exec(sqlStatement, forumName, userID)
+
+	return err
+}
+
+func (s *Store) RemoveForumModerator(forumName, userID string) error {
+	sqlStatement := s.sql(`delete from forum_moderator where forum_name = $1 and user_id = $2;`)
+
+	return s.execOne(sqlStatement, forumName, userID)
+}
+
+func (s *Store) GetForumModeratorList(forumName string) ([]model.User, error) {
+	sqlStatement := s.sql(`select u.* from "user" u
+	join forum_moderator m on m.user_id = u.id
+	where m.forum_name = $1
+	order by u.user_name, u.id;`)
+
+	var userList []model.User
+	err := s.DB.Select(&userList, sqlStatement, forumName)
+
+	return userList, err
+}
+
+func (s *Store) IsForumModerator(forumName, userID string) (bool, error) {
+	sqlStatement := s.sql(`select count(*) from forum_moderator
+	where forum_name = $1
+	and user_id = $2;`)
+
+	var count int
+	err := s.DB.Get(&count, sqlStatement, forumName, userID)
+
+	return count > 0, err
+}
+
+func (s *Store) SetThreadLocked(id string, locked bool) error {
+	sqlStatement := s.sql(`update thread set locked = $1 where id = $2;`)
+
+	return s.execOne(sqlStatement, locked, id)
+}
+
+func (s *Store) SetThreadPinned(id string, pinned bool) error {
+	sqlStatement := s.sql(`update thread set pinned = $1 where id = $2;`)
+
+	return s.execOne(sqlStatement, pinned, id)
+}
+
+func (s *Store) MoveThread(id, forumName string) error {
+	sqlStatement := s.sql(`update thread set forum_name = $1 where id = $2;`)
+
+	return s.execOne(sqlStatement, forumName, id)
+}
+
+func (s *Store) CreateAuditLog(entry *model.AuditLog) error {
+	sqlStatement := s.sql(`
+	insert into audit_log (
+		id,
+		user_id,
+		action,
+		target_type,
+		target_id,
+		detail,
+		created_at
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		$5,
+		$6,
+		{{now}}
+	);`)
+
+	if entry.ID == "" {
+		entry.ID = util.RandomID()
+	}
+
+	_, err := s.DB.Exec(sqlStatement,
+		entry.ID,
+		entry.UserID,
+		entry.Action,
+		entry.TargetType,
+		entry.TargetID,
+		entry.Detail)
+
+	return err
+}
+
+func (s *Store) GetAuditLogList(limit int) ([]model.AuditLogView, error) {
+	sqlStatement := s.sql(`select
+		a.*,
+		coalesce(u.user_name, '') as user_name
+	from audit_log a
+	left join "user" u on u.id = a.user_id
+	order by a.created_at desc, a.id desc
+	limit $1;`)
+
+	var entryList []model.AuditLogView
+	err := s.DB.Select(&entryList, sqlStatement, limit)
+
+	return entryList, err
+}
+
+/////////////////////////////////////////////////////////////////
+// chat
+
+func (s *Store) CreateChatRoom(room *model.ChatRoom) error {
+	slug, err := s.uniqueSlug(room.Name, "room", `select count(*) from chat_room where name_slug = $1;`, nil)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := s.sql(`
+	insert into chat_room (
+		name,
+		name_slug,
+		created_at,
+		updated_at
+	) values (
+		$1,
+		$2,
+		{{now}},
+		{{now}}
+	);`)
+
+	_, err = s.DB.Exec(sqlStatement,
+		room.Name,
+		slug)
+	if err != nil {
+		return err
+	}
+
+	room.NameSlug = slug
+
+	return nil
+}
+
+func (s *Store) GetChatRoom(name string) (*model.ChatRoom, error) {
+	sqlStatement := s.sql(`select * from chat_room where name_slug = $1;`)
+
+	var chatRoom model.ChatRoom
+	err := s.DB.Get(&chatRoom, sqlStatement, strings.ToLower(name))
+
+	return &chatRoom, err
+}
+
+func (s *Store) GetChatRoomList() ([]model.ChatRoom, error) {
+	sqlStatement := s.sql(`select * from chat_room;`)
+
+	var chatRoomList []model.ChatRoom
+	err := s.DB.Select(&chatRoomList, sqlStatement)
+
+	return chatRoomList, err
+}
+
+func (s *Store) DeleteChatRoom(name string) error {
+	sqlStatement := s.sql(`delete from chat_room where name_slug = $1;`)
+
+	_, err := s.DB.Exec(sqlStatement, strings.ToLower(name))
+
+	return err
+}
+
+func (s *Store) CreateChatMessage(message *model.ChatMessage) error {
+	sqlStatement := s.sql(`
+	insert into chat_message (
+		id,
+		room_id,
+		user_id,
+		content,
+		created_at,
+		updated_at
+	) values (
+		$1,
+		$2,
+		$3,
+		$4,
+		{{now}},
+		{{now}}
+	);`)
+
+	_, err := s.DB.Exec(sqlStatement,
+		message.ID,
+		message.RoomID,
+		message.UserID,
+		message.Content)
+
+	return err
+}
+
+func (s *Store) GetChatMessage(id string) (*model.ChatMessage, error) {
+	sqlStatement := s.sql(`select * from chat_message where id = $1;`)
+
+	var chatMessage model.ChatMessage
+	err := s.DB.Get(&chatMessage, sqlStatement, id)
+
+	return &chatMessage, err
+}
+
+func (s *Store) GetChatMessageList(roomID string) ([]model.ChatMessage, error) {
+	sqlStatement := s.sql(`select * from chat_message where room_id = $1;`)
+
+	var chatMessageList []model.ChatMessage
+	err := s.DB.Select(&chatMessageList, sqlStatement, roomID)
+
+	return chatMessageList, err
+}
+
+func (s *Store) GetChatMessagePage(roomID, before string, limit int) ([]model.ChatMessageView, error) {
+	sqlStatement := s.sql(`select
+		m.*,
+		coalesce(u.user_name, '') as user_name
+	from chat_message m
+	left join "user" u on u.id = m.user_id
+	where m.room_id = $1
+	and (cast($2 as text) = '' or m.seq < (
+		select seq from chat_message where id = $2))
+	order by m.seq desc
+	limit $3;`)
+
+	var chatMessageList []model.ChatMessageView
+	err := s.DB.Select(&chatMessageList, sqlStatement, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(chatMessageList)
+
+	return chatMessageList, nil
+}
+
+func (s *Store) DeleteChatMessage(id string) error {
+	sqlStatement := s.sql(`delete from chat_message where id = $1;`)
+
+	_, err := s.DB.Exec(sqlStatement, id)
+
+	return err
+}
+
+/////////////////////////////////////////////////////////////////
@@ -0,0 +1,7 @@
+drop table if exists chat_message;
+drop table if exists chat_room;
+drop table if exists comment;
+drop table if exists thread;
+drop table if exists forum;
+drop table if exists user;
+drop table if exists session;
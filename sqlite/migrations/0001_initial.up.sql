@@ -0,0 +1,69 @@
+-- schema created by the Create*Tables methods before migrations existed,
+-- "if not exists" lets old databases adopt it
+
+create table if not exists session (
+	session_id text primary key,
+	user_id text not null,
+	expire_at datetime not null,
+	logged_in integer not null,
+	oauth_provider text not null,
+	oauth_user_id text not null,
+	user_name text not null,
+	avatar_url text not null
+);
+
+create table if not exists user (
+	id text primary key,
+	oauth_provider text not null,
+	oauth_user_id text not null,
+	user_name text not null,
+	avatar_url text not null
+);
+
+create table if not exists forum (
+	name text not null,
+	name_slug text not null,
+	primary key(name_slug)
+);
+
+create table if not exists thread (
+	id text not null,
+	forum_name text not null,
+	title text not null,
+	content text not null,
+	user_id text not null,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(id),
+	foreign key(forum_name) references forum(name_slug)
+);
+
+create table if not exists comment (
+	id text not null,
+	thread_id text not null,
+	user_id text not null,
+	content text not null,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(id),
+	foreign key(thread_id) references thread(id)
+);
+
+create table if not exists chat_room (
+	name text not null,
+	name_slug text not null,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(name_slug)
+);
+
+create table if not exists chat_message (
+	id text not null,
+	room_id text not null,
+	user_id text not null,
+	content text not null,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(id),
+	foreign key(room_id) references chat_room(name_slug)
+);
@@ -0,0 +1,5 @@
+drop index if exists revision_item_idx;
+drop table if exists revision;
+
+alter table comment drop column deleted;
+alter table thread drop column deleted;
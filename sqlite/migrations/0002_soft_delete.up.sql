@@ -0,0 +1,15 @@
+alter table thread add column deleted integer not null default 0;
+alter table comment add column deleted integer not null default 0;
+
+create table revision (
+	id text not null,
+	item_type text not null,
+	item_id text not null,
+	title text not null,
+	content text not null,
+	user_id text not null,
+	created_at datetime not null,
+	primary key(id)
+);
+
+create index revision_item_idx on revision(item_id, created_at);
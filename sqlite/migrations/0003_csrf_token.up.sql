@@ -0,0 +1 @@
+alter table session add column csrf_token text not null default '';
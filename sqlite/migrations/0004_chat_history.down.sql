@@ -0,0 +1 @@
+drop index chat_message_room_idx;
@@ -0,0 +1,9 @@
+alter table thread add column last_post_at datetime not null default '1970-01-01 00:00:00';
+
+update thread set last_post_at = coalesce(
+	(select max(c.created_at) from comment c where c.thread_id = thread.id),
+	thread.created_at);
+
+create index thread_activity_idx on thread(forum_name, last_post_at, id);
+create index thread_created_idx on thread(forum_name, created_at, id);
+create index comment_thread_idx on comment(thread_id, created_at, id);
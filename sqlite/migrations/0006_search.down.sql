@@ -0,0 +1,13 @@
+drop trigger chat_message_fts_delete;
+drop trigger chat_message_fts_update;
+drop trigger chat_message_fts_insert;
+drop trigger comment_fts_delete;
+drop trigger comment_fts_update;
+drop trigger comment_fts_insert;
+drop trigger thread_fts_delete;
+drop trigger thread_fts_update;
+drop trigger thread_fts_insert;
+
+drop table chat_message_fts;
+drop table comment_fts;
+drop table thread_fts;
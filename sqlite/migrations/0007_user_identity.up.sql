@@ -0,0 +1,16 @@
+create table user_identity (
+	oauth_provider text not null,
+	oauth_user_id text not null,
+	user_id text not null,
+	user_name text not null,
+	created_at datetime not null,
+	primary key(oauth_provider, oauth_user_id),
+	foreign key(user_id) references user(id)
+);
+
+create index user_identity_user_idx on user_identity(user_id);
+
+insert into user_identity (oauth_provider, oauth_user_id, user_id, user_name, created_at)
+select oauth_provider, oauth_user_id, id, user_name, datetime('now') from user
+where true
+on conflict do nothing;
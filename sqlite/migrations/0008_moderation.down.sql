@@ -0,0 +1,11 @@
+drop index audit_log_created_idx;
+drop table audit_log;
+
+drop index forum_moderator_user_idx;
+drop table forum_moderator;
+
+alter table thread drop column pinned;
+alter table thread drop column locked;
+
+alter table user drop column banned_until;
+alter table user drop column role;
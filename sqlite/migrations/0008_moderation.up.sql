@@ -0,0 +1,29 @@
+alter table user add column role text not null default 'member';
+alter table user add column banned_until datetime;
+
+alter table thread add column locked integer not null default 0;
+alter table thread add column pinned integer not null default 0;
+
+create table forum_moderator (
+	forum_name text not null,
+	user_id text not null,
+	created_at datetime not null,
+	primary key(forum_name, user_id),
+	foreign key(forum_name) references forum(name_slug),
+	foreign key(user_id) references user(id)
+);
+
+create index forum_moderator_user_idx on forum_moderator(user_id);
+
+create table audit_log (
+	id text not null,
+	user_id text not null,
+	action text not null,
+	target_type text not null,
+	target_id text not null,
+	detail text not null,
+	created_at datetime not null,
+	primary key(id)
+);
+
+create index audit_log_created_idx on audit_log(created_at, id);
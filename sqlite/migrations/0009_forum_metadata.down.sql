@@ -0,0 +1,4 @@
+alter table forum drop column archived;
+alter table forum drop column category_slug;
+alter table forum drop column sort_order;
+alter table forum drop column description;
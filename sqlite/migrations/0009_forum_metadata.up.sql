@@ -0,0 +1,6 @@
+-- slugs created before the slugifier are kept, threads refer to them
+
+alter table forum add column description text not null default '';
+alter table forum add column sort_order integer not null default 0;
+alter table forum add column category_slug text not null default '';
+alter table forum add column archived integer not null default 0;
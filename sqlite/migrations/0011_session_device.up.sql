@@ -0,0 +1,6 @@
+alter table session add column user_agent text not null default '';
+alter table session add column ip text not null default '';
+-- sqlite only takes a constant default here, the next request sets it
+alter table session add column last_seen_at datetime not null default '1970-01-01 00:00:00';
+
+create index session_user_idx on session(user_id);
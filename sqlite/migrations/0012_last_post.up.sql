@@ -0,0 +1,5 @@
+-- deleting a comment did not move last_post_at back
+update thread set last_post_at = coalesce(
+	(select max(c.created_at) from comment c
+		where c.thread_id = thread.id and c.deleted = false),
+	thread.created_at);
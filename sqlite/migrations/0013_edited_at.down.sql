@@ -0,0 +1,2 @@
+alter table comment drop column edited_at;
+alter table thread drop column edited_at;
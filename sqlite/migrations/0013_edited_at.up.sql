@@ -0,0 +1,12 @@
+-- updated_at has whole seconds and also changes on delete, edits are
+-- tracked on their own
+alter table thread add column edited_at datetime;
+alter table comment add column edited_at datetime;
+
+update thread set edited_at = updated_at
+where deleted = false
+and exists (select 1 from revision r where r.item_type = 'thread' and r.item_id = thread.id);
+
+update comment set edited_at = updated_at
+where deleted = false
+and exists (select 1 from revision r where r.item_type = 'comment' and r.item_id = comment.id);
@@ -0,0 +1,11 @@
+drop index chat_message_room_idx;
+drop index comment_thread_idx;
+
+create index comment_thread_idx on comment(thread_id, created_at, id);
+create index chat_message_room_idx on chat_message(room_id, created_at, id);
+
+drop trigger chat_message_seq;
+drop trigger comment_seq;
+
+alter table chat_message drop column seq;
+alter table comment drop column seq;
@@ -0,0 +1,27 @@
+-- created_at has whole seconds and ids are random, seq keeps the order
+-- comments and chat messages were written in
+alter table comment add column seq integer not null default 0;
+alter table chat_message add column seq integer not null default 0;
+
+update comment set seq = (select count(*) from comment x
+	where x.created_at < comment.created_at
+	or (x.created_at = comment.created_at and x.id <= comment.id));
+
+update chat_message set seq = (select count(*) from chat_message x
+	where x.created_at < chat_message.created_at
+	or (x.created_at = chat_message.created_at and x.id <= chat_message.id));
+
+-- writes are serialized, the next number cannot be taken twice
+create trigger comment_seq after insert on comment begin
+	update comment set seq = (select max(seq) from comment) + 1 where id = new.id;
+end;
+
+create trigger chat_message_seq after insert on chat_message begin
+	update chat_message set seq = (select max(seq) from chat_message) + 1 where id = new.id;
+end;
+
+drop index comment_thread_idx;
+drop index chat_message_room_idx;
+
+create index comment_thread_idx on comment(thread_id, seq);
+create index chat_message_room_idx on chat_message(room_id, seq);
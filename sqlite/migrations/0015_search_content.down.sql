@@ -0,0 +1,72 @@
+drop trigger chat_message_fts_delete;
+drop trigger chat_message_fts_update;
+drop trigger chat_message_fts_insert;
+drop trigger comment_fts_delete;
+drop trigger comment_fts_update;
+drop trigger comment_fts_insert;
+drop trigger thread_fts_delete;
+drop trigger thread_fts_update;
+drop trigger thread_fts_insert;
+
+drop table chat_message_fts;
+drop table comment_fts;
+drop table thread_fts;
+
+create virtual table thread_fts using fts5(
+	id unindexed,
+	title,
+	content,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+create virtual table comment_fts using fts5(
+	id unindexed,
+	content,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+create virtual table chat_message_fts using fts5(
+	id unindexed,
+	content,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+insert into thread_fts (id, title, content) select id, title, content from thread;
+insert into comment_fts (id, content) select id, content from comment;
+insert into chat_message_fts (id, content) select id, content from chat_message;
+
+create trigger thread_fts_insert after insert on thread begin
+	insert into thread_fts (id, title, content) values (new.id, new.title, new.content);
+end;
+
+create trigger thread_fts_update after update of title, content on thread begin
+	update thread_fts set title = new.title, content = new.content where id = old.id;
+end;
+
+create trigger thread_fts_delete after delete on thread begin
+	delete from thread_fts where id = old.id;
+end;
+
+create trigger comment_fts_insert after insert on comment begin
+	insert into comment_fts (id, content) values (new.id, new.content);
+end;
+
+create trigger comment_fts_update after update of content on comment begin
+	update comment_fts set content = new.content where id = old.id;
+end;
+
+create trigger comment_fts_delete after delete on comment begin
+	delete from comment_fts where id = old.id;
+end;
+
+create trigger chat_message_fts_insert after insert on chat_message begin
+	insert into chat_message_fts (id, content) values (new.id, new.content);
+end;
+
+create trigger chat_message_fts_update after update of content on chat_message begin
+	update chat_message_fts set content = new.content where id = old.id;
+end;
+
+create trigger chat_message_fts_delete after delete on chat_message begin
+	delete from chat_message_fts where id = old.id;
+end;
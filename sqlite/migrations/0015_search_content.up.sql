@@ -0,0 +1,81 @@
+-- the full text indexes are keyed by the rowid of the indexed table, so
+-- the triggers find a row without scanning the index, and read the text
+-- from that table instead of keeping a copy. After a vacuum, which may
+-- renumber rowids, rebuild them with
+-- insert into thread_fts (thread_fts) values ('rebuild') and so on.
+
+drop trigger chat_message_fts_delete;
+drop trigger chat_message_fts_update;
+drop trigger chat_message_fts_insert;
+drop trigger comment_fts_delete;
+drop trigger comment_fts_update;
+drop trigger comment_fts_insert;
+drop trigger thread_fts_delete;
+drop trigger thread_fts_update;
+drop trigger thread_fts_insert;
+
+drop table chat_message_fts;
+drop table comment_fts;
+drop table thread_fts;
+
+create virtual table thread_fts using fts5(
+	title,
+	content,
+	content = 'thread',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+create virtual table comment_fts using fts5(
+	content,
+	content = 'comment',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+create virtual table chat_message_fts using fts5(
+	content,
+	content = 'chat_message',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+insert into thread_fts (thread_fts) values ('rebuild');
+insert into comment_fts (comment_fts) values ('rebuild');
+insert into chat_message_fts (chat_message_fts) values ('rebuild');
+
+create trigger thread_fts_insert after insert on thread begin
+	insert into thread_fts (rowid, title, content) values (new.rowid, new.title, new.content);
+end;
+
+create trigger thread_fts_update after update of title, content on thread begin
+	insert into thread_fts (thread_fts, rowid, title, content) values ('delete', old.rowid, old.title, old.content);
+	insert into thread_fts (rowid, title, content) values (new.rowid, new.title, new.content);
+end;
+
+create trigger thread_fts_delete after delete on thread begin
+	insert into thread_fts (thread_fts, rowid, title, content) values ('delete', old.rowid, old.title, old.content);
+end;
+
+create trigger comment_fts_insert after insert on comment begin
+	insert into comment_fts (rowid, content) values (new.rowid, new.content);
+end;
+
+create trigger comment_fts_update after update of content on comment begin
+	insert into comment_fts (comment_fts, rowid, content) values ('delete', old.rowid, old.content);
+	insert into comment_fts (rowid, content) values (new.rowid, new.content);
+end;
+
+create trigger comment_fts_delete after delete on comment begin
+	insert into comment_fts (comment_fts, rowid, content) values ('delete', old.rowid, old.content);
+end;
+
+create trigger chat_message_fts_insert after insert on chat_message begin
+	insert into chat_message_fts (rowid, content) values (new.rowid, new.content);
+end;
+
+create trigger chat_message_fts_update after update of content on chat_message begin
+	insert into chat_message_fts (chat_message_fts, rowid, content) values ('delete', old.rowid, old.content);
+	insert into chat_message_fts (rowid, content) values (new.rowid, new.content);
+end;
+
+create trigger chat_message_fts_delete after delete on chat_message begin
+	insert into chat_message_fts (chat_message_fts, rowid, content) values ('delete', old.rowid, old.content);
+end;
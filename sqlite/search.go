@@ -0,0 +1,137 @@
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+
+	"realm/model"
+	"realm/store"
+)
+
+var _ store.Store = (*Sqlite)(nil)
+
+// timeFormat is how datetime('now') stores dates, filters are compared
+// as text against it.
+const timeFormat = "2006-01-02 15:04:05"
+
+// Search looks into the FTS5 tables kept in sync by the triggers of the
+// 0015_search_content migration, keyed by the rowid of the indexed table.
+func (s *Sqlite) Search(q store.SearchQuery, scope store.SearchScope, page int) ([]model.SearchResult, error) {
+	match := ftsQuery(q.Text)
+	if match == "" {
+		return nil, nil
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	args := []any{match}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// filter returns the conditions of the query filters, forum is empty
+	// for tables that do not belong to a forum
+	filter := func(forum, author, createdAt string) string {
+		var b strings.Builder
+		if q.Forum != "" {
+			fmt.Fprintf(&b, " and %s = %s", forum, arg(strings.ToLower(q.Forum)))
+		}
+		if q.Author != "" {
+			fmt.Fprintf(&b, " and lower(%s) = lower(%s)", author, arg(q.Author))
+		}
+		if !q.From.IsZero() {
+			fmt.Fprintf(&b, " and %s >= %s", createdAt, arg(q.From.UTC().Format(timeFormat)))
+		}
+		if !q.To.IsZero() {
+			fmt.Fprintf(&b, " and %s < %s", createdAt, arg(q.To.UTC().Format(timeFormat)))
+		}
+		return b.String()
+	}
+
+	var parts []string
+
+	if scope == store.SearchAll || scope == store.SearchThreads {
+		parts = append(parts, `select
+			'thread' as kind,
+			t.id,
+			t.id as thread_id,
+			t.forum_name as forum,
+			t.title,
+			snippet(thread_fts, -1, char(2), char(3), '…', 24) as snippet,
+			coalesce(u.user_name, '') as user_name,
+			t.created_at,
+			bm25(thread_fts) as rank
+		from thread_fts
+		join thread t on t.rowid = thread_fts.rowid
+		left join "user" u on u.id = t.user_id
+		where thread_fts match $1
+		and t.deleted = false`+filter("t.forum_name", "u.user_name", "t.created_at"))
+	}
+
+	if scope == store.SearchAll || scope == store.SearchComments {
+		parts = append(parts, `select
+			'comment' as kind,
+			c.id,
+			c.thread_id,
+			t.forum_name as forum,
+			t.title,
+			snippet(comment_fts, 0, char(2), char(3), '…', 24) as snippet,
+			coalesce(u.user_name, '') as user_name,
+			c.created_at,
+			bm25(comment_fts) as rank
+		from comment_fts
+		join comment c on c.rowid = comment_fts.rowid
+		join thread t on t.id = c.thread_id
+		left join "user" u on u.id = c.user_id
+		where comment_fts match $1
+		and c.deleted = false
+		and t.deleted = false`+filter("t.forum_name", "u.user_name", "c.created_at"))
+	}
+
+	// chat rooms are not part of a forum
+	if (scope == store.SearchAll || scope == store.SearchChat) && q.Forum == "" {
+		parts = append(parts, `select
+			'chat' as kind,
+			m.id,
+			'' as thread_id,
+			m.room_id as forum,
+			coalesce(r.name, m.room_id) as title,
+			snippet(chat_message_fts, 0, char(2), char(3), '…', 24) as snippet,
+			coalesce(u.user_name, '') as user_name,
+			m.created_at,
+			bm25(chat_message_fts) as rank
+		from chat_message_fts
+		join chat_message m on m.rowid = chat_message_fts.rowid
+		left join chat_room r on r.name_slug = m.room_id
+		left join "user" u on u.id = m.user_id
+		where chat_message_fts match $1`+filter("", "u.user_name", "m.created_at"))
+	}
+
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	sqlStatement := `select
+		kind, id, thread_id, forum, title, snippet, user_name, created_at
+	from (` + strings.Join(parts, "\nunion all\n") + `)
+	order by rank, created_at desc
+	limit ` + arg(q.Limit) + ` offset ` + arg((page-1)*q.Limit) + `;`
+
+	var resultList []model.SearchResult
+	err := s.DB.Select(&resultList, sqlStatement, args...)
+
+	return resultList, err
+}
+
+// ftsQuery turns user input into an FTS5 query matching every word, each
+// word is quoted so the FTS5 syntax characters have no meaning.
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		word = strings.ReplaceAll(word, `"`, `""`)
+		terms = append(terms, `"`+word+`"`)
+	}
+	return strings.Join(terms, " ")
+}
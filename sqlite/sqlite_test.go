@@ -0,0 +1,24 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+
+	"realm/store"
+	"realm/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		db, err := Open(filepath.Join(t.TempDir(), "realm.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		if err := db.MigrateUp(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,219 @@
+// Package store defines the storage operations used by realm. The sqlite
+// package implements them on a database file, the memory package keeps
+// everything in memory for tests.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"realm/model"
+)
+
+// ReservedForumSlugs are paths under /forum that are not forums.
+var ReservedForumSlugs = []string{
+	"account", "delete", "edit", "github", "login", "logout", "mod", "oauth", "post", "search",
+}
+
+// ErrNotFound is returned when a record does not exist. It is the same
+// value as sql.ErrNoRows so SQL backends can return driver errors as is.
+var ErrNotFound = sql.ErrNoRows
+
+var (
+	// ErrIdentityLinked is returned when linking an identity that belongs
+	// to another user.
+	ErrIdentityLinked = errors.New("identity is linked to another user")
+	// ErrLastIdentity is returned when unlinking the only identity of a
+	// user, who could not log in anymore.
+	ErrLastIdentity = errors.New("cannot unlink the last identity")
+)
+
+// ThreadSort is the order of a thread list.
+type ThreadSort string
+
+const (
+	SortActivity ThreadSort = "activity" // latest post first
+	SortNewest   ThreadSort = "newest"   // latest thread first
+	SortComments ThreadSort = "comments" // most comments first
+)
+
+// Valid reports whether s is a known sort order.
+func (s ThreadSort) Valid() bool {
+	return s == SortActivity || s == SortNewest || s == SortComments
+}
+
+// Page selects a page of a keyset paginated list: the Limit items that
+// follow the item with id After, or the Limit items that precede the item
+// with id Before, or the first Limit items when both are empty. Items are
+// always returned in list order.
+type Page struct {
+	After  string
+	Before string
+	Limit  int
+}
+
+// SearchScope selects what Search looks into.
+type SearchScope string
+
+const (
+	SearchAll      SearchScope = "all"
+	SearchThreads  SearchScope = "threads"
+	SearchComments SearchScope = "comments"
+	SearchChat     SearchScope = "chat"
+)
+
+// Valid reports whether s is a known search scope.
+func (s SearchScope) Valid() bool {
+	return s == SearchAll || s == SearchThreads || s == SearchComments || s == SearchChat
+}
+
+// SearchQuery is a full text search with optional filters, zero values
+// do not filter. Chat messages are left out when Forum is set.
+type SearchQuery struct {
+	Text   string
+	Forum  string // forum slug
+	Author string // user name
+	From   time.Time
+	To     time.Time // exclusive
+	Limit  int       // page size
+}
+
+// Search snippets mark the matched terms with these characters, the
+// caller escapes the snippet and replaces them with its own markup.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+type SessionStore interface {
+	SaveSession(sessionID string, sd *model.SessionData) error
+	DeleteSession(sessionID string) error
+	GetSession(sessionID string) (*model.SessionData, error)
+	DeleteExpiredSessions() error
+	DeleteUserSessions(userID string) error
+	// GetUserSessionList lists the logged in sessions of a user that did
+	// not expire, latest used first.
+	GetUserSessionList(userID string) ([]model.SessionData, error)
+	DeleteAllSessions() error
+	LoadAllSessions() (map[string]model.SessionData, error)
+}
+
+type UserStore interface {
+	// SaveUser updates the user logged in with the identity in user, or
+	// creates a user and links the identity to it.
+	SaveUser(user *model.User) (model.User, error)
+	GetUser(id string) (*model.User, error)
+	GetUserFromOAuthID(oauthProvider string, oauthUserID string) (*model.User, error)
+
+	GetUserIdentityList(userID string) ([]model.UserIdentity, error)
+	LinkUserIdentity(identity *model.UserIdentity) error
+	UnlinkUserIdentity(userID, oauthProvider, oauthUserID string) error
+	// MergeUsers moves the identities, threads, comments and chat messages
+	// of user fromID to user intoID and deletes user fromID and its
+	// sessions.
+	MergeUsers(intoID, fromID string) error
+}
+
+type ForumStore interface {
+	// CreateForum creates a forum, setting forum.NameSlug to a slug of its
+	// name that is not taken.
+	CreateForum(forum *model.Forum) error
+	GetForum(name string) (*model.Forum, error)
+	// GetForumList lists the forums in display order.
+	GetForumList() ([]model.Forum, error)
+	// UpdateForum saves everything but the slug of forum.
+	UpdateForum(forum *model.Forum) error
+	DeleteForum(name string) error
+	// GetForumViewList lists the forums in display order with their
+	// counts and latest post.
+	GetForumViewList() ([]model.ForumView, error)
+
+	// CreateCategory creates a category, setting category.NameSlug as
+	// CreateForum does.
+	CreateCategory(category *model.Category) error
+	GetCategory(name string) (*model.Category, error)
+	// GetCategoryList lists the categories in display order.
+	GetCategoryList() ([]model.Category, error)
+	// UpdateCategory saves everything but the slug of category.
+	UpdateCategory(category *model.Category) error
+	// DeleteCategory deletes a category, its forums are left without one.
+	DeleteCategory(name string) error
+
+	CreateThread(thread *model.Thread) error
+	GetThread(id string) (*model.Thread, error)
+	GetThreadList(forumName string) ([]model.Thread, error)
+	GetThreadView(id string) (*model.ThreadView, error)
+	// GetThreadViewPage lists the threads of a forum that are not pinned.
+	GetThreadViewPage(forumName string, sort ThreadSort, page Page) ([]model.ThreadView, error)
+	GetPinnedThreadViewList(forumName string) ([]model.ThreadView, error)
+	UpdateThread(thread *model.Thread) error
+	DeleteThread(id string) error
+
+	CreateComment(comment *model.Comment) error
+	GetComment(id string) (*model.Comment, error)
+	GetCommentList(threadID string) ([]model.Comment, error)
+	GetCommentViewPage(threadID string, page Page) ([]model.CommentView, error)
+	UpdateComment(comment *model.Comment) error
+	DeleteComment(id string) error
+
+	GetRevisionList(itemID string) ([]model.Revision, error)
+}
+
+type ModerationStore interface {
+	SetUserRole(userID string, role model.Role) error
+	// BanUser sets the role of a user to banned until the given time, or
+	// forever when until is zero.
+	BanUser(userID string, until time.Time) error
+	// GetUserList lists the users with a role, or every user when role is
+	// empty.
+	GetUserList(role model.Role) ([]model.User, error)
+
+	AddForumModerator(forumName, userID string) error
+	RemoveForumModerator(forumName, userID string) error
+	GetForumModeratorList(forumName string) ([]model.User, error)
+	IsForumModerator(forumName, userID string) (bool, error)
+
+	SetThreadLocked(id string, locked bool) error
+	SetThreadPinned(id string, pinned bool) error
+	MoveThread(id, forumName string) error
+
+	CreateAuditLog(entry *model.AuditLog) error
+	// GetAuditLogList returns the latest limit entries, newest first.
+	GetAuditLogList(limit int) ([]model.AuditLogView, error)
+}
+
+type ChatStore interface {
+	// CreateChatRoom creates a chat room, setting room.NameSlug as
+	// CreateForum does.
+	CreateChatRoom(room *model.ChatRoom) error
+	GetChatRoom(name string) (*model.ChatRoom, error)
+	GetChatRoomList() ([]model.ChatRoom, error)
+	DeleteChatRoom(name string) error
+
+	CreateChatMessage(message *model.ChatMessage) error
+	GetChatMessage(id string) (*model.ChatMessage, error)
+	GetChatMessageList(roomID string) ([]model.ChatMessage, error)
+	// GetChatMessagePage returns up to limit messages of a room older than
+	// the message before, or the latest ones when before is empty, oldest
+	// first.
+	GetChatMessagePage(roomID, before string, limit int) ([]model.ChatMessageView, error)
+	DeleteChatMessage(id string) error
+}
+
+type SearchStore interface {
+	// Search returns page n, starting at 1, of the items matching query,
+	// best matches first.
+	Search(query SearchQuery, scope SearchScope, page int) ([]model.SearchResult, error)
+}
+
+// Store is the full set of operations a backend provides.
+type Store interface {
+	SessionStore
+	UserStore
+	ForumStore
+	ModerationStore
+	ChatStore
+	SearchStore
+	Close() error
+}
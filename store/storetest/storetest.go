@@ -0,0 +1,1082 @@
+// Package storetest is a conformance suite for store.Store. Every backend
+// runs it from its own tests, so they all behave the same.
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"realm/model"
+	"realm/store"
+)
+
+// Run runs the suite, open returns an empty store for each test.
+func Run(t *testing.T, open func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, st store.Store)
+	}{
+		{"Sessions", testSessions},
+		{"UserSessionList", testUserSessionList},
+		{"Users", testUsers},
+		{"Identities", testIdentities},
+		{"MergeUsers", testMergeUsers},
+		{"Forums", testForums},
+		{"Categories", testCategories},
+		{"ForumViewList", testForumViewList},
+		{"Threads", testThreads},
+		{"ThreadViewPage", testThreadViewPage},
+		{"Comments", testComments},
+		{"Roles", testRoles},
+		{"ForumModerators", testForumModerators},
+		{"ThreadModeration", testThreadModeration},
+		{"AuditLog", testAuditLog},
+		{"Chat", testChat},
+		{"Search", testSearch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wantNotFound(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("%s: got %v, want store.ErrNotFound", what, err)
+	}
+}
+
+// near reports whether two times are within the second precision some
+// backends keep.
+func near(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Second && d < time.Second
+}
+
+func newUser(t *testing.T, st store.Store, provider, id, name string) model.User {
+	t.Helper()
+
+	user, err := st.SaveUser(&model.User{
+		OAuthProvider: provider,
+		OAuthUserID:   id,
+		UserName:      name,
+	})
+	check(t, err)
+
+	return user
+}
+
+func newForum(t *testing.T, st store.Store, name string) model.Forum {
+	t.Helper()
+
+	forum := model.Forum{Name: name}
+	check(t, st.CreateForum(&forum))
+
+	return forum
+}
+
+func newThread(t *testing.T, st store.Store, id, forum, userID, title string) {
+	t.Helper()
+
+	check(t, st.CreateThread(&model.Thread{
+		ID:        id,
+		ForumName: forum,
+		Title:     title,
+		Content:   "content of " + title,
+		UserID:    userID,
+	}))
+}
+
+func newComment(t *testing.T, st store.Store, id, threadID, userID, content string) {
+	t.Helper()
+
+	check(t, st.CreateComment(&model.Comment{
+		ID:       id,
+		ThreadID: threadID,
+		UserID:   userID,
+		Content:  content,
+	}))
+}
+
+func threadIDs(list []model.ThreadView) string {
+	ids := make([]string, len(list))
+	for i, v := range list {
+		ids[i] = v.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func commentIDs(list []model.CommentView) string {
+	ids := make([]string, len(list))
+	for i, v := range list {
+		ids[i] = v.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func userIDs(list []model.User) string {
+	ids := make([]string, len(list))
+	for i, v := range list {
+		ids[i] = v.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+// revisionContents returns the sorted contents of revisions, with
+// "wrong type" for a revision that is not of type itemType.
+func revisionContents(revisions []model.Revision, itemType string) string {
+	contents := make([]string, len(revisions))
+	for i, r := range revisions {
+		contents[i] = r.Content
+		if r.ItemType != itemType {
+			contents[i] = "wrong type"
+		}
+	}
+	sort.Strings(contents)
+	return strings.Join(contents, ",")
+}
+
+func testSessions(t *testing.T, st store.Store) {
+	_, err := st.GetSession("missing")
+	wantNotFound(t, "GetSession", err)
+
+	expireAt := time.Now().Add(time.Hour).UTC()
+	sd := model.SessionData{
+		UserID:    "u1",
+		ExpireAt:  expireAt,
+		LoggedIn:  true,
+		UserName:  "Alice",
+		CSRFToken: "token1",
+		UserAgent: "test",
+		IP:        "127.0.0.1",
+	}
+	check(t, st.SaveSession("s1", &sd))
+
+	got, err := st.GetSession("s1")
+	check(t, err)
+	if got.SessionID != "s1" || got.UserID != "u1" || !got.LoggedIn || got.UserName != "Alice" ||
+		got.CSRFToken != "token1" || got.UserAgent != "test" || got.IP != "127.0.0.1" {
+		t.Errorf("GetSession = %+v", got)
+	}
+	if !near(got.ExpireAt, expireAt) {
+		t.Errorf("ExpireAt = %v, want %v", got.ExpireAt, expireAt)
+	}
+
+	// saving again updates
+	sd.CSRFToken = "token2"
+	check(t, st.SaveSession("s1", &sd))
+	got, err = st.GetSession("s1")
+	check(t, err)
+	if got.CSRFToken != "token2" {
+		t.Errorf("CSRFToken after update = %q", got.CSRFToken)
+	}
+
+	expired := model.SessionData{UserID: "u1", ExpireAt: time.Now().Add(-time.Hour).UTC()}
+	check(t, st.SaveSession("s2", &expired))
+	other := model.SessionData{UserID: "u2", ExpireAt: expireAt}
+	check(t, st.SaveSession("s3", &other))
+
+	all, err := st.LoadAllSessions()
+	check(t, err)
+	if len(all) != 2 || all["s1"].UserID != "u1" || all["s3"].UserID != "u2" {
+		t.Errorf("LoadAllSessions = %v, want s1 and s3", all)
+	}
+
+	check(t, st.DeleteExpiredSessions())
+	_, err = st.GetSession("s2")
+	wantNotFound(t, "GetSession of an expired session", err)
+
+	check(t, st.DeleteUserSessions("u2"))
+	_, err = st.GetSession("s3")
+	wantNotFound(t, "GetSession after DeleteUserSessions", err)
+
+	check(t, st.DeleteSession("s1"))
+	_, err = st.GetSession("s1")
+	wantNotFound(t, "GetSession after DeleteSession", err)
+
+	check(t, st.SaveSession("s4", &other))
+	check(t, st.DeleteAllSessions())
+	all, err = st.LoadAllSessions()
+	check(t, err)
+	if len(all) != 0 {
+		t.Errorf("LoadAllSessions after DeleteAllSessions = %v", all)
+	}
+}
+
+func testUserSessionList(t *testing.T, st store.Store) {
+	now := time.Now().UTC().Truncate(time.Second)
+	sessions := map[string]model.SessionData{
+		"old":       {UserID: "u1", LoggedIn: true, ExpireAt: now.Add(time.Hour), LastSeenAt: now.Add(-time.Hour)},
+		"new":       {UserID: "u1", LoggedIn: true, ExpireAt: now.Add(time.Hour), LastSeenAt: now},
+		"expired":   {UserID: "u1", LoggedIn: true, ExpireAt: now.Add(-time.Hour), LastSeenAt: now},
+		"anonymous": {UserID: "u1", ExpireAt: now.Add(time.Hour), LastSeenAt: now},
+		"other":     {UserID: "u2", LoggedIn: true, ExpireAt: now.Add(time.Hour), LastSeenAt: now},
+	}
+	for id, sd := range sessions {
+		check(t, st.SaveSession(id, &sd))
+	}
+
+	list, err := st.GetUserSessionList("u1")
+	check(t, err)
+	var ids []string
+	for _, sd := range list {
+		ids = append(ids, sd.SessionID)
+	}
+	if strings.Join(ids, ",") != "new,old" {
+		t.Errorf("GetUserSessionList = %v, want new,old", ids)
+	}
+}
+
+func testUsers(t *testing.T, st store.Store) {
+	_, err := st.GetUser("missing")
+	wantNotFound(t, "GetUser", err)
+
+	alice := newUser(t, st, "github", "1", "Alice")
+	if alice.ID == "" {
+		t.Fatal("SaveUser did not set the id")
+	}
+
+	got, err := st.GetUser(alice.ID)
+	check(t, err)
+	if got.UserName != "Alice" || got.Role != model.RoleMember || got.BannedUntil != nil {
+		t.Errorf("GetUser = %+v", got)
+	}
+
+	// a known identity updates its user
+	again := newUser(t, st, "github", "1", "Alice Liddell")
+	if again.ID != alice.ID {
+		t.Errorf("SaveUser of a known identity made user %s, want %s", again.ID, alice.ID)
+	}
+
+	got, err = st.GetUserFromOAuthID("github", "1")
+	check(t, err)
+	if got.ID != alice.ID || got.UserName != "Alice Liddell" {
+		t.Errorf("GetUserFromOAuthID = %+v", got)
+	}
+
+	_, err = st.GetUserFromOAuthID("github", "2")
+	wantNotFound(t, "GetUserFromOAuthID", err)
+
+	identities, err := st.GetUserIdentityList(alice.ID)
+	check(t, err)
+	if len(identities) != 1 || identities[0].UserName != "Alice Liddell" {
+		t.Errorf("GetUserIdentityList = %+v", identities)
+	}
+}
+
+func testIdentities(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	bob := newUser(t, st, "github", "2", "Bob")
+
+	check(t, st.LinkUserIdentity(&model.UserIdentity{
+		OAuthProvider: "gitlab",
+		OAuthUserID:   "10",
+		UserID:        alice.ID,
+		UserName:      "alice",
+	}))
+
+	got, err := st.GetUserFromOAuthID("gitlab", "10")
+	check(t, err)
+	if got.ID != alice.ID {
+		t.Errorf("linked identity belongs to %s, want %s", got.ID, alice.ID)
+	}
+
+	// linking it again renames it
+	check(t, st.LinkUserIdentity(&model.UserIdentity{
+		OAuthProvider: "gitlab",
+		OAuthUserID:   "10",
+		UserID:        alice.ID,
+		UserName:      "alice2",
+	}))
+
+	err = st.LinkUserIdentity(&model.UserIdentity{
+		OAuthProvider: "github",
+		OAuthUserID:   "2",
+		UserID:        alice.ID,
+		UserName:      "Bob",
+	})
+	if !errors.Is(err, store.ErrIdentityLinked) {
+		t.Errorf("linking an identity of another user: got %v, want store.ErrIdentityLinked", err)
+	}
+
+	identities, err := st.GetUserIdentityList(alice.ID)
+	check(t, err)
+	if len(identities) != 2 {
+		t.Fatalf("GetUserIdentityList = %+v", identities)
+	}
+	for _, i := range identities {
+		if i.OAuthProvider == "gitlab" && i.UserName != "alice2" {
+			t.Errorf("relinked identity is named %q", i.UserName)
+		}
+	}
+
+	err = st.UnlinkUserIdentity(alice.ID, "github", "2")
+	wantNotFound(t, "UnlinkUserIdentity of another user", err)
+
+	check(t, st.UnlinkUserIdentity(alice.ID, "gitlab", "10"))
+
+	err = st.UnlinkUserIdentity(bob.ID, "github", "2")
+	if !errors.Is(err, store.ErrLastIdentity) {
+		t.Errorf("unlinking the last identity: got %v, want store.ErrLastIdentity", err)
+	}
+	identities, err = st.GetUserIdentityList(bob.ID)
+	check(t, err)
+	if len(identities) != 1 {
+		t.Errorf("the last identity was unlinked: %+v", identities)
+	}
+}
+
+func testMergeUsers(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	bob := newUser(t, st, "gitlab", "2", "Bob")
+	forum := newForum(t, st, "Go")
+
+	newThread(t, st, "t1", forum.NameSlug, bob.ID, "by bob")
+	newComment(t, st, "c1", "t1", bob.ID, "bob comments")
+	room := model.ChatRoom{Name: "Lobby"}
+	check(t, st.CreateChatRoom(&room))
+	check(t, st.CreateChatMessage(&model.ChatMessage{ID: "m1", RoomID: room.NameSlug, UserID: bob.ID, Content: "hi"}))
+	check(t, st.AddForumModerator(forum.NameSlug, bob.ID))
+	check(t, st.AddForumModerator(forum.NameSlug, alice.ID))
+	sd := model.SessionData{UserID: bob.ID, LoggedIn: true, ExpireAt: time.Now().Add(time.Hour).UTC()}
+	check(t, st.SaveSession("bob-session", &sd))
+
+	if err := st.MergeUsers(alice.ID, alice.ID); err == nil {
+		t.Error("merged a user into itself")
+	}
+	if err := st.MergeUsers(alice.ID, "missing"); err == nil {
+		t.Error("merged a missing user")
+	}
+
+	check(t, st.MergeUsers(alice.ID, bob.ID))
+
+	_, err := st.GetUser(bob.ID)
+	wantNotFound(t, "GetUser of the merged user", err)
+	_, err = st.GetSession("bob-session")
+	wantNotFound(t, "GetSession of the merged user", err)
+
+	got, err := st.GetUserFromOAuthID("gitlab", "2")
+	check(t, err)
+	if got.ID != alice.ID {
+		t.Errorf("merged identity belongs to %s", got.ID)
+	}
+	thread, err := st.GetThread("t1")
+	check(t, err)
+	comment, err := st.GetComment("c1")
+	check(t, err)
+	message, err := st.GetChatMessage("m1")
+	check(t, err)
+	if thread.UserID != alice.ID || comment.UserID != alice.ID || message.UserID != alice.ID {
+		t.Errorf("posts not moved: thread %s, comment %s, message %s", thread.UserID, comment.UserID, message.UserID)
+	}
+
+	moderators, err := st.GetForumModeratorList(forum.NameSlug)
+	check(t, err)
+	if userIDs(moderators) != alice.ID {
+		t.Errorf("moderators = %s, want only %s", userIDs(moderators), alice.ID)
+	}
+}
+
+func testForums(t *testing.T, st store.Store) {
+	_, err := st.GetForum("missing")
+	wantNotFound(t, "GetForum", err)
+
+	gamma := model.Forum{Name: "Gamma", SortOrder: 1}
+	check(t, st.CreateForum(&gamma))
+	alpha := model.Forum{Name: "Alpha", SortOrder: 2, Description: "first letter"}
+	check(t, st.CreateForum(&alpha))
+	beta := model.Forum{Name: "Beta", SortOrder: 1}
+	check(t, st.CreateForum(&beta))
+
+	slugs := map[string]string{}
+	for _, name := range []string{"Beta", "Café Olé", "Account", "!!!"} {
+		forum := model.Forum{Name: name}
+		check(t, st.CreateForum(&forum))
+		slugs[name] = forum.NameSlug
+	}
+	want := map[string]string{"Beta": "beta-2", "Café Olé": "cafe-ole", "Account": "account-2", "!!!": "forum"}
+	for name, slug := range want {
+		if slugs[name] != slug {
+			t.Errorf("slug of %q = %q, want %q", name, slugs[name], slug)
+		}
+	}
+
+	got, err := st.GetForum("ALPHA")
+	check(t, err)
+	if got.Name != "Alpha" || got.Description != "first letter" || got.SortOrder != 2 {
+		t.Errorf("GetForum = %+v", got)
+	}
+
+	// the forums without a sort order come first, only the order of the
+	// others is checked
+	list, err := st.GetForumList()
+	check(t, err)
+	var ordered []string
+	for _, f := range list {
+		if f.SortOrder > 0 {
+			ordered = append(ordered, f.NameSlug)
+		}
+	}
+	if strings.Join(ordered, ",") != "beta,gamma,alpha" {
+		t.Errorf("GetForumList order = %v, want beta,gamma,alpha", ordered)
+	}
+
+	alpha.Name = "Alpha Centauri"
+	alpha.Archived = true
+	alpha.CategorySlug = "space"
+	check(t, st.UpdateForum(&alpha))
+	got, err = st.GetForum("alpha")
+	check(t, err)
+	if got.Name != "Alpha Centauri" || !got.Archived || got.CategorySlug != "space" || got.NameSlug != "alpha" {
+		t.Errorf("GetForum after UpdateForum = %+v", got)
+	}
+
+	err = st.UpdateForum(&model.Forum{NameSlug: "missing", Name: "Missing"})
+	wantNotFound(t, "UpdateForum", err)
+
+	check(t, st.DeleteForum("Alpha"))
+	_, err = st.GetForum("alpha")
+	wantNotFound(t, "GetForum after DeleteForum", err)
+}
+
+func testCategories(t *testing.T, st store.Store) {
+	_, err := st.GetCategory("missing")
+	wantNotFound(t, "GetCategory", err)
+
+	games := model.Category{Name: "Games", SortOrder: 2}
+	check(t, st.CreateCategory(&games))
+	code := model.Category{Name: "Code", SortOrder: 1}
+	check(t, st.CreateCategory(&code))
+	again := model.Category{Name: "Games"}
+	check(t, st.CreateCategory(&again))
+	if games.NameSlug != "games" || again.NameSlug != "games-2" {
+		t.Errorf("category slugs %q and %q", games.NameSlug, again.NameSlug)
+	}
+
+	list, err := st.GetCategoryList()
+	check(t, err)
+	var slugs []string
+	for _, c := range list {
+		slugs = append(slugs, c.NameSlug)
+	}
+	if strings.Join(slugs, ",") != "games-2,code,games" {
+		t.Errorf("GetCategoryList = %v, want games-2,code,games", slugs)
+	}
+
+	code.Name = "Programming"
+	code.SortOrder = 5
+	check(t, st.UpdateCategory(&code))
+	got, err := st.GetCategory("CODE")
+	check(t, err)
+	if got.Name != "Programming" || got.SortOrder != 5 {
+		t.Errorf("GetCategory after UpdateCategory = %+v", got)
+	}
+	wantNotFound(t, "UpdateCategory", st.UpdateCategory(&model.Category{NameSlug: "missing"}))
+
+	forum := model.Forum{Name: "Go", CategorySlug: code.NameSlug}
+	check(t, st.CreateForum(&forum))
+	check(t, st.DeleteCategory(code.NameSlug))
+	_, err = st.GetCategory(code.NameSlug)
+	wantNotFound(t, "GetCategory after DeleteCategory", err)
+	got2, err := st.GetForum(forum.NameSlug)
+	check(t, err)
+	if got2.CategorySlug != "" {
+		t.Errorf("forum kept deleted category %q", got2.CategorySlug)
+	}
+}
+
+func testForumViewList(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	bob := newUser(t, st, "github", "2", "Bob")
+	golang := newForum(t, st, "Go")
+	empty := newForum(t, st, "Empty")
+
+	newThread(t, st, "t1", golang.NameSlug, alice.ID, "first")
+	newThread(t, st, "t2", golang.NameSlug, alice.ID, "second")
+	newComment(t, st, "c1", "t2", bob.ID, "reply")
+	newComment(t, st, "c2", "t2", bob.ID, "another reply")
+
+	list, err := st.GetForumViewList()
+	check(t, err)
+	views := map[string]model.ForumView{}
+	for _, v := range list {
+		views[v.NameSlug] = v
+	}
+
+	g := views[golang.NameSlug]
+	if g.ThreadCount != 2 || g.PostCount != 4 {
+		t.Errorf("counts of %s = %d threads, %d posts, want 2 and 4", g.NameSlug, g.ThreadCount, g.PostCount)
+	}
+	if g.LastThreadID != "t2" || g.LastThreadTitle != "second" || g.LastUserName != "Bob" || g.LastPostAt == nil {
+		t.Errorf("latest post of %s = %+v", g.NameSlug, g)
+	}
+
+	e := views[empty.NameSlug]
+	if e.ThreadCount != 0 || e.PostCount != 0 || e.LastThreadID != "" || e.LastPostAt != nil {
+		t.Errorf("empty forum view = %+v", e)
+	}
+
+	goView := func() model.ForumView {
+		t.Helper()
+		list, err := st.GetForumViewList()
+		check(t, err)
+		for _, v := range list {
+			if v.NameSlug == golang.NameSlug {
+				return v
+			}
+		}
+		t.Fatalf("forum %s not listed", golang.NameSlug)
+		return model.ForumView{}
+	}
+
+	// deleted posts are not counted, nor the comments of deleted threads,
+	// and a deleted comment does not name the last poster
+	carol := newUser(t, st, "github", "3", "Carol")
+	newThread(t, st, "t3", golang.NameSlug, alice.ID, "third")
+	newComment(t, st, "c3", "t3", bob.ID, "reply to third")
+	check(t, st.DeleteThread("t3"))
+	newComment(t, st, "c4", "t2", carol.ID, "deleted reply")
+	check(t, st.DeleteComment("c4"))
+
+	g = goView()
+	if g.ThreadCount != 2 || g.PostCount != 4 {
+		t.Errorf("counts with deleted posts = %d threads, %d posts, want 2 and 4", g.ThreadCount, g.PostCount)
+	}
+	if g.LastThreadID != "t2" || g.LastUserName != "Bob" {
+		t.Errorf("latest post with a deleted comment = %s by %s, want t2 by Bob", g.LastThreadID, g.LastUserName)
+	}
+
+	// the last post time goes back when the last post is deleted, the
+	// timestamps have whole seconds
+	time.Sleep(time.Second)
+	newComment(t, st, "c5", "t1", carol.ID, "late reply")
+	if g = goView(); g.LastThreadID != "t1" || g.LastUserName != "Carol" {
+		t.Errorf("latest post = %s by %s, want t1 by Carol", g.LastThreadID, g.LastUserName)
+	}
+
+	check(t, st.DeleteComment("c5"))
+	thread, err := st.GetThread("t1")
+	check(t, err)
+	if !thread.LastPostAt.Equal(thread.CreatedAt) {
+		t.Errorf("last post of t1 at %s after its only comment was deleted, want %s", thread.LastPostAt, thread.CreatedAt)
+	}
+	if g = goView(); g.LastThreadID != "t2" || g.LastUserName != "Bob" {
+		t.Errorf("latest post after the delete = %s by %s, want t2 by Bob", g.LastThreadID, g.LastUserName)
+	}
+}
+
+func testThreads(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	forum := newForum(t, st, "Go")
+
+	_, err := st.GetThread("missing")
+	wantNotFound(t, "GetThread", err)
+
+	newThread(t, st, "t1", forum.NameSlug, alice.ID, "Hello")
+	newComment(t, st, "c1", "t1", alice.ID, "first")
+
+	thread, err := st.GetThread("t1")
+	check(t, err)
+	if thread.Title != "Hello" || thread.Content != "content of Hello" || thread.Deleted || thread.Edited() {
+		t.Errorf("GetThread = %+v", thread)
+	}
+
+	newComment(t, st, "c2", "t1", alice.ID, "deleted")
+	check(t, st.DeleteComment("c2"))
+
+	view, err := st.GetThreadView("t1")
+	check(t, err)
+	if view.UserName != "Alice" || view.CommentCount != 1 {
+		t.Errorf("GetThreadView = %+v", view)
+	}
+
+	list, err := st.GetThreadList(forum.NameSlug)
+	check(t, err)
+	if len(list) != 1 || list[0].ID != "t1" {
+		t.Errorf("GetThreadList = %+v", list)
+	}
+
+	check(t, st.UpdateThread(&model.Thread{ID: "t1", Title: "Hello again", Content: "edited"}))
+	thread, err = st.GetThread("t1")
+	check(t, err)
+	if thread.Title != "Hello again" || thread.Content != "edited" {
+		t.Errorf("GetThread after UpdateThread = %+v", thread)
+	}
+	// an edit shows even in the second the thread was created
+	if !thread.Edited() || !near(*thread.EditedAt, time.Now()) {
+		t.Errorf("thread edited at %v, want now", thread.EditedAt)
+	}
+
+	check(t, st.DeleteThread("t1"))
+	thread, err = st.GetThread("t1")
+	check(t, err)
+	if !thread.Deleted || thread.Content != "" {
+		t.Errorf("GetThread after DeleteThread = %+v", thread)
+	}
+
+	// revisions of the same second have no set order
+	revisions, err := st.GetRevisionList("t1")
+	check(t, err)
+	if got := revisionContents(revisions, "thread"); got != "content of Hello,edited" {
+		t.Errorf("revision contents = %q", got)
+	}
+
+	// a deleted thread is not edited
+	check(t, st.UpdateThread(&model.Thread{ID: "t1", Title: "back", Content: "back"}))
+	thread, err = st.GetThread("t1")
+	check(t, err)
+	if thread.Content != "" {
+		t.Errorf("deleted thread was edited: %+v", thread)
+	}
+}
+
+func testThreadViewPage(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	forum := newForum(t, st, "Go")
+	for i := 1; i <= 5; i++ {
+		newThread(t, st, fmt.Sprintf("t%d", i), forum.NameSlug, alice.ID, fmt.Sprintf("thread %d", i))
+	}
+	newThread(t, st, "t6", forum.NameSlug, alice.ID, "pinned")
+	check(t, st.SetThreadPinned("t6", true))
+
+	// t2 gets the most comments, the deleted one of t4 does not count
+	newComment(t, st, "c1", "t2", alice.ID, "one")
+	newComment(t, st, "c2", "t2", alice.ID, "two")
+	newComment(t, st, "c3", "t4", alice.ID, "three")
+	newComment(t, st, "c4", "t4", alice.ID, "deleted")
+	check(t, st.DeleteComment("c4"))
+
+	page := func(sort store.ThreadSort, p store.Page) string {
+		t.Helper()
+		list, err := st.GetThreadViewPage(forum.NameSlug, sort, p)
+		check(t, err)
+		return threadIDs(list)
+	}
+
+	if got := page(store.SortNewest, store.Page{Limit: 2}); got != "t5,t4" {
+		t.Errorf("first newest page = %s, want t5,t4", got)
+	}
+	if got := page(store.SortNewest, store.Page{After: "t4", Limit: 2}); got != "t3,t2" {
+		t.Errorf("newest page after t4 = %s, want t3,t2", got)
+	}
+	if got := page(store.SortNewest, store.Page{After: "t2", Limit: 2}); got != "t1" {
+		t.Errorf("last newest page = %s, want t1", got)
+	}
+	if got := page(store.SortNewest, store.Page{Before: "t2", Limit: 2}); got != "t4,t3" {
+		t.Errorf("newest page before t2 = %s, want t4,t3", got)
+	}
+
+	if got := page(store.SortComments, store.Page{Limit: 2}); got != "t2,t4" {
+		t.Errorf("first comments page = %s, want t2,t4", got)
+	}
+	list, err := st.GetThreadViewPage(forum.NameSlug, store.SortComments, store.Page{Limit: 2})
+	check(t, err)
+	if len(list) != 2 || list[0].CommentCount != 2 || list[1].CommentCount != 1 {
+		t.Errorf("comment counts = %+v", list)
+	}
+
+	if _, err := st.GetThreadViewPage(forum.NameSlug, "bogus", store.Page{Limit: 2}); err == nil {
+		t.Error("GetThreadViewPage took an unknown sort")
+	}
+
+	pinned, err := st.GetPinnedThreadViewList(forum.NameSlug)
+	check(t, err)
+	if threadIDs(pinned) != "t6" {
+		t.Errorf("GetPinnedThreadViewList = %s, want t6", threadIDs(pinned))
+	}
+}
+
+func testComments(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	forum := newForum(t, st, "Go")
+	newThread(t, st, "t1", forum.NameSlug, alice.ID, "Hello")
+
+	_, err := st.GetComment("missing")
+	wantNotFound(t, "GetComment", err)
+
+	for i := 1; i <= 5; i++ {
+		newComment(t, st, fmt.Sprintf("c%d", i), "t1", alice.ID, fmt.Sprintf("comment %d", i))
+	}
+
+	list, err := st.GetCommentList("t1")
+	check(t, err)
+	if len(list) != 5 || list[0].ID != "c1" || list[4].ID != "c5" {
+		t.Errorf("GetCommentList = %+v", list)
+	}
+
+	page := func(p store.Page) string {
+		t.Helper()
+		list, err := st.GetCommentViewPage("t1", p)
+		check(t, err)
+		return commentIDs(list)
+	}
+	if got := page(store.Page{Limit: 2}); got != "c1,c2" {
+		t.Errorf("first page = %s, want c1,c2", got)
+	}
+	if got := page(store.Page{After: "c2", Limit: 2}); got != "c3,c4" {
+		t.Errorf("page after c2 = %s, want c3,c4", got)
+	}
+	if got := page(store.Page{Before: "c5", Limit: 2}); got != "c3,c4" {
+		t.Errorf("page before c5 = %s, want c3,c4", got)
+	}
+
+	// ids are random and created_at has whole seconds, the order the
+	// comments were written in decides
+	newComment(t, st, "a6", "t1", alice.ID, "comment 6")
+	if got := page(store.Page{After: "c4", Limit: 5}); got != "c5,a6" {
+		t.Errorf("page after c4 = %s, want c5,a6", got)
+	}
+
+	views, err := st.GetCommentViewPage("t1", store.Page{Limit: 1})
+	check(t, err)
+	if len(views) != 1 || views[0].UserName != "Alice" {
+		t.Errorf("GetCommentViewPage = %+v", views)
+	}
+
+	check(t, st.UpdateComment(&model.Comment{ID: "c1", Content: "edited"}))
+	comment, err := st.GetComment("c1")
+	check(t, err)
+	if comment.Content != "edited" || !comment.Edited() || !near(*comment.EditedAt, time.Now()) {
+		t.Errorf("GetComment after UpdateComment = %+v", comment)
+	}
+	comment, err = st.GetComment("c2")
+	check(t, err)
+	if comment.Edited() {
+		t.Errorf("comment never edited has edited at %v", comment.EditedAt)
+	}
+
+	check(t, st.DeleteComment("c1"))
+	comment, err = st.GetComment("c1")
+	check(t, err)
+	if !comment.Deleted || comment.Content != "" {
+		t.Errorf("GetComment after DeleteComment = %+v", comment)
+	}
+
+	revisions, err := st.GetRevisionList("c1")
+	check(t, err)
+	if got := revisionContents(revisions, "comment"); got != "comment 1,edited" {
+		t.Errorf("revision contents = %q", got)
+	}
+}
+
+func testRoles(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	bob := newUser(t, st, "github", "2", "Bob")
+	carol := newUser(t, st, "github", "3", "Carol")
+
+	check(t, st.SetUserRole(alice.ID, model.RoleAdmin))
+	wantNotFound(t, "SetUserRole", st.SetUserRole("missing", model.RoleAdmin))
+
+	until := time.Now().Add(24 * time.Hour).UTC()
+	check(t, st.BanUser(bob.ID, until))
+	check(t, st.BanUser(carol.ID, time.Time{}))
+	wantNotFound(t, "BanUser", st.BanUser("missing", until))
+
+	got, err := st.GetUser(bob.ID)
+	check(t, err)
+	if got.Role != model.RoleBanned || got.BannedUntil == nil || !near(*got.BannedUntil, until) {
+		t.Errorf("user banned for a day = %+v", got)
+	}
+	got, err = st.GetUser(carol.ID)
+	check(t, err)
+	if got.Role != model.RoleBanned || got.BannedUntil != nil {
+		t.Errorf("user banned forever = %+v", got)
+	}
+
+	banned, err := st.GetUserList(model.RoleBanned)
+	check(t, err)
+	if userIDs(banned) != bob.ID+","+carol.ID {
+		t.Errorf("GetUserList(banned) = %s", userIDs(banned))
+	}
+	all, err := st.GetUserList("")
+	check(t, err)
+	if len(all) != 3 {
+		t.Errorf("GetUserList() has %d users", len(all))
+	}
+
+	// a new role ends the ban
+	check(t, st.SetUserRole(bob.ID, model.RoleMember))
+	got, err = st.GetUser(bob.ID)
+	check(t, err)
+	if got.Role != model.RoleMember || got.BannedUntil != nil {
+		t.Errorf("unbanned user = %+v", got)
+	}
+}
+
+func testForumModerators(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	bob := newUser(t, st, "github", "2", "Bob")
+	forum := newForum(t, st, "Go")
+
+	check(t, st.AddForumModerator(forum.NameSlug, bob.ID))
+	check(t, st.AddForumModerator(forum.NameSlug, alice.ID))
+	check(t, st.AddForumModerator(forum.NameSlug, alice.ID))
+
+	list, err := st.GetForumModeratorList(forum.NameSlug)
+	check(t, err)
+	if userIDs(list) != alice.ID+","+bob.ID {
+		t.Errorf("GetForumModeratorList = %s", userIDs(list))
+	}
+
+	ok, err := st.IsForumModerator(forum.NameSlug, bob.ID)
+	check(t, err)
+	if !ok {
+		t.Error("IsForumModerator = false for a moderator")
+	}
+
+	check(t, st.RemoveForumModerator(forum.NameSlug, bob.ID))
+	wantNotFound(t, "RemoveForumModerator", st.RemoveForumModerator(forum.NameSlug, bob.ID))
+
+	ok, err = st.IsForumModerator(forum.NameSlug, bob.ID)
+	check(t, err)
+	if ok {
+		t.Error("IsForumModerator = true after RemoveForumModerator")
+	}
+}
+
+func testThreadModeration(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	golang := newForum(t, st, "Go")
+	rust := newForum(t, st, "Rust")
+	newThread(t, st, "t1", golang.NameSlug, alice.ID, "Hello")
+
+	check(t, st.SetThreadLocked("t1", true))
+	check(t, st.SetThreadPinned("t1", true))
+	check(t, st.MoveThread("t1", rust.NameSlug))
+
+	thread, err := st.GetThread("t1")
+	check(t, err)
+	if !thread.Locked || !thread.Pinned || thread.ForumName != rust.NameSlug {
+		t.Errorf("moderated thread = %+v", thread)
+	}
+
+	check(t, st.SetThreadLocked("t1", false))
+	thread, err = st.GetThread("t1")
+	check(t, err)
+	if thread.Locked {
+		t.Error("thread still locked")
+	}
+
+	wantNotFound(t, "SetThreadLocked", st.SetThreadLocked("missing", true))
+	wantNotFound(t, "SetThreadPinned", st.SetThreadPinned("missing", true))
+	wantNotFound(t, "MoveThread", st.MoveThread("missing", rust.NameSlug))
+}
+
+func testAuditLog(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+
+	for i := 1; i <= 3; i++ {
+		check(t, st.CreateAuditLog(&model.AuditLog{
+			ID:         fmt.Sprintf("a%d", i),
+			UserID:     alice.ID,
+			Action:     "lock_thread",
+			TargetType: "thread",
+			TargetID:   fmt.Sprintf("t%d", i),
+		}))
+	}
+	entry := model.AuditLog{UserID: "missing", Action: "ban_user", TargetType: "user"}
+	check(t, st.CreateAuditLog(&entry))
+	if entry.ID == "" {
+		t.Error("CreateAuditLog did not set the id")
+	}
+
+	list, err := st.GetAuditLogList(3)
+	check(t, err)
+	if len(list) != 3 {
+		t.Fatalf("GetAuditLogList(3) has %d entries", len(list))
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i].CreatedAt.After(list[i-1].CreatedAt) {
+			t.Errorf("GetAuditLogList is not newest first: %+v", list)
+		}
+	}
+	for _, e := range list {
+		if e.UserID == alice.ID && e.UserName != "Alice" {
+			t.Errorf("entry %s has user name %q", e.ID, e.UserName)
+		}
+	}
+}
+
+func testChat(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+
+	_, err := st.GetChatRoom("missing")
+	wantNotFound(t, "GetChatRoom", err)
+
+	lobby := model.ChatRoom{Name: "Lobby"}
+	check(t, st.CreateChatRoom(&lobby))
+	again := model.ChatRoom{Name: "lobby"}
+	check(t, st.CreateChatRoom(&again))
+	if lobby.NameSlug != "lobby" || again.NameSlug != "lobby-2" {
+		t.Errorf("room slugs %q and %q", lobby.NameSlug, again.NameSlug)
+	}
+
+	got, err := st.GetChatRoom("LOBBY")
+	check(t, err)
+	if got.Name != "Lobby" {
+		t.Errorf("GetChatRoom = %+v", got)
+	}
+
+	rooms, err := st.GetChatRoomList()
+	check(t, err)
+	if len(rooms) != 2 {
+		t.Errorf("GetChatRoomList = %+v", rooms)
+	}
+
+	for i := 1; i <= 5; i++ {
+		check(t, st.CreateChatMessage(&model.ChatMessage{
+			ID:      fmt.Sprintf("m%d", i),
+			RoomID:  lobby.NameSlug,
+			UserID:  alice.ID,
+			Content: fmt.Sprintf("message %d", i),
+		}))
+	}
+
+	message, err := st.GetChatMessage("m1")
+	check(t, err)
+	if message.Content != "message 1" || message.RoomID != lobby.NameSlug {
+		t.Errorf("GetChatMessage = %+v", message)
+	}
+
+	list, err := st.GetChatMessageList(lobby.NameSlug)
+	check(t, err)
+	if len(list) != 5 {
+		t.Errorf("GetChatMessageList has %d messages", len(list))
+	}
+
+	pageIDs := func(before string) string {
+		t.Helper()
+		page, err := st.GetChatMessagePage(lobby.NameSlug, before, 2)
+		check(t, err)
+		var ids []string
+		for _, m := range page {
+			if m.UserName != "Alice" {
+				t.Errorf("message %s has user name %q", m.ID, m.UserName)
+			}
+			ids = append(ids, m.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := pageIDs(""); got != "m4,m5" {
+		t.Errorf("latest page = %s, want m4,m5", got)
+	}
+	if got := pageIDs("m4"); got != "m2,m3" {
+		t.Errorf("page before m4 = %s, want m2,m3", got)
+	}
+
+	// the order of writing decides, not the random ids
+	check(t, st.CreateChatMessage(&model.ChatMessage{ID: "a6", RoomID: lobby.NameSlug, UserID: alice.ID, Content: "message 6"}))
+	if got := pageIDs(""); got != "m5,a6" {
+		t.Errorf("latest page = %s, want m5,a6", got)
+	}
+	if got := pageIDs("a6"); got != "m4,m5" {
+		t.Errorf("page before a6 = %s, want m4,m5", got)
+	}
+
+	check(t, st.DeleteChatMessage("m5"))
+	_, err = st.GetChatMessage("m5")
+	wantNotFound(t, "GetChatMessage after DeleteChatMessage", err)
+
+	check(t, st.DeleteChatRoom("lobby-2"))
+	_, err = st.GetChatRoom("lobby-2")
+	wantNotFound(t, "GetChatRoom after DeleteChatRoom", err)
+}
+
+func testSearch(t *testing.T, st store.Store) {
+	alice := newUser(t, st, "github", "1", "Alice")
+	bob := newUser(t, st, "github", "2", "Bob")
+	golang := newForum(t, st, "Go")
+	rust := newForum(t, st, "Rust")
+
+	check(t, st.CreateThread(&model.Thread{ID: "t1", ForumName: golang.NameSlug, Title: "Goroutines", Content: "about zebras", UserID: alice.ID}))
+	check(t, st.CreateThread(&model.Thread{ID: "t2", ForumName: rust.NameSlug, Title: "Ownership", Content: "no zebras here", UserID: bob.ID}))
+	check(t, st.CreateThread(&model.Thread{ID: "t3", ForumName: golang.NameSlug, Title: "Deleted", Content: "zebras gone", UserID: bob.ID}))
+	check(t, st.DeleteThread("t3"))
+	newComment(t, st, "c1", "t1", bob.ID, "zebras everywhere")
+	room := model.ChatRoom{Name: "Lobby"}
+	check(t, st.CreateChatRoom(&room))
+	check(t, st.CreateChatMessage(&model.ChatMessage{ID: "m1", RoomID: room.NameSlug, UserID: alice.ID, Content: "zebras in chat"}))
+
+	search := func(q store.SearchQuery, scope store.SearchScope) map[string]model.SearchResult {
+		t.Helper()
+		results, err := st.Search(q, scope, 1)
+		check(t, err)
+		found := make(map[string]model.SearchResult)
+		for _, r := range results {
+			found[r.ID] = r
+		}
+		return found
+	}
+
+	all := search(store.SearchQuery{Text: "zebras", Limit: 10}, store.SearchAll)
+	for _, id := range []string{"t1", "t2", "c1", "m1"} {
+		if _, ok := all[id]; !ok {
+			t.Errorf("search for zebras did not find %s", id)
+		}
+	}
+	if _, ok := all["t3"]; ok {
+		t.Error("search found a deleted thread")
+	}
+	if r := all["c1"]; r.Kind != "comment" || r.ThreadID != "t1" || r.UserName != "Bob" {
+		t.Errorf("comment result = %+v", r)
+	}
+	if r := all["t1"]; !strings.Contains(r.Snippet, store.HighlightStart) {
+		t.Errorf("snippet %q does not mark the match", r.Snippet)
+	}
+
+	comments := search(store.SearchQuery{Text: "zebras", Limit: 10}, store.SearchComments)
+	if len(comments) != 1 || comments["c1"].Kind != "comment" {
+		t.Errorf("comment search = %v", comments)
+	}
+
+	inGo := search(store.SearchQuery{Text: "zebras", Forum: golang.NameSlug, Limit: 10}, store.SearchAll)
+	if _, ok := inGo["t2"]; ok {
+		t.Error("forum filter kept a thread of another forum")
+	}
+	if _, ok := inGo["m1"]; ok {
+		t.Error("forum filter kept a chat message")
+	}
+
+	byBob := search(store.SearchQuery{Text: "zebras", Author: "bob", Limit: 10}, store.SearchAll)
+	if _, ok := byBob["t1"]; ok {
+		t.Error("author filter kept a thread of another author")
+	}
+	if _, ok := byBob["c1"]; !ok {
+		t.Error("author filter dropped a comment of the author")
+	}
+
+	if none := search(store.SearchQuery{Text: "giraffes", Limit: 10}, store.SearchAll); len(none) != 0 {
+		t.Errorf("search for giraffes = %v", none)
+	}
+
+	// edits and deletes reach the index
+	check(t, st.UpdateComment(&model.Comment{ID: "c1", Content: "giraffes everywhere"}))
+	check(t, st.DeleteChatMessage("m1"))
+	all = search(store.SearchQuery{Text: "zebras", Limit: 10}, store.SearchAll)
+	if _, ok := all["c1"]; ok {
+		t.Error("search found the old text of an edited comment")
+	}
+	if _, ok := all["m1"]; ok {
+		t.Error("search found a deleted chat message")
+	}
+	if _, ok := all["t1"]; !ok {
+		t.Error("search lost a thread after editing another post")
+	}
+	if _, ok := search(store.SearchQuery{Text: "giraffes", Limit: 10}, store.SearchComments)["c1"]; !ok {
+		t.Error("search did not find the new text of an edited comment")
+	}
+}
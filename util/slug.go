@@ -0,0 +1,91 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MaxSlugLength is the maximum number of runes in a slug, not counting
+// the suffix added by UniqueSlug.
+const MaxSlugLength = 64
+
+// foldRunes spells Latin letters with diacritics, and the ones that do
+// not decompose, in ASCII.
+var foldRunes = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae",
+	'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c",
+	'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ĝ': "g", 'ğ': "g", 'ġ': "g", 'ģ': "g",
+	'ĥ': "h", 'ħ': "h",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i",
+	'ĵ': "j",
+	'ķ': "k",
+	'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o",
+	'œ': "oe",
+	'ŕ': "r", 'ŗ': "r", 'ř': "r",
+	'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ß': "ss",
+	'ţ': "t", 'ť': "t", 'ŧ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ũ': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ŵ': "w",
+	'ý': "y", 'ÿ': "y", 'ŷ': "y",
+	'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// Slugify turns a name into a lower case URL path segment: Latin letters
+// lose their diacritics, other letters and digits are kept, and every
+// run of other characters becomes a single hyphen. It returns "" when
+// the name has no letters or digits.
+func Slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		s, ok := foldRunes[r]
+		switch {
+		case ok:
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			s = string(r)
+		case r > unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsNumber(r)):
+			s = string(r)
+		case unicode.Is(unicode.Mn, r):
+			// combining marks of decomposed letters
+			continue
+		default:
+			hyphen = b.Len() > 0
+			continue
+		}
+
+		if hyphen {
+			b.WriteByte('-')
+			hyphen = false
+		}
+		b.WriteString(s)
+	}
+
+	slug := []rune(b.String())
+	if len(slug) > MaxSlugLength {
+		slug = slug[:MaxSlugLength]
+	}
+
+	return strings.TrimRight(string(slug), "-")
+}
+
+// UniqueSlug returns base, or base followed by -2, -3 and so on, the
+// first one that taken reports as free.
+func UniqueSlug(base string, taken func(slug string) (bool, error)) (string, error) {
+	slug := base
+	for i := 2; ; i++ {
+		t, err := taken(slug)
+		if err != nil {
+			return "", err
+		}
+		if !t {
+			return slug, nil
+		}
+		slug = base + "-" + strconv.Itoa(i)
+	}
+}
@@ -2,16 +2,29 @@ package util
 
 import "crypto/rand"
 
+// RandomID returns 32 random alphanumeric characters, about 190 bits.
 func RandomID() string {
 	const (
-		length  = 16
+		length  = 32
 		charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+		// bytes from limit up are dropped so every character is equally
+		// likely, limit is the largest multiple of len(charset) below 256
+		limit = 256 - 256%len(charset)
 	)
-	lenCharset := byte(len(charset))
-	b := make([]byte, length)
-	rand.Read(b)
-	for i := 0; i < length; i++ {
-		b[i] = charset[b[i]%lenCharset]
+
+	id := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(id) < length {
+		_, err := rand.Read(buf)
+		if err != nil {
+			panic("util: crypto/rand failed: " + err.Error())
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(id) < length {
+				id = append(id, charset[int(b)%len(charset)])
+			}
+		}
 	}
-	return string(b)
+
+	return string(id)
 }